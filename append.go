@@ -0,0 +1,75 @@
+package bitcask
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+	"github.com/prologic/bitcask/internal/data/codec"
+)
+
+// AppendRaw writes the already encoded entry `encoded`, such as one copied
+// from the datafiles of another database, to the current datafile as it is
+// and updates the index, returning where it was written. An entry with an
+// empty value deletes its key. The key is stored as it is, including any key
+// prefix (see WithKeyPrefix).
+//
+// ErrInvalidEntry is returned if `encoded` isn't a single entry within the
+// maximum key and value sizes, or is one whose value is stored in a blob
+// file, and ErrChecksumFailed if its value doesn't match its checksum. With
+// WithEntryAlignment() the entry is encoded again to be padded.
+func (b *Bitcask) AppendRaw(encoded []byte) (Meta, error) {
+	if err := b.lockWrite(); err != nil {
+		return Meta{}, err
+	}
+
+	var e internal.Entry
+	if err := codec.DecodeEntry(encoded, &e, b.config.MaxKeySize, b.config.MaxValueSize); err != nil {
+		b.mu.Unlock()
+		return Meta{}, fmt.Errorf("%w: %v", ErrInvalidEntry, err)
+	}
+	if e.Blob {
+		b.mu.Unlock()
+		return Meta{}, fmt.Errorf("%w: values stored in blob files can't be appended", ErrInvalidEntry)
+	}
+	if !e.Verify(e.Value) {
+		b.mu.Unlock()
+		return Meta{}, ErrChecksumFailed
+	}
+
+	offset, n, err := b.write(func(df data.Datafile) (int64, int64, error) {
+		if b.config.EntryAlignment > 1 {
+			return df.Write(e)
+		}
+		return df.WriteRaw(encoded)
+	})
+	if err != nil {
+		b.mu.Unlock()
+		return Meta{}, err
+	}
+
+	meta := Meta{FileID: b.curr.FileID(), Offset: offset, Size: n}
+	if e.ModTime != 0 {
+		meta.ModTime = time.Unix(0, e.ModTime)
+	}
+	if e.Expiry != 0 {
+		meta.Expiry = time.Unix(0, e.Expiry)
+	}
+
+	if len(e.Value) == 0 {
+		if value, found := b.trie.Search(e.Key); found {
+			b.deleted(e.Key, value.(internal.Item))
+		}
+	} else {
+		err = b.inserted(e, e.Value, offset, n)
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return Meta{}, err
+	}
+
+	b.maybeMerge()
+
+	return meta, nil
+}
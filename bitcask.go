@@ -1,26 +1,51 @@
 package bitcask
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
-	"hash/crc32"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"math"
+	"math/bits"
 	"os"
-	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gofrs/flock"
 	art "github.com/plar/go-adaptive-radix-tree"
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/config"
 	"github.com/prologic/bitcask/internal/data"
+	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/internal/fs"
 	"github.com/prologic/bitcask/internal/index"
 )
 
+// rename renames a file on a file system, replaceable by tests to inject
+// failures
+var rename = func(fsys fs.FS, oldpath, newpath string) error {
+	return fsys.Rename(oldpath, newpath)
+}
+
+const (
+	mergeCommitFilename = "merge.commit"
+
+	// lockRetryDelay is how often Open() retries the lock when a lock
+	// timeout is configured
+	lockRetryDelay = 10 * time.Millisecond
+)
+
 var (
-	// ErrKeyNotFound is the error returned when a key is not found
+	// ErrKeyNotFound is the error returned when a key is not found. It is
+	// never returned for a key that exists but could not be read.
 	ErrKeyNotFound = errors.New("error: key not found")
 
 	// ErrKeyTooLarge is the error returned for a key that exceeds the
@@ -38,6 +63,70 @@ var (
 	// ErrDatabaseLocked is the error returned if the database is locked
 	// (typically opened by another process)
 	ErrDatabaseLocked = errors.New("error: database locked")
+
+	// ErrMergeInProgress is the error returned if Merge() is called when
+	// a merge is already in progress
+	ErrMergeInProgress = errors.New("error: merge already in progress")
+
+	// ErrMergeVerifyFailed is the error returned by Merge() with
+	// WithMergeVerify() if the merged database fails to verify
+	ErrMergeVerifyFailed = errors.New("error: merged database failed verification")
+
+	// ErrIteratorClosed is the error returned when reading from an Iterator
+	// that has been closed
+	ErrIteratorClosed = errors.New("error: iterator closed")
+
+	// ErrWriteTimeout is the error returned when a write could not acquire
+	// the database's lock within the timeout set with WithWriteTimeout
+	ErrWriteTimeout = errors.New("error: write timed out")
+
+	// ErrDatabaseClosed is the error returned by Merge() if the database
+	// was closed while the merge was in progress, and by HasE() once the
+	// database is closed
+	ErrDatabaseClosed = errors.New("error: database closed")
+
+	// ErrCallbackPanicked is the error returned by methods calling a user
+	// callback that panicked if a panic handler is set (see
+	// WithPanicHandler)
+	ErrCallbackPanicked = errors.New("error: callback panicked")
+
+	// ErrDatafileFormatChanged is the error returned when opening an existing
+	// database with a different datafile extension or magic setting
+	ErrDatafileFormatChanged = errors.New("error: datafile format can't be changed")
+
+	// ErrIncompatibleConfig is the error returned by Reconfigure() for a
+	// change that can't be applied to the database while it is open
+	ErrIncompatibleConfig = errors.New("error: incompatible configuration change")
+
+	// ErrDatafileNotFound is the error returned by ReadEntryAt() when there
+	// is no datafile with the given id, and by reads of a key whose datafile
+	// is missing
+	ErrDatafileNotFound = errors.New("error: datafile not found")
+
+	// ErrInvalidEntry is the error returned by ReadEntryAt() when there is no
+	// entry of the given size at the given offset, and wrapped by reads of a
+	// key whose entry can't be decoded
+	ErrInvalidEntry = errors.New("error: invalid entry")
+
+	// ErrShortRead is the error returned by reads of a key whose datafile
+	// ends before its entry
+	ErrShortRead = data.ErrShortRead
+
+	// ErrFooterMismatch is the error returned by Open() with
+	// WithVerifyDatafileFooters() when a sealed datafile was modified
+	ErrFooterMismatch = data.ErrFooterMismatch
+
+	// ErrReadOnly is the error returned by writes once a write failed with
+	// WithReadOnlyAfterError(), until ResetReadOnly() is called
+	ErrReadOnly = errors.New("error: database is read-only after a write error")
+
+	// ErrInvalidLimit is the error returned by ScanPage() for a limit that
+	// isn't positive
+	ErrInvalidLimit = errors.New("error: invalid limit")
+
+	// ErrBufferTooSmall is the error returned by GetInto() when the value
+	// doesn't fit in the given buffer
+	ErrBufferTooSmall = errors.New("error: buffer too small")
 )
 
 // Bitcask is a struct that represents a on-disk LSM and WAL data structure
@@ -55,43 +144,231 @@ type Bitcask struct {
 	datafiles map[int]data.Datafile
 	trie      art.Tree
 	indexer   index.Indexer
+	merging   int32
+	cache     *data.Cache
+	indexes   map[string]*secondaryIndex
+	watchers  map[*watcher]struct{}
+	mergeLog  *mergeLog
+	closed    bool
+	blobs     *blobStore
+
+	// locked is 1 while the database holds its lock, which is also the case
+	// on file systems without file locks (see lock)
+	locked int32
+
+	// removeLock is set by openSource() if it created the lock file
+	removeLock bool
+
+	// writeErr is the write error that made the database read-only (see
+	// WithReadOnlyAfterError)
+	writeErr error
+
+	// blobRefs records the blob files referenced by a merged database
+	blobRefs map[uint64]struct{}
+
+	loadMu sync.Mutex
+	loads  map[string]*loadCall
+
+	// liveBytes is the size of the entries of the live keys
+	liveBytes int64
+
+	recoveredFromIndex bool
+
+	// syncMu guards the syncer, which Reconfigure() restarts while the
+	// database is in use. syncStopped is set once it is stopped for good.
+	syncMu      sync.Mutex
+	syncStop    chan struct{}
+	syncDone    chan struct{}
+	syncStopped bool
+
+	metricsStop chan struct{}
+	metricsDone chan struct{}
 }
 
 // Stats is a struct returned by Stats() on an open Bitcask instance
-type Stats struct {
-	Datafiles int
-	Keys      int
-	Size      int64
-}
+type Stats = internal.Stats
+
+// Observer is notified of lifecycle events of the database (see WithObserver)
+type Observer = internal.Observer
+
+// NopObserver is an Observer that ignores all events. Embed it to implement
+// only some of the methods of Observer.
+type NopObserver = internal.NopObserver
+
+// FS is a file system a database can be stored on (see WithFileSystem)
+type FS = fs.FS
+
+// File is an open file of a FS
+type File = fs.File
 
 // Stats returns statistics about the database including the number of
-// data files, keys and overall size on disk of the data
+// data files, keys and overall size on disk of the database directory. The
+// size includes the index, config and lock files as well as any temporary
+// merge files, see DataSize() for the size of the datafiles alone.
 func (b *Bitcask) Stats() (stats Stats, err error) {
-	if stats.Size, err = internal.DirSize(b.path); err != nil {
+	if stats.Size, err = internal.DirSize(b.config.FS, b.path); err != nil {
 		return
 	}
 
 	b.mu.RLock()
 	stats.Datafiles = len(b.datafiles)
 	stats.Keys = b.trie.Size()
+	stats.DeadBytes = b.dataSize() - b.liveBytes - b.headerBytes()
+	stats.RecoveredFromIndex = b.recoveredFromIndex
 	b.mu.RUnlock()
 
 	return
 }
 
+// DataSize returns the size on disk of the datafiles of the database only,
+// unlike Stats() which reports the size of the whole database directory.
+func (b *Bitcask) DataSize() (int64, error) {
+	return internal.DataSize(b.config.FS, b.path, b.config.DatafileExt, b.config.DatafileMagic)
+}
+
+// SizeHistogram holds the distribution of the key and value sizes of the
+// database. Bucket 0 counts empty sizes and bucket i > 0 counts the sizes in
+// the range [2^(i-1), 2^i).
+type SizeHistogram struct {
+	Keys   []int
+	Values []int
+}
+
+// SizeHistogram returns the distribution of the key and value sizes of all
+// keys in the database. Value sizes are read from the headers of the entries
+// (and the sizes of blob files) without reading the values. Values whose
+// size can't be read are left out.
+func (b *Bitcask) SizeHistogram() SizeHistogram {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var h SizeHistogram
+	add := func(buckets []int, size int64) []int {
+		i := bits.Len64(uint64(size))
+		for len(buckets) <= i {
+			buckets = append(buckets, 0)
+		}
+		buckets[i]++
+		return buckets
+	}
+
+	b.forEachPrefix(b.config.KeyPrefix, func(node art.Node) bool {
+		item := node.Value().(internal.Item)
+		key := int64(len(node.Key()))
+		h.Keys = add(h.Keys, key-int64(len(b.config.KeyPrefix)))
+		if size, err := b.valueSize(item); err == nil {
+			h.Values = add(h.Values, size)
+		}
+		return true
+	})
+
+	return h
+}
+
+// valueSize returns the size of the value located by `item` as recorded in
+// the header of its entry, or the size of its blob file. The caller must
+// hold at least a read lock.
+func (b *Bitcask) valueSize(item internal.Item) (int64, error) {
+	df := b.datafile(item.FileID)
+	if df == nil {
+		return 0, ErrDatafileNotFound
+	}
+	size, blob, err := df.ReadValueSize(item.Offset)
+	if err != nil || !blob {
+		return size, err
+	}
+
+	// The value of a blob entry is the reference to its blob file
+	e, err := b.readEntry(item)
+	if err != nil {
+		return 0, err
+	}
+	return b.blobs.size(e.Value)
+}
+
+// DatafileInfo describes a single datafile of the database
+type DatafileInfo struct {
+	ID      int
+	Size    int64
+	Entries int
+}
+
+// Datafiles returns information about every datafile of the database
+// (including the current one) ordered by id. Counting the entries requires
+// reading each datafile in full so this should not be called frequently on
+// large databases.
+func (b *Bitcask) Datafiles() ([]DatafileInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var infos []DatafileInfo
+	for _, id := range b.datafileIDs() {
+		info := DatafileInfo{ID: id}
+		if id == b.curr.FileID() {
+			info.Size = b.curr.Size()
+		} else {
+			info.Size = b.datafiles[id].Size()
+		}
+
+		err := b.scanDatafile(id, func(e internal.Entry, item internal.Item) error {
+			info.Entries++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
 // Close closes the database and removes the lock. It is important to call
 // Close() as this is the only way to cleanup the lock held by the open
-// database.
+// database. With WithBackgroundMergeOnClose() the database is merged first.
 func (b *Bitcask) Close() error {
-	defer func() {
-		b.Flock.Unlock()
-		os.Remove(b.Flock.Path())
-	}()
+	defer b.unlock()
+
+	var mergeErr error
+	if b.config.MergeOnClose {
+		if err := b.Merge(); err != nil && err != ErrMergeInProgress {
+			mergeErr = fmt.Errorf("error merging on close: %w", err)
+		}
+	}
 
-	if err := b.indexer.Save(b.trie, filepath.Join(b.path, "index")); err != nil {
+	if err := b.close(); err != nil {
 		return err
 	}
+	return mergeErr
+}
+
+func (b *Bitcask) close() error {
+	b.stopSyncer()
+	b.stopMetricsLogger()
+
+	b.mu.Lock()
+	b.closed = true
+	b.closeWatchers()
+	noIndexFile := b.config.NoIndexFile
+	b.mu.Unlock()
+
+	if noIndexFile {
+		// Remove any stale index so it is never trusted on a later open
+		if err := b.config.FS.Remove(filepath.Join(b.path, "index")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		if err := b.indexer.Save(b.trie, filepath.Join(b.path, "index")); err != nil {
+			return err
+		}
+		b.hook(func() { b.observer().IndexWritten(b.trie.Size()) })
+	}
 
+	return b.closeDatafiles()
+}
+
+func (b *Bitcask) closeDatafiles() error {
 	for _, df := range b.datafiles {
 		if err := df.Close(); err != nil {
 			return err
@@ -101,338 +378,2571 @@ func (b *Bitcask) Close() error {
 	return b.curr.Close()
 }
 
-// Sync flushes all buffers to disk ensuring all data is written
+// Sync flushes all buffers to disk ensuring all data is written, including
+// the directory entries of the datafiles created so they can't be lost on a
+// crash
 func (b *Bitcask) Sync() error {
-	return b.curr.Sync()
+	// The read lock keeps the current datafile from being rolled over
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if err := b.curr.Sync(); err != nil {
+		return err
+	}
+	return fs.SyncDir(b.config.FS, b.path)
+}
+
+// syncer periodically syncs the current datafile until `stop` is closed
+func (b *Bitcask) syncer(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.mu.RLock()
+			b.curr.Sync()
+			b.mu.RUnlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// startSyncer starts the syncer with the given interval. The caller must
+// hold syncMu unless the database isn't in use yet.
+func (b *Bitcask) startSyncer(interval time.Duration) {
+	b.syncStop = make(chan struct{})
+	b.syncDone = make(chan struct{})
+	go b.syncer(interval, b.syncStop, b.syncDone)
+}
+
+// haltSyncer stops the syncer, if running. The caller must hold syncMu.
+func (b *Bitcask) haltSyncer() {
+	if b.syncStop == nil {
+		return
+	}
+	close(b.syncStop)
+	<-b.syncDone
+	b.syncStop = nil
+}
+
+// stopSyncer stops the syncer for good so Reconfigure() can't restart it
+func (b *Bitcask) stopSyncer() {
+	b.syncMu.Lock()
+	defer b.syncMu.Unlock()
+
+	b.syncStopped = true
+	b.haltSyncer()
+}
+
+// restartSyncer restarts the syncer with the configured interval, or leaves
+// it stopped if the interval is 0 or the database was closed. The syncer
+// syncs with the read lock held so the caller must not hold the lock.
+func (b *Bitcask) restartSyncer() {
+	b.syncMu.Lock()
+	defer b.syncMu.Unlock()
+
+	if b.syncStopped {
+		return
+	}
+
+	b.mu.RLock()
+	interval := b.config.SyncInterval
+	b.mu.RUnlock()
+
+	b.haltSyncer()
+	if interval > 0 {
+		b.startSyncer(interval)
+	}
+}
+
+// Health checks that the database is usable, returning nil if it is open and
+// holds its lock, the current datafile is writable and a value can be read
+// back from disk. Otherwise an error describing the problem is returned.
+func (b *Bitcask) Health() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed || !b.isLocked() {
+		return errors.New("error: database is closed or not locked")
+	}
+
+	if b.writeErr != nil {
+		return fmt.Errorf("%w: %v", ErrReadOnly, b.writeErr)
+	}
+
+	if err := b.curr.Sync(); err != nil {
+		return fmt.Errorf("error: current datafile is not writable: %w", err)
+	}
+
+	var err error
+	b.trie.ForEach(func(node art.Node) bool {
+		if node.Kind() != art.Leaf {
+			return true
+		}
+		_, err = b.readItem(node.Value().(internal.Item))
+		return false
+	})
+	if err != nil {
+		return fmt.Errorf("error: reading from datafiles failed: %w", err)
+	}
+
+	return nil
 }
 
 // Get retrieves the value of the given key. If the key is not found or an/I/O
 // error occurs a null byte slice is returned along with the error.
+//
+// ErrKeyNotFound is only ever returned when the key does not exist. If the key
+// exists but its value could not be read, ErrChecksumFailed is returned if the
+// value is corrupt, ErrInvalidEntry (wrapped) if its entry can't be decoded,
+// ErrShortRead or ErrDatafileNotFound if its datafile is truncated or missing,
+// or otherwise the I/O error from the underlying datafile.
 func (b *Bitcask) Get(key []byte) ([]byte, error) {
-	var df data.Datafile
+	value, _, err := b.get(b.storedKey(key))
+	return value, err
+}
+
+// GetInto retrieves the value of the given key like Get() and copies it into
+// `dst`, returning its length. This lets readers reuse a buffer rather than
+// holding on to a freshly allocated value for every key read. If the value
+// doesn't fit in `dst`, ErrBufferTooSmall is returned along with its length
+// so that the caller can grow the buffer and retry.
+func (b *Bitcask) GetInto(key, dst []byte) (int, error) {
+	value, _, err := b.get(b.storedKey(key))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(value) > len(dst) {
+		return len(value), ErrBufferTooSmall
+	}
+	return copy(dst, value), nil
+}
+
+// Meta is the metadata of a key returned along with its value by
+// GetWithMeta()
+type Meta struct {
+	// ModTime is when the key was last written, the zero time if it was not
+	// recorded (see WithModTimes)
+	ModTime time.Time
+	// Expiry is when the key expires, the zero time if it never does (see
+	// PutWithTTL)
+	Expiry time.Time
+	// FileID, Offset and Size locate the entry of the key in the datafiles
+	// until it is overwritten or merged (see ReadEntryAt)
+	FileID int
+	Offset int64
+	Size   int64
+}
+
+// GetWithMeta retrieves the value of the given key like Get() along with its
+// metadata.
+func (b *Bitcask) GetWithMeta(key []byte) ([]byte, Meta, error) {
+	value, item, err := b.get(b.storedKey(key))
+	if err != nil {
+		return nil, Meta{}, err
+	}
+
+	meta := Meta{FileID: item.FileID, Offset: item.Offset, Size: item.Size}
+	if item.ModTime != 0 {
+		meta.ModTime = time.Unix(0, item.ModTime)
+	}
+	if item.Expiry != 0 {
+		meta.Expiry = time.Unix(0, item.Expiry)
+	}
+	return value, meta, nil
+}
+
+// GetTagged retrieves the value of the given key like Get() along with the
+// tag it was stored with by PutTagged(), 0 if it was stored untagged.
+func (b *Bitcask) GetTagged(key []byte) ([]byte, uint8, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
+	value, found := b.trie.Search(b.storedKey(key))
+	if !found || b.expired(value.(internal.Item)) {
+		return nil, 0, ErrKeyNotFound
+	}
+	return b.readTagged(value.(internal.Item))
+}
+
+func (b *Bitcask) get(key []byte) ([]byte, internal.Item, error) {
 	b.mu.RLock()
 	value, found := b.trie.Search(key)
-	if !found {
+	if !found || b.expired(value.(internal.Item)) {
 		b.mu.RUnlock()
-		return nil, ErrKeyNotFound
+		return nil, internal.Item{}, ErrKeyNotFound
 	}
 
 	item := value.(internal.Item)
+	v, err := b.readItem(item)
+	b.mu.RUnlock()
+
+	if err == ErrChecksumFailed && b.config.ReadRepair {
+		return b.repair(key, item)
+	}
+
+	return v, item, err
+}
+
+// GetMany retrieves the values of the given keys as a best-effort bulk read.
+// Rather than aborting on the first failure, the error reading any key (such
+// as ErrChecksumFailed for a corrupt value) is recorded for that key in
+// `errs` and the remaining keys are still read. Keys that don't exist are
+// left out of both maps.
+func (b *Bitcask) GetMany(keys [][]byte) (values map[string][]byte, errs map[string]error) {
+	values = make(map[string][]byte, len(keys))
+	errs = make(map[string]error)
+
+	for _, key := range keys {
+		value, _, err := b.get(b.storedKey(key))
+		switch err {
+		case nil:
+			values[string(key)] = value
+		case ErrKeyNotFound:
+		default:
+			errs[string(key)] = err
+		}
+	}
+	return
+}
+
+// ReadEntryAt reads and verifies the value of the entry of `size` bytes at
+// `offset` in the datafile `fileID`, as located by GetWithMeta(), without
+// looking up its key. This allows external indexes to be built over the
+// database. Locations are only valid until the next Merge().
+//
+// ErrDatafileNotFound is returned if there is no datafile `fileID` and
+// ErrInvalidEntry if there is no entry of `size` bytes at `offset`.
+func (b *Bitcask) ReadEntryAt(fileID int, offset, size int64) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	if item.FileID == b.curr.FileID() {
+	var df data.Datafile
+	if fileID == b.curr.FileID() {
 		df = b.curr
-	} else {
-		df = b.datafiles[item.FileID]
+	} else if df = b.datafiles[fileID]; df == nil {
+		return nil, ErrDatafileNotFound
 	}
 
-	e, err := df.ReadAt(item.Offset, item.Size)
-	b.mu.RUnlock()
+	if offset < 0 || size <= 0 || offset+size > df.Size() {
+		return nil, ErrInvalidEntry
+	}
+
+	value, err := b.readItem(internal.Item{FileID: fileID, Offset: offset, Size: size})
+	if errors.Is(err, ErrInvalidEntry) || err == ErrShortRead {
+		return nil, ErrInvalidEntry
+	}
+	return value, err
+}
+
+// repair attempts to recover from a checksum failure reading the value of
+// `key` located by `item` by finding the most recent valid prior version of
+// the key and rewriting it as the current value.
+func (b *Bitcask) repair(key []byte, item internal.Item) ([]byte, internal.Item, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The key may have been written or deleted in the meantime
+	value, found := b.trie.Search(key)
+	if !found {
+		return nil, internal.Item{}, ErrKeyNotFound
+	}
+	if current := value.(internal.Item); current != item {
+		v, err := b.readItem(current)
+		return v, current, err
+	}
+
+	v, tag, err := b.previousVersion(key, item)
 	if err != nil {
-		return nil, err
+		return nil, internal.Item{}, err
 	}
 
-	checksum := crc32.ChecksumIEEE(e.Value)
-	if checksum != e.Checksum {
-		return nil, ErrChecksumFailed
+	if _, err := b.insert(key, v, item.Expiry, b.modTime(), tag); err != nil {
+		return nil, internal.Item{}, err
 	}
 
-	return e.Value, nil
+	value, _ = b.trie.Search(key)
+	return v, value.(internal.Item), nil
 }
 
-// Has returns true if the key exists in the database, false otherwise.
-func (b *Bitcask) Has(key []byte) bool {
-	b.mu.RLock()
-	_, found := b.trie.Search(key)
-	b.mu.RUnlock()
-	return found
+// previousVersion scans the datafiles for the most recent valid version of
+// `key` written before `item` and returns its value and tag. If there is no
+// such version (or the key was deleted since) ErrChecksumFailed is returned.
+func (b *Bitcask) previousVersion(key []byte, item internal.Item) ([]byte, uint8, error) {
+	var (
+		value []byte
+		tag   uint8
+	)
+
+	for _, id := range b.datafileIDs() {
+		if id > item.FileID {
+			break
+		}
+
+		err := b.scanDatafile(id, func(e internal.Entry, it internal.Item) error {
+			if id == item.FileID && it.Offset >= item.Offset {
+				return io.EOF
+			}
+			if !bytes.Equal(e.Key, key) {
+				return nil
+			}
+			if len(e.Value) == 0 {
+				value = nil
+			} else if v, err := b.blobs.value(e); err == nil && e.Verify(v) {
+				value, tag = v, e.Tag
+			}
+			return nil
+		})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if value == nil {
+		return nil, 0, ErrChecksumFailed
+	}
+	return value, tag, nil
 }
 
-// Put stores the key and value in the database.
-func (b *Bitcask) Put(key, value []byte) error {
-	if uint32(len(key)) > b.config.MaxKeySize {
-		return ErrKeyTooLarge
+// readItem reads and verifies the value located by `item`. The caller must
+// hold at least a read lock for the duration of the read, which prevents the
+// current datafile from being rolled over and closed while it is read.
+func (b *Bitcask) readItem(item internal.Item) ([]byte, error) {
+	value, _, err := b.readTagged(item)
+	return value, err
+}
+
+// readTagged reads the value located by `item` like readItem() along with
+// its tag. The caller must hold at least a read lock.
+func (b *Bitcask) readTagged(item internal.Item) ([]byte, uint8, error) {
+	e, err := b.readEntry(item)
+	if err != nil {
+		return nil, 0, err
 	}
-	if uint64(len(value)) > b.config.MaxValueSize {
-		return ErrValueTooLarge
+
+	value, err := b.entryValue(e)
+	if err != nil {
+		return nil, 0, err
 	}
+	return value, e.Tag, nil
+}
 
-	b.mu.Lock()
-	offset, n, err := b.put(key, value)
+// entryValue returns the value of the entry `e`, read from its blob file if
+// it is stored in one, and verifies it
+func (b *Bitcask) entryValue(e internal.Entry) ([]byte, error) {
+	value, err := b.blobs.value(e)
 	if err != nil {
-		b.mu.Unlock()
-		return err
+		return nil, err
 	}
 
-	if b.config.Sync {
-		if err := b.curr.Sync(); err != nil {
-			b.mu.Unlock()
-			return err
-		}
+	if !b.config.NoVerifyChecksums && !e.Verify(value) {
+		return nil, ErrChecksumFailed
 	}
 
-	item := internal.Item{FileID: b.curr.FileID(), Offset: offset, Size: n}
-	b.trie.Insert(key, item)
-	b.mu.Unlock()
+	return value, nil
+}
 
-	return nil
+// readEntry reads the entry located by `item`. The caller must hold at least
+// a read lock.
+func (b *Bitcask) readEntry(item internal.Item) (internal.Entry, error) {
+	df := b.datafile(item.FileID)
+	if df == nil {
+		return internal.Entry{}, ErrDatafileNotFound
+	}
+	return readAt(df, item)
 }
 
-// Delete deletes the named key. If the key doesn't exist or an I/O error
-// occurs the error is returned.
-func (b *Bitcask) Delete(key []byte) error {
-	b.mu.Lock()
-	_, _, err := b.put(key, []byte{})
-	if err != nil {
-		b.mu.Unlock()
-		return err
+// readAt reads the entry located by `item` from the datafile `df`
+func readAt(df data.Datafile, item internal.Item) (internal.Entry, error) {
+	e, err := df.ReadAt(item.Offset, item.Size)
+	if codec.IsCorruptedData(err) {
+		return internal.Entry{}, fmt.Errorf("%w: %v", ErrInvalidEntry, err)
 	}
-	b.trie.Delete(key)
-	b.mu.Unlock()
+	return e, err
+}
 
-	return nil
+// datafile returns the datafile `id`, which may be the current one. The
+// caller must hold at least a read lock.
+func (b *Bitcask) datafile(id int) data.Datafile {
+	if id == b.curr.FileID() {
+		return b.curr
+	}
+	return b.datafiles[id]
 }
 
-// DeleteAll deletes all the keys. If an I/O error occurs the error is returned.
-func (b *Bitcask) DeleteAll() (err error) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+// readStored reads the entry located by `item` as stored, verifying the
+// value unless it is stored in a blob file, which is left unread. The caller
+// must hold at least a read lock.
+func (b *Bitcask) readStored(item internal.Item) (internal.Entry, error) {
+	e, err := b.readEntry(item)
+	if err != nil {
+		return internal.Entry{}, err
+	}
 
-	b.trie.ForEach(func(node art.Node) bool {
-		_, _, err = b.put(node.Key(), []byte{})
-		if err != nil {
-			return false
-		}
-		return true
-	})
-	b.trie = art.New()
+	if !e.Blob && !b.config.NoVerifyChecksums && !e.Verify(e.Value) {
+		return internal.Entry{}, ErrChecksumFailed
+	}
 
-	return
+	return e, nil
 }
 
-// Scan performs a prefix scan of keys matching the given prefix and calling
-// the function `f` with the keys found. If the function returns an error
-// no further keys are processed and the first error returned.
+// Has returns true if the key exists in the database, false otherwise,
+// including if the database is closed (see HasE).
+func (b *Bitcask) Has(key []byte) bool {
+	found, _ := b.HasE(key)
+	return found
+}
+
+// HasE is like Has() but returns ErrDatabaseClosed if the database is closed,
+// including after a failed merge closed it (see Health), so that a key that
+// doesn't exist can be told apart from a database that can't tell.
+func (b *Bitcask) HasE(key []byte) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed || !b.isLocked() {
+		return false, ErrDatabaseClosed
+	}
+	value, found := b.trie.Search(b.storedKey(key))
+	return found && !b.expired(value.(internal.Item)), nil
+}
+
+// TTL returns the remaining time to live of the key and whether it has one at
+// all (see PutWithTTL). If the key is not found (or has expired)
+// ErrKeyNotFound is returned.
+func (b *Bitcask) TTL(key []byte) (time.Duration, bool, error) {
+	b.mu.RLock()
+	value, found := b.trie.Search(b.storedKey(key))
+	b.mu.RUnlock()
+
+	if !found {
+		return 0, false, ErrKeyNotFound
+	}
+
+	item := value.(internal.Item)
+	if item.Expiry == 0 {
+		return 0, false, nil
+	}
+	ttl := time.Unix(0, item.Expiry).Sub(b.now())
+	if ttl <= 0 {
+		return 0, false, ErrKeyNotFound
+	}
+	return ttl, true, nil
+}
+
+// ModTime returns when the key was last written. It returns false if the key
+// is not found (or has expired) or its modification time was not recorded
+// (see WithModTimes).
+func (b *Bitcask) ModTime(key []byte) (time.Time, bool) {
+	b.mu.RLock()
+	value, found := b.trie.Search(b.storedKey(key))
+	b.mu.RUnlock()
+
+	if !found || b.expired(value.(internal.Item)) {
+		return time.Time{}, false
+	}
+
+	item := value.(internal.Item)
+	if item.ModTime == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, item.ModTime), true
+}
+
+// Put stores the key and value in the database.
+func (b *Bitcask) Put(key, value []byte) error {
+	_, err := b.set(b.storedKey(key), value, 0, b.modTime(), 0)
+	return err
+}
+
+// PutTagged stores the key and value like Put() along with a `tag`, for
+// example describing the encoding of the value (see GetTagged). A tag of 0
+// means untagged and takes no space on disk.
+func (b *Bitcask) PutTagged(key, value []byte, tag uint8) error {
+	_, err := b.set(b.storedKey(key), value, 0, b.modTime(), tag)
+	return err
+}
+
+// PutN stores the key and value in the database like Put() and returns the
+// number of bytes written to disk.
+func (b *Bitcask) PutN(key, value []byte) (int64, error) {
+	return b.set(b.storedKey(key), value, 0, b.modTime(), 0)
+}
+
+// PutReader stores the key and the value read from `r` until EOF. If the value
+// exceeds the maximum value size reading stops and ErrValueTooLarge is
+// returned. Since an entry records its value size before the value, the value
+// is buffered in memory and only written once it was read in full within the
+// limit, so an oversized or failed read never leaves a partial entry on disk.
+func (b *Bitcask) PutReader(key []byte, r io.Reader) error {
+	b.mu.RLock()
+	maxValueSize := b.config.MaxValueSize
+	b.mu.RUnlock()
+
+	limit := int64(math.MaxInt64)
+	if maxValueSize < math.MaxInt64 {
+		limit = int64(maxValueSize) + 1
+	}
+
+	value, err := ioutil.ReadAll(io.LimitReader(r, limit))
+	if err != nil {
+		return err
+	}
+
+	_, err = b.set(b.storedKey(key), value, 0, b.modTime(), 0)
+	return err
+}
+
+// PutWithTTL stores the key and value in the database to expire after `ttl`.
+// Expired keys are no longer visible and are removed from disk by the next
+// Merge(), although they are still counted by Len() until then.
+func (b *Bitcask) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	_, err := b.set(b.storedKey(key), value, b.now().Add(ttl).UnixNano(), b.modTime(), 0)
+	return err
+}
+
+// Persist removes the TTL of the key (see PutWithTTL) so it never expires by
+// rewriting its current value without an expiry. If the key is not found (or
+// has expired) ErrKeyNotFound is returned.
+func (b *Bitcask) Persist(key []byte) error {
+	key = b.storedKey(key)
+
+	if err := b.lockWrite(); err != nil {
+		return err
+	}
+	value, found := b.trie.Search(key)
+	if !found || b.expired(value.(internal.Item)) {
+		b.mu.Unlock()
+		return ErrKeyNotFound
+	}
+
+	item := value.(internal.Item)
+	if item.Expiry == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+
+	v, tag, err := b.readTagged(item)
+	if err == nil {
+		_, err = b.insert(key, v, 0, item.ModTime, tag)
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	b.maybeMerge()
+
+	return nil
+}
+
+// Append appends `suffix` to the value of the key and returns the length of
+// the new value. If the key is not found (or has expired) it is stored with
+// `suffix` as its value. The value is read and rewritten with the write lock
+// held so concurrent appends are never lost. The key keeps its TTL, if any.
+func (b *Bitcask) Append(key, suffix []byte) (int, error) {
+	key = b.storedKey(key)
+
+	if err := b.lockWrite(); err != nil {
+		return 0, err
+	}
+	if uint64(len(key)) > uint64(b.config.MaxKeySize) {
+		b.mu.Unlock()
+		return 0, ErrKeyTooLarge
+	}
+
+	var (
+		value  []byte
+		expiry int64
+		tag    uint8
+	)
+	if v, found := b.trie.Search(key); found && !b.expired(v.(internal.Item)) {
+		item := v.(internal.Item)
+		current, t, err := b.readTagged(item)
+		if err != nil {
+			b.mu.Unlock()
+			return 0, err
+		}
+		value = make([]byte, 0, len(current)+len(suffix))
+		value = append(append(value, current...), suffix...)
+		expiry, tag = item.Expiry, t
+	} else {
+		value = suffix
+	}
+
+	// Nothing to write, and an empty value would delete the key
+	if len(suffix) == 0 {
+		b.mu.Unlock()
+		return len(value), nil
+	}
+
+	if uint64(len(value)) > b.config.MaxValueSize {
+		b.mu.Unlock()
+		return 0, ErrValueTooLarge
+	}
+
+	_, err := b.insert(key, value, expiry, b.modTime(), tag)
+	b.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	b.maybeMerge()
+
+	return len(value), nil
+}
+
+// expired returns true if the key located by `item` has expired
+func (b *Bitcask) expired(item internal.Item) bool {
+	return item.Expiry != 0 && b.now().UnixNano() >= item.Expiry
+}
+
+// modTime returns the modification time to record for a write, which is
+// zero unless modification times are enabled (see WithModTimes)
+func (b *Bitcask) modTime() int64 {
+	if !b.config.ModTimes {
+		return 0
+	}
+	return b.now().UnixNano()
+}
+
+func (b *Bitcask) set(key, value []byte, expiry, modTime int64, tag uint8) (int64, error) {
+	if err := b.lockWrite(); err != nil {
+		return 0, err
+	}
+	// The sizes are checked with the lock held as Reconfigure() may change them
+	if uint64(len(key)) > uint64(b.config.MaxKeySize) {
+		b.mu.Unlock()
+		return 0, ErrKeyTooLarge
+	}
+	if uint64(len(value)) > b.config.MaxValueSize {
+		b.mu.Unlock()
+		return 0, ErrValueTooLarge
+	}
+	if b.config.DedupWrites && expiry == 0 && b.unchanged(key, value, tag) {
+		b.mu.Unlock()
+		return 0, nil
+	}
+	n, err := b.insert(key, value, expiry, modTime, tag)
+	b.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	b.maybeMerge()
+
+	return n, nil
+}
+
+// unchanged returns true if `key` is currently stored without an expiry and
+// with a value equal to `value` and the tag `tag`. The caller must hold at
+// least a read lock.
+func (b *Bitcask) unchanged(key, value []byte, tag uint8) bool {
+	v, found := b.trie.Search(key)
+	if !found {
+		return false
+	}
+
+	item := v.(internal.Item)
+	if item.Expiry != 0 {
+		return false
+	}
+
+	current, t, err := b.readTagged(item)
+	return err == nil && t == tag && bytes.Equal(current, value)
+}
+
+// insert writes the key/value pair expiring at `expiry`, last modified at
+// `modTime` and tagged with `tag` (if not zero) and updates the index
+// returning the number of bytes written. The caller must hold the write lock.
+func (b *Bitcask) insert(key, value []byte, expiry, modTime int64, tag uint8) (int64, error) {
+	var e internal.Entry
+	if b.config.NoWriteChecksums {
+		e = internal.Entry{Key: key, Value: value, NoChecksum: true}
+	} else {
+		e = internal.NewEntry(key, value)
+	}
+	e.Expiry = expiry
+	e.ModTime = modTime
+	e.Tag = tag
+	if b.config.LargeValueThreshold > 0 && len(value) > b.config.LargeValueThreshold {
+		ref, err := b.blobs.write(value)
+		if err != nil {
+			return 0, err
+		}
+		e.Value, e.Blob = ref, true
+	}
+	return b.insertEntry(e, value)
+}
+
+// insertEntry writes the entry `e` of the key/value pair with the value
+// `value` and updates the index returning the number of bytes written. The
+// caller must hold the write lock.
+func (b *Bitcask) insertEntry(e internal.Entry, value []byte) (int64, error) {
+	offset, n, err := b.putEntry(e)
+	if err != nil {
+		return 0, err
+	}
+	return n, b.inserted(e, value, offset, n)
+}
+
+// inserted syncs the entry `e` of the key/value pair with the value `value`
+// written at `offset` with `n` bytes if needed and updates the index. The
+// caller must hold the write lock.
+func (b *Bitcask) inserted(e internal.Entry, value []byte, offset, n int64) error {
+	key, expiry, modTime := e.Key, e.Expiry, e.ModTime
+	if b.config.Sync {
+		if err := b.curr.Sync(); err != nil {
+			return b.writeFailed(err)
+		}
+	}
+
+	item := internal.Item{FileID: b.curr.FileID(), Offset: offset, Size: n, Expiry: expiry, ModTime: modTime}
+	if old, found := b.trie.Insert(key, item); found {
+		b.liveBytes -= old.(internal.Item).Size
+	}
+	b.liveBytes += n
+	if e.Blob && b.blobRefs != nil {
+		id, _ := blobID(e.Value)
+		b.blobRefs[id] = struct{}{}
+	}
+	b.indexKey(key, value)
+	b.logMerge(key)
+	b.notify(EventPut, key, value)
+
+	return nil
+}
+
+// lockWrite acquires the write lock for a write operation. If a write timeout
+// is configured (see WithWriteTimeout) and the lock can't be acquired in time
+// ErrWriteTimeout is returned.
+func (b *Bitcask) lockWrite() error {
+	if b.config.WriteTimeout <= 0 {
+		b.mu.Lock()
+		return nil
+	}
+
+	const (
+		waiting int32 = iota
+		acquired
+		abandoned
+	)
+	var state int32
+
+	locked := make(chan struct{})
+	go func() {
+		b.mu.Lock()
+		if !atomic.CompareAndSwapInt32(&state, waiting, acquired) {
+			// The caller gave up in the meantime
+			b.mu.Unlock()
+			return
+		}
+		close(locked)
+	}()
+
+	timer := time.NewTimer(b.config.WriteTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-locked:
+		return nil
+	case <-timer.C:
+		if atomic.CompareAndSwapInt32(&state, waiting, abandoned) {
+			return ErrWriteTimeout
+		}
+		// The lock was acquired just as the timeout fired
+		<-locked
+		return nil
+	}
+}
+
+// Delete deletes the named key. If an I/O error occurs the error is returned.
+// Deleting a key that doesn't exist writes nothing and returns nil, or
+// ErrKeyNotFound if WithStrictDeletes is enabled.
+func (b *Bitcask) Delete(key []byte) error {
+	return b.remove(b.storedKey(key))
+}
+
+// remove deletes the stored key `key` (see Delete)
+func (b *Bitcask) remove(key []byte) error {
+	if err := b.lockWrite(); err != nil {
+		return err
+	}
+	value, found := b.trie.Search(key)
+	if !found || b.expired(value.(internal.Item)) {
+		b.mu.Unlock()
+		if b.config.StrictDeletes {
+			return ErrKeyNotFound
+		}
+		return nil
+	}
+
+	_, _, err := b.put(key, []byte{})
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.deleted(key, value.(internal.Item))
+	b.mu.Unlock()
+
+	b.maybeMerge()
+
+	return nil
+}
+
+// deleted updates the index after the deletion of `key` located by `item` was
+// written. The caller must hold the write lock.
+func (b *Bitcask) deleted(key []byte, item internal.Item) {
+	b.trie.Delete(key)
+	b.liveBytes -= item.Size
+	b.unindexKey(key)
+	b.logMerge(key)
+	b.notify(EventDelete, key, nil)
+}
+
+// DeleteAll deletes all the keys. If an I/O error occurs the error is returned.
+// If a key prefix is configured (see WithKeyPrefix) only keys with that
+// prefix are deleted.
+func (b *Bitcask) DeleteAll() (err error) {
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	defer b.mu.Unlock()
+
+	if len(b.config.KeyPrefix) == 0 {
+		b.trie.ForEach(func(node art.Node) bool {
+			_, _, err = b.put(node.Key(), []byte{})
+			if err != nil {
+				return false
+			}
+			b.logMerge(node.Key())
+			b.notify(EventDelete, node.Key(), nil)
+			return true
+		})
+		b.trie = art.New()
+		b.liveBytes = 0
+		if e := b.buildIndexes(); err == nil {
+			err = e
+		}
+		return
+	}
+
+	var keys [][]byte
+	b.forEachPrefix(b.config.KeyPrefix, func(node art.Node) bool {
+		keys = append(keys, node.Key())
+		return true
+	})
+	for _, key := range keys {
+		if _, _, err = b.put(key, []byte{}); err != nil {
+			return
+		}
+		if old, found := b.trie.Delete(key); found {
+			b.liveBytes -= old.(internal.Item).Size
+		}
+		b.unindexKey(key)
+		b.logMerge(key)
+		b.notify(EventDelete, key, nil)
+	}
+
+	return
+}
+
+// Scan performs a prefix scan of keys matching the given prefix and calling
+// the function `f` with the keys found. If the function returns an error
+// no further keys are processed and the first error returned.
 func (b *Bitcask) Scan(prefix []byte, f func(key []byte) error) (err error) {
-	b.trie.ForEachPrefix(prefix, func(node art.Node) bool {
-		// Skip the root node
-		if len(node.Key()) == 0 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	b.forEachPrefix(b.storedKey(prefix), func(node art.Node) bool {
+		err = b.callback(func() error { return f(b.stripKey(node.Key())) })
+		return err == nil
+	})
+	return
+}
+
+// ReverseScan is like Scan() but calls `f` with the keys matching the prefix
+// in reverse (descending) order. As the index can only be walked forwards, all
+// the matching keys are collected in memory first, so ReverseScan() uses
+// memory proportional to the number of keys matching the prefix.
+func (b *Bitcask) ReverseScan(prefix []byte, f func(key []byte) error) error {
+	var keys [][]byte
+
+	b.mu.RLock()
+	b.forEachPrefix(b.storedKey(prefix), func(node art.Node) bool {
+		keys = append(keys, b.stripKey(node.Key()))
+		return true
+	})
+	b.mu.RUnlock()
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := b.callback(func() error { return f(keys[i]) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanPage returns, in ascending order, up to `limit` keys matching the given
+// prefix that sort after the cursor `after`, or from the first key if `after`
+// is nil, for paginating over the keys. The cursor of the next page is
+// returned along with the keys, or nil if there are no more keys. The keys
+// before the cursor are walked but the walk stops as soon as the page is
+// full, so only the keys of the page are collected.
+func (b *Bitcask) ScanPage(prefix, after []byte, limit int) (keys [][]byte, next []byte, err error) {
+	if limit <= 0 {
+		return nil, nil, ErrInvalidLimit
+	}
+
+	var cursor []byte
+	if after != nil {
+		cursor = b.storedKey(after)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	b.forEachPrefix(b.storedKey(prefix), func(node art.Node) bool {
+		if cursor != nil && bytes.Compare(node.Key(), cursor) <= 0 {
 			return true
 		}
+		if len(keys) == limit {
+			next = keys[len(keys)-1]
+			return false
+		}
+		keys = append(keys, b.stripKey(node.Key()))
+		return true
+	})
+	return
+}
+
+// Len returns the total number of keys in the database
+func (b *Bitcask) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.trie.Size()
+}
+
+// Count returns the number of keys matching the given prefix. Like Len(),
+// expired keys are counted until they are removed by Merge(). An empty prefix
+// counts all keys as cheaply as Len() without walking them.
+func (b *Bitcask) Count(prefix []byte) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	prefix = b.storedKey(prefix)
+	if len(prefix) == 0 {
+		return b.trie.Size()
+	}
+
+	var n int
+	b.walkPrefix(prefix, func(node art.Node) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Keys returns all keys in the database as a channel of keys. Like with
+// ReverseScan(), the keys are collected in memory first so the database isn't
+// locked while they are sent, and a consumer that stops receiving (or panics)
+// can't block writes.
+func (b *Bitcask) Keys() chan []byte {
+	var keys [][]byte
+	b.mu.RLock()
+	b.forEachPrefix(b.config.KeyPrefix, func(node art.Node) bool {
+		keys = append(keys, b.stripKey(node.Key()))
+		return true
+	})
+	b.mu.RUnlock()
+
+	ch := make(chan []byte)
+	go func() {
+		defer close(ch)
+		for _, key := range keys {
+			ch <- key
+		}
+	}()
+
+	return ch
+}
+
+// Fold iterates over all keys in the database calling the function `f` for
+// each key. If the function returns an error, no further keys are processed
+// and the error returned.
+func (b *Bitcask) Fold(f func(key []byte) error) (err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	b.forEachPrefix(b.config.KeyPrefix, func(node art.Node) bool {
+		err = b.callback(func() error { return f(b.stripKey(node.Key())) })
+		return err == nil
+	})
+
+	return
+}
+
+// FoldWithValue iterates over all keys in the database calling the function
+// `f` with each key and its value. Values are read and verified against their
+// checksum in the same pass over the keys. If the function returns an error or
+// a value could not be read, no further keys are processed and the error
+// returned.
+func (b *Bitcask) FoldWithValue(f func(key, value []byte) error) (err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	b.forEachPrefix(b.config.KeyPrefix, func(node art.Node) bool {
+		var value []byte
+		if value, err = b.readItem(node.Value().(internal.Item)); err != nil {
+			return false
+		}
+		err = b.callback(func() error { return f(b.stripKey(node.Key()), value) })
+		return err == nil
+	})
+
+	return
+}
+
+// ForEachByFile iterates over all keys in the database like FoldWithValue()
+// but in the order their values are stored on disk, calling the function `f`
+// with the id of the datafile of each key (see Datafiles) along with the key
+// and its value. The datafiles are read sequentially in order of their ids,
+// skipping the entries of keys overwritten or deleted since, which avoids
+// seeking back and forth when processing the whole database. If the function
+// returns an error or a value could not be read, no further keys are
+// processed and the error returned.
+func (b *Bitcask) ForEachByFile(f func(fileID int, key, value []byte) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, id := range b.datafileIDs() {
+		err := b.scanDatafile(id, func(e internal.Entry, item internal.Item) error {
+			if len(e.Value) == 0 || !bytes.HasPrefix(e.Key, b.config.KeyPrefix) {
+				return nil
+			}
+			v, found := b.trie.Search(e.Key)
+			if !found {
+				return nil
+			}
+			if current := v.(internal.Item); current.FileID != id || current.Offset != item.Offset || b.expired(current) {
+				return nil
+			}
+
+			value, err := b.entryValue(e)
+			if err != nil {
+				return err
+			}
+			return b.callback(func() error { return f(id, b.stripKey(e.Key), value) })
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Preload reads the values of all keys matching the given prefix, or of all
+// keys if the prefix is empty, so that they are in the operating system's
+// page cache before they are first requested, for example right after Open().
+// The values are read from a snapshot like with Iterator() so writes aren't
+// blocked meanwhile. If `ctx` is done Preload stops early and returns its
+// error, and if a value could not be read its error is returned.
+func (b *Bitcask) Preload(ctx context.Context, prefix []byte) error {
+	it, err := b.Iterator(prefix)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !it.Next() {
+			return it.Err()
+		}
+	}
+}
+
+// observer returns the configured Observer or one ignoring all events
+func (b *Bitcask) observer() Observer {
+	if b.config.Observer == nil {
+		return NopObserver{}
+	}
+	return b.config.Observer
+}
+
+// now returns the current time according to the configured clock
+func (b *Bitcask) now() time.Time {
+	if b.config.Clock != nil {
+		return b.config.Clock()
+	}
+	return time.Now()
+}
+
+// forEachPrefix calls `f` for every leaf of the trie whose key starts with
+// `prefix`, or for every leaf if `prefix` is empty. Expired keys are skipped.
+func (b *Bitcask) forEachPrefix(prefix []byte, f art.Callback) {
+	b.walkPrefix(prefix, func(node art.Node) bool {
+		if b.expired(node.Value().(internal.Item)) {
+			return true
+		}
+		return f(node)
+	})
+}
+
+// walkPrefix calls `f` for every leaf of the trie whose key starts with
+// `prefix`, or for every leaf if `prefix` is empty, including expired keys.
+// The walk stops as soon as `f` returns false.
+func (b *Bitcask) walkPrefix(prefix []byte, f art.Callback) {
+	// The trie only skips the children of a node for which the callback
+	// returns false and carries on with its siblings, so stop calling `f`
+	// once it asked to stop
+	var stopped bool
+	walk := func(node art.Node) bool {
+		if stopped {
+			return false
+		}
+		if !f(node) {
+			stopped = true
+			return false
+		}
+		return true
+	}
+
+	if len(prefix) == 0 {
+		b.trie.ForEach(walk)
+		return
+	}
+	b.trie.ForEachPrefix(prefix, func(node art.Node) bool {
+		// Skip the root node
+		if len(node.Key()) == 0 {
+			return !stopped
+		}
+		return walk(node)
+	})
+}
+
+// storedKey returns the form of `key` stored in the database: normalized with
+// the configured key normalizer and with the configured key prefix prepended
+func (b *Bitcask) storedKey(key []byte) []byte {
+	if b.config.KeyNormalizer != nil {
+		key = b.config.KeyNormalizer(key)
+	}
+	if len(b.config.KeyPrefix) == 0 {
+		return key
+	}
+	k := make([]byte, len(b.config.KeyPrefix)+len(key))
+	copy(k, b.config.KeyPrefix)
+	copy(k[len(b.config.KeyPrefix):], key)
+	return k
+}
+
+// stripKey returns `key` with the configured key prefix (if any) removed
+func (b *Bitcask) stripKey(key []byte) []byte {
+	return key[len(b.config.KeyPrefix):]
+}
+
+func (b *Bitcask) put(key, value []byte) (int64, int64, error) {
+	return b.putEntry(internal.NewEntry(key, value))
+}
+
+func (b *Bitcask) putEntry(e internal.Entry) (int64, int64, error) {
+	return b.write(func(df data.Datafile) (int64, int64, error) {
+		return df.Write(e)
+	})
+}
+
+// write writes an entry to the current datafile with `f`, rolling it over
+// first if it is full, and returns the offset and size of the entry written.
+// The caller must hold the write lock.
+func (b *Bitcask) write(f func(df data.Datafile) (int64, int64, error)) (int64, int64, error) {
+	if b.writeErr != nil {
+		return -1, 0, ErrReadOnly
+	}
+
+	size := b.curr.Size()
+	if size >= int64(b.config.MaxDatafileSize) {
+		if err := b.rollover(); err != nil {
+			return -1, 0, b.writeFailed(err)
+		}
+	}
+
+	offset, n, err := f(b.curr)
+	if err != nil {
+		return -1, 0, b.writeFailed(err)
+	}
+	return offset, n, nil
+}
+
+// writeFailed makes the database read-only after the write error `err` if
+// WithReadOnlyAfterError() is enabled, and returns `err`. The caller must hold
+// the write lock.
+func (b *Bitcask) writeFailed(err error) error {
+	if b.config.ReadOnlyAfterError && b.writeErr == nil {
+		b.writeErr = err
+	}
+	return err
+}
+
+// ResetReadOnly makes a database that was made read-only by a write error
+// (see WithReadOnlyAfterError) writable again once the cause of the error was
+// dealt with. The datafiles are opened again, truncating any partially
+// written entry at the end of the current datafile. It does nothing if the
+// database isn't read-only.
+func (b *Bitcask) ResetReadOnly() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.writeErr == nil {
+		return nil
+	}
+
+	// The datafiles may be in any state after the failure
+	for _, df := range b.datafiles {
+		df.Close()
+	}
+	b.curr.Close()
+
+	if err := b.openDatafiles(); err != nil {
+		return err
+	}
+
+	b.writeErr = nil
+	return nil
+}
+
+// CurrentDatafile returns the id of the current datafile, the one written to
+func (b *Bitcask) CurrentDatafile() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.curr.FileID()
+}
+
+// Rotate closes the current datafile and starts writing to a new one
+// regardless of the size of the current datafile, for example to align
+// datafiles with external events such as days so they can later be merged
+// with MergeFilesBefore().
+func (b *Bitcask) Rotate() error {
+	if err := b.lockWrite(); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	if b.writeErr != nil {
+		return ErrReadOnly
+	}
+	if err := b.rollover(); err != nil {
+		return b.writeFailed(err)
+	}
+	return nil
+}
+
+// rollover closes the current datafile, reopening it readonly, and starts a
+// new current datafile. The caller must hold the write lock.
+func (b *Bitcask) rollover() error {
+	err := b.curr.Seal()
+	if err != nil {
+		return err
+	}
+
+	id := b.curr.FileID()
+
+	var df data.Datafile
+	if b.cache != nil {
+		df, err = data.NewLazyDatafile(b.cache, b.config.FS, b.path, id, b.config.MaxKeySize, b.config.MaxValueSize, b.config.NoMmap, b.config.DatafileExt, b.config.DatafileMagic)
+	} else {
+		df, err = b.openDatafile(id, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Replace the stale readonly handle opened along with the others
+	if prev, ok := b.datafiles[id]; ok {
+		prev.Close()
+	}
+	b.datafiles[id] = df
+
+	id = b.curr.FileID() + 1
+	curr, err := b.openDatafile(id, false)
+	if err != nil {
+		return err
+	}
+	b.curr = curr
+
+	if !b.config.NoDatafileSync {
+		if err := b.curr.Sync(); err != nil {
+			return err
+		}
+		if err := fs.SyncDir(b.config.FS, b.path); err != nil {
+			return err
+		}
+	}
+
+	b.hook(func() { b.observer().DatafileRolled(id-1, id) })
+
+	return nil
+}
+
+// Clear removes all keys from the database by removing all of its datafiles
+// and index and starting afresh with an empty datafile, leaving the database
+// in the same state as a newly created one. The database stays open and
+// locked throughout.
+func (b *Bitcask) Clear() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.writeErr != nil {
+		return ErrReadOnly
+	}
+
+	if err := b.closeDatafiles(); err != nil {
+		return err
+	}
+
+	fns, err := internal.GetDatafiles(b.config.FS, b.path, b.config.DatafileExt, b.config.DatafileMagic)
+	if err != nil {
+		return err
+	}
+	for _, fn := range append(fns, filepath.Join(b.path, "index")) {
+		if err := b.config.FS.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	keys := b.trie
+	if err := b.reopen(context.Background()); err != nil {
+		return err
+	}
+
+	if b.mergeLog != nil {
+		b.mergeLog.cleared = true
+		b.mergeLog.keys = make(map[string]struct{})
+	}
+
+	// A merged database shares the blob files of the database being merged
+	if b.blobRefs != nil {
+		b.blobRefs = make(map[uint64]struct{})
+	} else if err := b.blobs.removeAll(); err != nil {
+		return err
+	}
+
+	if len(b.watchers) > 0 {
+		keys.ForEach(func(node art.Node) bool {
+			b.notify(EventDelete, node.Key(), nil)
+			return true
+		})
+	}
+	return nil
+}
+
+func (b *Bitcask) Reopen() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.reopen(context.Background())
+}
+
+// reopen opens the datafiles and loads the index, rebuilding it from the
+// datafiles if necessary unless `ctx` is done first, in which case its error
+// is returned. The caller must hold the write lock.
+func (b *Bitcask) reopen(ctx context.Context) error {
+	if err := repairLastDatafile(b.path, b.config); err != nil {
+		return err
+	}
+
+	datafiles, lastID, err := loadDatafiles(b.path, b.config, b.cache)
+	if err != nil {
+		return err
+	}
+
+	var (
+		t     art.Tree
+		found bool
+	)
+	if b.config.NoIndexFile {
+		t = art.New()
+		err = replayDatafiles(ctx, t, datafiles)
+	} else {
+		t, found, err = loadIndex(ctx, b.path, b.indexer, b.config.MaxKeySize, datafiles)
+	}
+	if err != nil {
+		for _, df := range datafiles {
+			df.Close()
+		}
+		return err
+	}
+
+	curr, err := b.openDatafile(lastID, false)
+	if err != nil {
+		return err
+	}
+
+	// The first datafile of an empty database was just created
+	if len(datafiles) == 0 && !b.config.NoDatafileSync {
+		if err := fs.SyncDir(b.config.FS, b.path); err != nil {
+			curr.Close()
+			return err
+		}
+	}
+
+	b.trie = t
+	b.curr = curr
+	b.datafiles = datafiles
+	b.recoveredFromIndex = found
+
+	b.liveBytes = 0
+	t.ForEach(func(node art.Node) bool {
+		b.liveBytes += node.Value().(internal.Item).Size
+		return true
+	})
+
+	return b.buildIndexes()
+}
+
+// Merge merges all datafiles in the database. Old keys are squashed
+// and deleted keys removes. Duplicate key/value pairs are also removed.
+// Call this function periodically to reclaim disk space. If another merge is
+// already in progress ErrMergeInProgress is returned.
+//
+// Reads and writes carry on while the keys are rewritten into the merged
+// datafiles. Writes made in the meantime are logged and applied to the
+// merged datafiles before they replace the original ones, which blocks
+// reads and writes only briefly. With WithMergeKeepVersions() all reads and
+// writes are blocked for the whole merge instead.
+//
+// If the merge fails the database remains usable with its original data,
+// unless it failed after the merge was committed. The database is then
+// closed, as reported by Health(), and the merge is completed by opening the
+// database again.
+func (b *Bitcask) Merge() error {
+	if !atomic.CompareAndSwapInt32(&b.merging, 0, 1) {
+		return ErrMergeInProgress
+	}
+	defer atomic.StoreInt32(&b.merging, 0)
+
+	return b.merge(-1)
+}
+
+// MergeFilesBefore merges only the datafiles with an id lower than `id` (see
+// Datafiles), leaving the newer datafiles untouched, which avoids rewriting
+// the most recently written keys over and over in write-heavy databases. The
+// live keys of the older datafiles are rewritten into as many datafiles
+// taking their place. If `id` is past the current datafile all datafiles are
+// merged as with Merge(). If another merge is already in progress
+// ErrMergeInProgress is returned.
+//
+// Unlike Merge(), all reads and writes are blocked while the older datafiles
+// are rewritten, only the latest version of each key is kept, and blob files
+// (see WithLargeValueThreshold) are only removed by Merge().
+func (b *Bitcask) MergeFilesBefore(id int) error {
+	if !atomic.CompareAndSwapInt32(&b.merging, 0, 1) {
+		return ErrMergeInProgress
+	}
+	defer atomic.StoreInt32(&b.merging, 0)
+
+	return b.merge(id)
+}
+
+// merge merges the datafiles with an id lower than `cutoff` (all of them if
+// `cutoff` is negative or past the current datafile) with the write lock
+// held. A merge that left the database unusable releases it once the write
+// lock is released, as the syncer and metrics logger wait for the read lock.
+func (b *Bitcask) merge(cutoff int) error {
+	b.mu.Lock()
+	release, err := b.doMerge(cutoff)
+	b.mu.Unlock()
+
+	if release {
+		b.release()
+	}
+	return err
+}
+
+// doMerge does the work of merge() and reports whether the database must be
+// released. The caller must hold the write lock.
+func (b *Bitcask) doMerge(cutoff int) (bool, error) {
+	if b.writeErr != nil {
+		return false, ErrReadOnly
+	}
+	if cutoff >= 0 && cutoff > b.curr.FileID() {
+		cutoff = -1
+	}
+
+	// The newer datafiles are kept as they are by a partial merge
+	var keep []string
+	if cutoff >= 0 {
+		ids := b.datafileIDs()
+		if ids[0] >= cutoff {
+			return false, nil
+		}
+		for _, id := range ids {
+			if id >= cutoff {
+				keep = append(keep, filepath.Base(b.datafile(id).Name()))
+			}
+		}
+	}
+
+	before, size, err := b.datafilesOnDisk()
+	if err != nil {
+		return false, err
+	}
+	b.hook(func() { b.observer().MergeStarted(before) })
+
+	// Temporary merged database path
+	temp, err := fs.TempDir(b.config.FS, b.path, "merge")
+	if err != nil {
+		return false, err
+	}
+	marker := filepath.Join(b.path, mergeCommitFilename)
+	defer func() {
+		// A committed merge needs the merged files to be completed
+		if !fs.Exists(b.config.FS, marker) {
+			fs.RemoveAll(b.config.FS, temp)
+		}
+	}()
+
+	// Create a merged database with the same configuration
+	cfg := *b.config
+	cfg.MergeTrigger = nil
+	cfg.AutoMergeRatio = 0
+	cfg.MergeOnClose = false
+	cfg.MaxDatafiles = 0
+	cfg.SyncInterval = 0
+	cfg.MetricsInterval = 0
+	cfg.SecondaryIndexes = nil
+	cfg.Observer = nil
+	// The datafiles of a partial merge must fit before the ones kept
+	if cfg.MergeTargetFileSize > 0 && cutoff < 0 {
+		cfg.MaxDatafileSize = cfg.MergeTargetFileSize
+	}
+	mdb, err := Open(temp, withConfig(&cfg))
+	if err != nil {
+		return false, err
+	}
+	// Blob files are referenced rather than rewritten
+	mdb.blobs = b.blobs
+	if cutoff < 0 {
+		mdb.blobRefs = make(map[uint64]struct{})
+	}
+
+	switch {
+	case cutoff >= 0:
+		err = b.mergeFiles(mdb, cutoff)
+	case b.config.MergeKeepVersions > 1:
+		err = b.mergeVersions(mdb, b.config.MergeKeepVersions)
+	default:
+		err = b.mergeOnline(mdb)
+	}
+	if err == nil && b.closed {
+		err = ErrDatabaseClosed
+	}
+	if err == nil && b.config.MergeVerify {
+		err = verifyMerged(mdb, cutoff)
+	}
+	if err == nil && b.config.MergeVerifyKeyCount {
+		err = b.verifyKeyCount(mdb, cutoff)
+	}
+	if err != nil {
+		mdb.Close()
+		return false, err
+	}
+
+	err = mdb.Close()
+	if err != nil {
+		return false, err
+	}
+
+	// From here on the datafiles are closed so the database must be
+	// reopened whether the merge succeeds or not
+	if err := b.replaceDatafiles(mdb.path, keep...); err != nil {
+		if fs.Exists(b.config.FS, marker) {
+			// The merge was committed but couldn't be completed, which
+			// only the next Open() can do
+			return true, err
+		}
+		// Carry on with the original datafiles
+		release := b.reopen(context.Background()) != nil
+		return release, err
+	}
+
+	// And finally reopen the database
+	if err := b.reopen(context.Background()); err != nil {
+		return true, err
+	}
+
+	// Blob files left over are removed by the next merge
+	if mdb.blobRefs != nil {
+		b.blobs.removeUnreferenced(mdb.blobRefs)
+	}
+
+	if after, merged, err := b.datafilesOnDisk(); err == nil {
+		b.hook(func() { b.observer().MergeFinished(before, after, size-merged) })
+	}
+	return false, nil
+}
+
+// verifyMerged checks that every key of the merged database `mdb` can be read
+// back with a valid checksum. The keys a partial merge up to `cutoff` kept in
+// the original datafiles aren't checked.
+func verifyMerged(mdb *Bitcask, cutoff int) error {
+	report, err := mdb.Check()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMergeVerifyFailed, err)
+	}
+
+	var problems []CheckProblem
+	for _, p := range report.Orphaned {
+		if cutoff < 0 || p.FileID < cutoff {
+			problems = append(problems, p)
+		}
+	}
+	problems = append(problems, report.Corrupt...)
+	problems = append(problems, report.Unindexed...)
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %d problems, first %s", ErrMergeVerifyFailed, len(problems), problems[0])
+	}
+	return nil
+}
+
+// verifyKeyCount checks that replaying the datafiles of the merged database
+// `mdb` finds as many live keys as the database has, or as it has in the
+// datafiles merged up to `cutoff` by a partial merge. The caller must hold
+// the write lock.
+func (b *Bitcask) verifyKeyCount(mdb *Bitcask, cutoff int) error {
+	now := b.now().UnixNano()
+	live := func(item internal.Item) bool {
+		return item.Expiry == 0 || now < item.Expiry
+	}
+
+	var expected int
+	b.walkPrefix(nil, func(node art.Node) bool {
+		if item := node.Value().(internal.Item); live(item) && (cutoff < 0 || item.FileID < cutoff) {
+			expected++
+		}
+		return true
+	})
+
+	replayed := art.New()
+	for _, id := range mdb.datafileIDs() {
+		err := mdb.scanDatafile(id, func(e internal.Entry, item internal.Item) error {
+			if len(e.Value) == 0 {
+				replayed.Delete(e.Key)
+			} else {
+				replayed.Insert(e.Key, item)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMergeVerifyFailed, err)
+		}
+	}
+	var actual int
+	replayed.ForEach(func(node art.Node) bool {
+		if live(node.Value().(internal.Item)) {
+			actual++
+		}
+		return true
+	})
+
+	if actual != expected {
+		return fmt.Errorf("%w: merged datafiles have %d keys, expected %d", ErrMergeVerifyFailed, actual, expected)
+	}
+	return nil
+}
+
+// datafilesOnDisk returns the number of datafiles in the database directory
+// and their total size
+func (b *Bitcask) datafilesOnDisk() (int, int64, error) {
+	fns, err := internal.GetDatafiles(b.config.FS, b.path, b.config.DatafileExt, b.config.DatafileMagic)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := internal.DataSize(b.config.FS, b.path, b.config.DatafileExt, b.config.DatafileMagic)
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(fns), size, nil
+}
+
+// mergeLog records the keys changed while Merge() rewrites a snapshot of the
+// keys into the merged database without holding the write lock
+type mergeLog struct {
+	keys    map[string]struct{}
+	cleared bool
+}
+
+// errMergeCleared is returned while rewriting the snapshot of a merge if the
+// database was cleared in the meantime, which makes the snapshot obsolete
+var errMergeCleared = errors.New("error: database cleared during merge")
+
+// mergeOnline rewrites the live keys into the merged database. The keys are
+// rewritten from a snapshot without holding the write lock so reads and
+// writes can carry on, and the keys changed in the meantime are then
+// rewritten again with the write lock held. The caller must hold the write
+// lock, which is held again when mergeOnline returns.
+func (b *Bitcask) mergeOnline(mdb *Bitcask) error {
+	var (
+		keys  [][]byte
+		items []internal.Item
+	)
+	b.forEachPrefix(nil, func(node art.Node) bool {
+		keys = append(keys, node.Key())
+		items = append(items, node.Value().(internal.Item))
+		return true
+	})
+
+	log := &mergeLog{keys: make(map[string]struct{})}
+	b.mergeLog = log
+	b.mu.Unlock()
+
+	var err error
+	if b.config.MergeConcurrency > 1 {
+		err = b.mergeConcurrent(mdb, log, keys, items, b.config.MergeConcurrency)
+	} else {
+		// Rewrite all key/value pairs into merged database
+		// Doing this automatically strips deleted keys and
+		// old key/value pairs
+		for i, item := range items {
+			var e internal.Entry
+			if e, err = b.readMerged(log, item); err != nil {
+				break
+			}
+			if err = mdb.setStored(keys[i], e); err != nil {
+				break
+			}
+		}
+	}
+
+	b.mu.Lock()
+	b.mergeLog = nil
+	if err != nil && err != errMergeCleared {
+		return err
+	}
+
+	return b.applyMergeLog(mdb, log)
+}
+
+// readMerged reads the entry located by `item` of the snapshot rewritten by
+// mergeOnline() with the read lock held
+func (b *Bitcask) readMerged(log *mergeLog, item internal.Item) (internal.Entry, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return internal.Entry{}, ErrDatabaseClosed
+	}
+	if log.cleared {
+		return internal.Entry{}, errMergeCleared
+	}
+	return b.readStored(item)
+}
+
+// applyMergeLog rewrites the keys changed since the snapshot of the merge
+// into the merged database. The caller must hold the write lock.
+func (b *Bitcask) applyMergeLog(mdb *Bitcask, log *mergeLog) error {
+	if log.cleared {
+		if err := mdb.Clear(); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(log.keys))
+	for key := range log.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, found := b.trie.Search([]byte(key))
+		if !found || b.expired(value.(internal.Item)) {
+			if err := mdb.remove([]byte(key)); err != nil && err != ErrKeyNotFound {
+				return err
+			}
+			continue
+		}
+
+		e, err := b.readStored(value.(internal.Item))
+		if err != nil {
+			return err
+		}
+		if err := mdb.setStored([]byte(key), e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setStored writes the entry `e` of `key` as read by readStored() into the
+// merged database, keeping its value in the same blob file if it is stored
+// in one
+func (b *Bitcask) setStored(key []byte, e internal.Entry) error {
+	if !e.Blob {
+		_, err := b.set(key, e.Value, e.Expiry, e.ModTime, e.Tag)
+		return err
+	}
+
+	if err := b.lockWrite(); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	stored := internal.Entry{
+		Checksum:   e.Checksum,
+		Key:        key,
+		Value:      e.Value,
+		Expiry:     e.Expiry,
+		ModTime:    e.ModTime,
+		Blob:       true,
+		NoChecksum: e.NoChecksum,
+		Tag:        e.Tag,
+	}
+	_, err := b.insertEntry(stored, nil)
+	return err
+}
+
+// logMerge records that `key` changed while a merge is rewriting its
+// snapshot of the keys. The caller must hold the write lock.
+func (b *Bitcask) logMerge(key []byte) {
+	if b.mergeLog != nil {
+		b.mergeLog.keys[string(key)] = struct{}{}
+	}
+}
+
+// mergeRead is an entry read by a worker of mergeConcurrent()
+type mergeRead struct {
+	key   []byte
+	item  internal.Item
+	entry internal.Entry
+	err   error
+	done  chan struct{}
+}
+
+// mergeConcurrent rewrites the snapshot of mergeOnline() into the merged
+// database reading the values with `n` workers. The reads are handed to the
+// writer in key order so the values are written in the same order as a
+// sequential merge.
+func (b *Bitcask) mergeConcurrent(mdb *Bitcask, log *mergeLog, keys [][]byte, items []internal.Item, n int) error {
+	reads := make(chan *mergeRead, n)
+	pending := make(chan *mergeRead, n)
+	stop := make(chan struct{})
+	errc := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range reads {
+				r.entry, r.err = b.readMerged(log, r.item)
+				close(r.done)
+			}
+		}()
+	}
+
+	go func() {
+		var err error
+		for r := range pending {
+			<-r.done
+			if err != nil {
+				continue
+			}
+			if err = r.err; err == nil {
+				err = mdb.setStored(r.key, r.entry)
+			}
+			if err != nil {
+				close(stop)
+			}
+		}
+		errc <- err
+	}()
+
+feed:
+	for i, item := range items {
+		r := &mergeRead{
+			key:  keys[i],
+			item: item,
+			done: make(chan struct{}),
+		}
+		select {
+		case pending <- r:
+		case <-stop:
+			break feed
+		}
+		reads <- r
+	}
+	close(reads)
+	close(pending)
+	wg.Wait()
+
+	return <-errc
+}
+
+// replaceDatafiles closes the datafiles and replaces them with the ones of
+// the merged database at `temp`, except for the datafiles named in `keep`
+func (b *Bitcask) replaceDatafiles(temp string, keep ...string) error {
+	// Close the datafiles (the lock is retained)
+	if err := b.closeDatafiles(); err != nil {
+		return err
+	}
+
+	// Atomically mark the merge as committed before touching the original
+	// datafiles so an interrupted merge is completed on the next Open()
+	if err := commitMerge(b.config.FS, b.path, temp, keep...); err != nil {
+		return err
+	}
+
+	// Replace the original data files with the merged ones
+	if err := recoverMerge(b.path, b.config); err != nil {
+		return err
+	}
+
+	// Restore our configuration over the merged database's
+	return b.saveConfig()
+}
+
+// saveConfig saves the configuration to config.json unless there is none
+// (see WithoutConfigFile)
+func (b *Bitcask) saveConfig() error {
+	if b.config.NoConfigFile {
+		return nil
+	}
+	return b.config.Save(b.config.FS, filepath.Join(b.path, "config.json"))
+}
+
+// release closes the database after a failure left it unusable by releasing
+// its lock, so Health() reports it as closed. It must be opened again.
+func (b *Bitcask) release() {
+	b.stopSyncer()
+	b.stopMetricsLogger()
+	b.unlock()
+}
+
+// ResolveFunc decides the value to keep for a key present in more than one
+// database merged by MergeDatabasesWith(), given the `current` value in the
+// destination and the `incoming` value from the source being merged.
+type ResolveFunc func(key, current, incoming []byte) ([]byte, error)
+
+// MergeDatabases merges the live keys of the `sources` databases into the
+// `dest` database, which is created if needed. Sources are merged in order
+// and a key present in more than one database takes the value of the last
+// source holding it. The sources are only read, and ErrDatabaseLocked is
+// returned for a source another process has open.
+func MergeDatabases(dest string, sources ...string) error {
+	return MergeDatabasesWith(dest, nil, sources...)
+}
+
+// MergeDatabasesWith is like MergeDatabases() but calls `resolve` (if not
+// nil) to decide the value of keys that already exist in `dest`.
+func MergeDatabasesWith(dest string, resolve ResolveFunc, sources ...string) error {
+	db, err := Open(dest)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		if err := mergeDatabase(db, source, resolve); err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	return db.Close()
+}
+
+func mergeDatabase(db *Bitcask, source string, resolve ResolveFunc) error {
+	src, err := openSource(source)
+	if err != nil {
+		return err
+	}
+	defer src.closeSource()
+
+	// Carry over the expiry of keys with a TTL as is
+	src.forEachPrefix(nil, func(node art.Node) bool {
+		item := node.Value().(internal.Item)
+
+		var (
+			value []byte
+			tag   uint8
+		)
+		if value, tag, err = src.readTagged(item); err != nil {
+			return false
+		}
+
+		if resolve != nil {
+			var current []byte
+			current, err = db.Get(node.Key())
+			if err == nil {
+				if value, err = resolve(node.Key(), current, value); err != nil {
+					return false
+				}
+			} else if err != ErrKeyNotFound {
+				return false
+			}
+		}
+
+		_, err = db.set(node.Key(), value, item.Expiry, item.ModTime, tag)
+		return err == nil
+	})
+
+	return err
+}
+
+// errMergePending is returned by openSource() for a database whose merge was
+// committed but not completed, which only opening it can do
+var errMergePending = errors.New("error: merge pending, open the database to complete it")
+
+// openSource opens the database at `path` read-only as a source of
+// MergeDatabases() or for Inspect(), without writing anything to it. It takes
+// a shared lock, so ErrDatabaseLocked is returned while another process has
+// the database open, but not while others read it this way. Its
+// configuration is read from its config.json (if any) and its index from its
+// index file or by replaying its datafiles.
+func openSource(path string) (*Bitcask, error) {
+	cfg := newDefaultConfig()
+	configPath := filepath.Join(path, "config.json")
+	if fs.Exists(fs.OS, configPath) {
+		var err error
+		if cfg, err = config.Load(fs.OS, configPath); err != nil {
+			return nil, err
+		}
+		if cfg.DatafileExt == "" {
+			cfg.DatafileExt = DefaultDatafileExtension
+		}
+		cfg.FS = fs.OS
+	}
+
+	b := &Bitcask{
+		Flock:   flock.New(filepath.Join(path, "lock")),
+		config:  cfg,
+		path:    path,
+		trie:    art.New(),
+		indexer: index.NewIndexer(cfg.FS),
+		blobs:   newBlobStore(cfg.FS, path),
+	}
+
+	// The lock file is removed again unless it was left behind by someone
+	b.removeLock = !fs.Exists(fs.OS, b.Flock.Path())
+	locked, err := b.Flock.TryRLock()
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		b.closeSource()
+		return nil, fmt.Errorf("%w: %s", ErrDatabaseLocked, path)
+	}
+
+	if fs.Exists(cfg.FS, filepath.Join(path, mergeCommitFilename)) {
+		b.closeSource()
+		return nil, fmt.Errorf("%w: %s", errMergePending, path)
+	}
+
+	datafiles, lastID, err := loadDatafiles(path, cfg, nil)
+	if err != nil {
+		b.closeSource()
+		return nil, err
+	}
+	b.datafiles = datafiles
+	if len(datafiles) == 0 {
+		return b, nil
+	}
+
+	b.curr = datafiles[lastID]
+	b.trie, b.recoveredFromIndex, err = loadIndex(context.Background(), path, b.indexer, cfg.MaxKeySize, datafiles)
+	if err != nil {
+		b.closeSource()
+		return nil, err
+	}
+	b.trie.ForEach(func(node art.Node) bool {
+		b.liveBytes += node.Value().(internal.Item).Size
+		return true
+	})
+	return b, nil
+}
+
+// closeSource closes the datafiles of a database opened by openSource() and
+// releases its shared lock
+func (b *Bitcask) closeSource() {
+	for _, df := range b.datafiles {
+		df.Close()
+	}
+
+	b.Flock.Unlock()
+	if b.removeLock {
+		os.Remove(b.Flock.Path())
+	}
+}
+
+// Inspect returns the statistics and datafiles (see Stats() and Datafiles())
+// of the database at `path` without opening it, which would lock it, save its
+// config and write its index on Close(). ErrDatabaseLocked is returned while
+// another process has the database open.
+func Inspect(path string) (Stats, []DatafileInfo, error) {
+	b, err := openSource(path)
+	if err != nil {
+		return Stats{}, nil, err
+	}
+	defer b.closeSource()
+
+	if b.curr == nil {
+		size, err := internal.DirSize(b.config.FS, path)
+		return Stats{Size: size}, nil, err
+	}
+
+	stats, err := b.Stats()
+	if err != nil {
+		return Stats{}, nil, err
+	}
+	datafiles, err := b.Datafiles()
+	if err != nil {
+		return Stats{}, nil, err
+	}
+	return stats, datafiles, nil
+}
+
+// maybeMerge merges the database before the next write rolls over to more
+// datafiles than configured with WithMaxDatafiles. Otherwise it evaluates the
+// merge trigger (if any) configured with WithMergeTrigger and the ratio
+// configured with WithAutoMergeRatio, and if either fires schedules a
+// background Merge(). At most one background merge runs at a time.
+func (b *Bitcask) maybeMerge() {
+	if b.config.MaxDatafiles > 0 && b.atMaxDatafiles() {
+		// The writer is stalled until the merge is done. If another merge is
+		// in progress it is left to reduce the datafiles.
+		b.Merge()
+		return
+	}
+
+	if b.config.MergeTrigger == nil && b.config.AutoMergeRatio <= 0 {
+		return
+	}
+
+	b.mu.RLock()
+	stats := Stats{
+		Datafiles:          len(b.datafiles),
+		Keys:               b.trie.Size(),
+		Size:               b.dataSize(),
+		RecoveredFromIndex: b.recoveredFromIndex,
+	}
+	stats.DeadBytes = stats.Size - b.liveBytes - b.headerBytes()
+	b.mu.RUnlock()
+
+	var trigger bool
+	if b.config.MergeTrigger != nil {
+		b.hook(func() { trigger = b.config.MergeTrigger(stats) })
+	}
+	if !trigger && b.config.AutoMergeRatio > 0 && stats.Size > 0 {
+		trigger = float64(stats.DeadBytes)/float64(stats.Size) > b.config.AutoMergeRatio
+	}
+	if !trigger {
+		return
+	}
 
-		if err = f(node.Key()); err != nil {
-			return false
-		}
-		return true
-	})
-	return
+	if atomic.LoadInt32(&b.merging) != 0 {
+		return
+	}
+	go b.Merge()
 }
 
-// Len returns the total number of keys in the database
-func (b *Bitcask) Len() int {
+// atMaxDatafiles returns true if the next write would roll over to more
+// datafiles than configured with WithMaxDatafiles and a merge would reclaim
+// space
+func (b *Bitcask) atMaxDatafiles() bool {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	return b.trie.Size()
-}
 
-// Keys returns all keys in the database as a channel of keys
-func (b *Bitcask) Keys() chan []byte {
-	ch := make(chan []byte)
-	go func() {
-		b.mu.RLock()
-		defer b.mu.RUnlock()
+	n := len(b.datafiles)
+	if _, ok := b.datafiles[b.curr.FileID()]; !ok {
+		n++
+	}
+	if n < b.config.MaxDatafiles || b.curr.Size() < int64(b.config.MaxDatafileSize) {
+		return false
+	}
+	return b.dataSize()-b.liveBytes-b.headerBytes() > 0
+}
 
-		for it := b.trie.Iterator(); it.HasNext(); {
-			node, _ := it.Next()
-			ch <- node.Key()
+// dataSize returns the size of the datafiles from in-memory state, which
+// leaves out the footers of sealed datafiles (see WithDatafileFooters) so they
+// aren't counted as dead bytes. The caller must hold at least a read lock.
+func (b *Bitcask) dataSize() int64 {
+	size := b.curr.Size()
+	for id, df := range b.datafiles {
+		if id != b.curr.FileID() {
+			size += df.Size()
 		}
-		close(ch)
-	}()
+	}
+	return size
+}
 
-	return ch
+// headerBytes returns the size of the headers of the datafiles (see
+// WithDatafileMagic). The caller must hold at least a read lock.
+func (b *Bitcask) headerBytes() int64 {
+	if !b.config.DatafileMagic {
+		return 0
+	}
+	n := len(b.datafiles)
+	if _, ok := b.datafiles[b.curr.FileID()]; !ok {
+		n++
+	}
+	return int64(n * len(internal.DatafileMagic))
 }
 
-// Fold iterates over all keys in the database calling the function `f` for
-// each key. If the function returns an error, no further keys are processed
-// and the error returned.
-func (b *Bitcask) Fold(f func(key []byte) error) (err error) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+// mergeCommit is the content of the merge commit marker. It records the
+// temporary merge directory and the files it holds that replace the original
+// files of the database, except for the original files to keep.
+type mergeCommit struct {
+	Dir   string   `json:"dir"`
+	Files []string `json:"files"`
+	Keep  []string `json:"keep,omitempty"`
+}
 
-	b.trie.ForEach(func(node art.Node) bool {
-		if err = f(node.Key()); err != nil {
-			return false
+// commitMerge atomically writes the merge commit marker for the merged
+// database at `temp` into the database at `path`, keeping the original files
+// named in `keep`.
+func commitMerge(fsys fs.FS, path, temp string, keep ...string) error {
+	files, err := fsys.ReadDir(temp)
+	if err != nil {
+		return err
+	}
+
+	mc := mergeCommit{Dir: filepath.Base(temp), Keep: keep}
+	for _, file := range files {
+		if !file.IsDir() {
+			mc.Files = append(mc.Files, file.Name())
 		}
-		return true
-	})
+	}
 
-	return
-}
+	data, err := json.Marshal(mc)
+	if err != nil {
+		return err
+	}
 
-func (b *Bitcask) put(key, value []byte) (int64, int64, error) {
-	size := b.curr.Size()
-	if size >= int64(b.config.MaxDatafileSize) {
-		err := b.curr.Close()
-		if err != nil {
-			return -1, 0, err
-		}
+	if err := fs.SyncDir(fsys, temp); err != nil {
+		return err
+	}
 
-		id := b.curr.FileID()
+	tmp := filepath.Join(path, mergeCommitFilename+".tmp")
+	if err := fs.WriteFile(fsys, tmp, data, 0600); err != nil {
+		return err
+	}
 
-		df, err := data.NewDatafile(b.path, id, true, b.config.MaxKeySize, b.config.MaxValueSize)
-		if err != nil {
-			return -1, 0, err
-		}
+	if err := rename(fsys, tmp, filepath.Join(path, mergeCommitFilename)); err != nil {
+		return err
+	}
 
-		b.datafiles[id] = df
+	// The merged files and the marker must be durable before the
+	// original datafiles are removed
+	return fs.SyncDir(fsys, path)
+}
 
-		id = b.curr.FileID() + 1
-		curr, err := data.NewDatafile(b.path, id, false, b.config.MaxKeySize, b.config.MaxValueSize)
+// recoverMerge deterministically resolves the state of a previous Merge() of
+// the database at `path`. If a merge commit marker is present the merge is
+// completed by moving the merged files into place and removing the other
+// datafiles; every step is idempotent so this is safe to repeat after a crash.
+// Otherwise any incomplete merge is rolled back by removing its leftovers.
+func recoverMerge(path string, cfg *config.Config) error {
+	marker := filepath.Join(path, mergeCommitFilename)
+	if !fs.Exists(cfg.FS, marker) {
+		files, err := cfg.FS.ReadDir(path)
 		if err != nil {
-			return -1, 0, err
+			return err
+		}
+		for _, file := range files {
+			if !strings.HasPrefix(file.Name(), "merge") {
+				continue
+			}
+			if err := fs.RemoveAll(cfg.FS, filepath.Join(path, file.Name())); err != nil {
+				return err
+			}
 		}
-		b.curr = curr
+		return nil
 	}
 
-	e := internal.NewEntry(key, value)
-	return b.curr.Write(e)
-}
+	data, err := fs.ReadFile(cfg.FS, marker)
+	if err != nil {
+		return err
+	}
+	var mc mergeCommit
+	if err := json.Unmarshal(data, &mc); err != nil {
+		return err
+	}
 
-func (b *Bitcask) Reopen() error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+	keep := map[string]bool{"lock": true, mergeCommitFilename: true}
+	for _, name := range mc.Keep {
+		keep[name] = true
+	}
+	for _, name := range mc.Files {
+		keep[name] = true
+		src := filepath.Join(path, mc.Dir, name)
+		if fs.Exists(cfg.FS, src) {
+			if err := rename(cfg.FS, src, filepath.Join(path, name)); err != nil {
+				return err
+			}
+		}
+	}
 
-	datafiles, lastID, err := loadDatafiles(b.path, b.config.MaxKeySize, b.config.MaxValueSize)
-	if err != nil {
+	// The merged files must be durable in place before the others go
+	if err := fs.SyncDir(cfg.FS, path); err != nil {
 		return err
 	}
 
-	t, err := loadIndex(b.path, b.indexer, b.config.MaxKeySize, datafiles)
+	// Only remove files of the database, others may share the directory
+	fns, err := internal.GetDatafiles(cfg.FS, path, cfg.DatafileExt, cfg.DatafileMagic)
 	if err != nil {
 		return err
 	}
+	for _, fn := range append(fns, filepath.Join(path, "index")) {
+		if !keep[filepath.Base(fn)] {
+			if err := cfg.FS.Remove(fn); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
 
-	curr, err := data.NewDatafile(b.path, lastID, false, b.config.MaxKeySize, b.config.MaxValueSize)
-	if err != nil {
+	if err := fs.RemoveAll(cfg.FS, filepath.Join(path, mc.Dir)); err != nil {
 		return err
 	}
 
-	b.trie = t
-	b.curr = curr
-	b.datafiles = datafiles
+	return cfg.FS.Remove(marker)
+}
 
-	return nil
+// datafileIDs returns the sorted ids of all datafiles including the current
+// one.
+func (b *Bitcask) datafileIDs() []int {
+	ids := []int{b.curr.FileID()}
+	for id := range b.datafiles {
+		if id != b.curr.FileID() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
 }
 
-// Merge merges all datafiles in the database. Old keys are squashed
-// and deleted keys removes. Duplicate key/value pairs are also removed.
-// Call this function periodically to reclaim disk space.
-func (b *Bitcask) Merge() error {
-	// Temporary merged database path
-	temp, err := ioutil.TempDir(b.path, "merge")
-	if err != nil {
-		return err
+// openDatafile opens the datafile `id` with the database's configuration
+func (b *Bitcask) openDatafile(id int, readonly bool) (data.Datafile, error) {
+	var preallocate, align int64
+	if !readonly {
+		preallocate = int64(b.config.PreallocateDatafile)
+		align = int64(b.config.EntryAlignment)
 	}
-	defer os.RemoveAll(temp)
+	return data.NewDatafile(b.config.FS, b.path, id, readonly, b.config.MaxKeySize, b.config.MaxValueSize, b.config.NoMmap, b.config.DatafileExt, b.config.DatafileMagic, preallocate, align, b.config.DatafileFooters)
+}
 
-	// Create a merged database
-	mdb, err := Open(temp, b.options...)
+// scanDatafile sequentially reads every entry of the datafile `id` from the
+// start, calling `f` with each entry and the item locating it on disk. If `f`
+// returns an error the scan stops and the error is returned.
+func (b *Bitcask) scanDatafile(id int, f func(e internal.Entry, item internal.Item) error) error {
+	df, err := b.openDatafile(id, true)
 	if err != nil {
 		return err
 	}
+	defer df.Close()
 
-	// Rewrite all key/value pairs into merged database
-	// Doing this automatically strips deleted keys and
-	// old key/value pairs
-	err = b.Fold(func(key []byte) error {
-		value, err := b.Get(key)
+	for {
+		e, n, err := df.Read()
 		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
 			return err
 		}
 
-		if err := mdb.Put(key, value); err != nil {
+		if err := f(e, internal.Item{FileID: id, Offset: e.Offset, Size: n, Expiry: e.Expiry, ModTime: e.ModTime}); err != nil {
 			return err
 		}
+	}
+}
 
-		return nil
+// mergeFiles rewrites the live keys located in the datafiles with an id lower
+// than `cutoff` into `mdb` in the order they were written, so the merged
+// datafiles are no more than the ones they replace. The caller must hold the
+// write lock.
+func (b *Bitcask) mergeFiles(mdb *Bitcask, cutoff int) error {
+	var (
+		keys  [][]byte
+		items []internal.Item
+	)
+	b.forEachPrefix(nil, func(node art.Node) bool {
+		item := node.Value().(internal.Item)
+		if item.FileID < cutoff {
+			keys = append(keys, node.Key())
+			items = append(items, item)
+		}
+		return true
 	})
-	if err != nil {
-		return err
-	}
+	sort.Sort(byLocation{keys, items})
 
-	err = mdb.Close()
-	if err != nil {
-		return err
+	for i, item := range items {
+		e, err := b.readStored(item)
+		if err != nil {
+			return err
+		}
+		if err := mdb.setStored(keys[i], e); err != nil {
+			return err
+		}
 	}
 
-	// Close the database
-	err = b.Close()
-	if err != nil {
-		return err
+	if mdb.curr.FileID() >= cutoff {
+		return errMergeOverflow
 	}
 
-	// Remove all data files
-	files, err := ioutil.ReadDir(b.path)
-	if err != nil {
-		return err
-	}
-	for _, file := range files {
-		if !file.IsDir() {
-			err := os.RemoveAll(path.Join([]string{b.path, file.Name()}...))
-			if err != nil {
-				return err
-			}
+	// The merged index also locates the keys of the datafiles kept so it
+	// indexes the whole database once they are moved into place
+	b.walkPrefix(nil, func(node art.Node) bool {
+		if item := node.Value().(internal.Item); item.FileID >= cutoff {
+			mdb.trie.Insert(node.Key(), item)
 		}
+		return true
+	})
+
+	return nil
+}
+
+// errMergeOverflow is returned by a partial merge whose merged datafiles
+// don't fit before the datafiles kept, which can happen if the maximum
+// datafile size was lowered since they were written
+var errMergeOverflow = errors.New("error: merged datafiles don't fit before the datafiles kept")
+
+// byLocation sorts keys by the location of their items in the datafiles
+type byLocation struct {
+	keys  [][]byte
+	items []internal.Item
+}
+
+func (l byLocation) Len() int { return len(l.keys) }
+
+func (l byLocation) Less(i, j int) bool {
+	if l.items[i].FileID != l.items[j].FileID {
+		return l.items[i].FileID < l.items[j].FileID
 	}
+	return l.items[i].Offset < l.items[j].Offset
+}
 
-	// Rename all merged data files
-	files, err = ioutil.ReadDir(mdb.path)
-	if err != nil {
-		return err
+func (l byLocation) Swap(i, j int) {
+	l.keys[i], l.keys[j] = l.keys[j], l.keys[i]
+	l.items[i], l.items[j] = l.items[j], l.items[i]
+}
+
+// mergeVersions scans all datafiles to find up to `n` of the most recent
+// versions of every live key and rewrites them, oldest first, into `mdb`.
+func (b *Bitcask) mergeVersions(mdb *Bitcask, n int) error {
+	capacity := b.trie.Size()
+	if b.config.InitialCapacity > capacity {
+		capacity = b.config.InitialCapacity
 	}
-	for _, file := range files {
-		err := os.Rename(
-			path.Join([]string{mdb.path, file.Name()}...),
-			path.Join([]string{b.path, file.Name()}...),
-		)
+	versions := make(map[string][]internal.Item, capacity)
+	for _, id := range b.datafileIDs() {
+		err := b.scanDatafile(id, func(e internal.Entry, item internal.Item) error {
+			key := string(e.Key)
+			if len(e.Value) == 0 {
+				delete(versions, key)
+				return nil
+			}
+			items := append(versions[key], item)
+			if len(items) > n {
+				items = items[len(items)-n:]
+			}
+			versions[key] = items
+			return nil
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	// And finally reopen the database
-	return b.Reopen()
+	var err error
+	b.forEachPrefix(nil, func(node art.Node) bool {
+		for _, item := range versions[string(node.Key())] {
+			if b.expired(item) {
+				continue
+			}
+
+			var e internal.Entry
+			if e, err = b.readStored(item); err != nil {
+				return false
+			}
+
+			if err = mdb.setStored(node.Key(), e); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+
+	return err
+}
+
+// OpenInMemory opens a new database that keeps its datafiles, index and
+// configuration in memory instead of on disk. It supports the full API, but
+// calls for durability such as Sync() do nothing and the data is lost once
+// the database is closed.
+func OpenInMemory(options ...Option) (*Bitcask, error) {
+	options = append(options[:len(options):len(options)], WithFileSystem(fs.NewMemFS()))
+	return Open("bitcask", options...)
 }
 
 // Open opens the database at the given path with optional options.
 // Options can be provided with the `WithXXX` functions that provide
 // configuration options as functions.
 func Open(path string, options ...Option) (*Bitcask, error) {
+	return OpenContext(context.Background(), path, options...)
+}
+
+// OpenContext opens the database at the given path like Open(), but gives up
+// rebuilding the index from the datafiles (when there is no index file or
+// with WithNoIndexFile) once `ctx` is done, returning its error. This bounds
+// how long opening a large database can take, see also WithOpenTimeout.
+func OpenContext(ctx context.Context, path string, options ...Option) (*Bitcask, error) {
 	var (
 		cfg *config.Config
 		err error
 	)
 
-	if err := os.MkdirAll(path, 0755); err != nil {
+	// The file system is needed before the configuration can be loaded
+	opts, err := optionsConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	fsys := opts.FS
+
+	if err := fsys.MkdirAll(path, 0755); err != nil {
 		return nil, err
 	}
 
 	configPath := filepath.Join(path, "config.json")
-	if internal.Exists(configPath) {
-		cfg, err = config.Load(configPath)
+	exists := !opts.NoConfigFile && fs.Exists(fsys, configPath)
+	if exists {
+		cfg, err = config.Load(fsys, configPath)
 		if err != nil {
 			return nil, err
 		}
+		if cfg.DatafileExt == "" {
+			cfg.DatafileExt = DefaultDatafileExtension
+		}
 	} else {
 		cfg = newDefaultConfig()
 	}
+	ext, magic := cfg.DatafileExt, cfg.DatafileMagic
 
 	bitcask := &Bitcask{
 		Flock:   flock.New(filepath.Join(path, "lock")),
 		config:  cfg,
 		options: options,
 		path:    path,
-		indexer: index.NewIndexer(),
+		indexer: index.NewIndexer(fsys),
+		blobs:   newBlobStore(fsys, path),
 	}
 
 	for _, opt := range options {
@@ -440,8 +2950,13 @@ func Open(path string, options ...Option) (*Bitcask, error) {
 			return nil, err
 		}
 	}
+	cfg.FS = fsys
 
-	locked, err := bitcask.Flock.TryLock()
+	if exists && (cfg.DatafileExt != ext || cfg.DatafileMagic != magic) {
+		return nil, ErrDatafileFormatChanged
+	}
+
+	locked, err := bitcask.lock()
 	if err != nil {
 		return nil, err
 	}
@@ -450,35 +2965,125 @@ func Open(path string, options ...Option) (*Bitcask, error) {
 		return nil, ErrDatabaseLocked
 	}
 
-	if err := cfg.Save(configPath); err != nil {
+	if err := recoverMerge(path, cfg); err != nil {
+		bitcask.unlock()
+		return nil, err
+	}
+
+	if err := bitcask.saveConfig(); err != nil {
+		bitcask.unlock()
 		return nil, err
 	}
 
-	if err := bitcask.Reopen(); err != nil {
+	if cfg.MaxOpenDatafiles > 0 {
+		bitcask.cache = data.NewCache(cfg.MaxOpenDatafiles)
+	}
+
+	if cfg.OpenTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.OpenTimeout)
+		defer cancel()
+	}
+
+	bitcask.mu.Lock()
+	err = bitcask.reopen(ctx)
+	bitcask.mu.Unlock()
+	if err != nil {
+		bitcask.unlock()
 		return nil, err
 	}
 
+	if cfg.SyncInterval > 0 {
+		bitcask.startSyncer(cfg.SyncInterval)
+	}
+
+	if cfg.MetricsInterval > 0 {
+		logf := cfg.MetricsLogf
+		if logf == nil {
+			logf = log.Printf
+		}
+		bitcask.metricsStop = make(chan struct{})
+		bitcask.metricsDone = make(chan struct{})
+		go bitcask.metricsLogger(cfg.MetricsInterval, logf)
+	}
+
 	return bitcask, nil
 }
 
-func loadDatafiles(path string, maxKeySize uint32, maxValueSize uint64) (datafiles map[int]data.Datafile, lastID int, err error) {
-	fns, err := internal.GetDatafiles(path)
+// lock tries to take the database lock, retrying for up to the configured
+// lock timeout if it is held by someone else
+func (b *Bitcask) lock() (bool, error) {
+	locked, err := b.tryLock()
+	if locked {
+		atomic.StoreInt32(&b.locked, 1)
+	}
+	return locked, err
+}
+
+func (b *Bitcask) tryLock() (bool, error) {
+	// Files can only be locked on the file system of the operating system
+	if !fs.IsOS(b.config.FS) {
+		return true, nil
+	}
+
+	if b.config.LockTimeout <= 0 {
+		return b.Flock.TryLock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.LockTimeout)
+	defer cancel()
+
+	locked, err := b.Flock.TryLockContext(ctx, lockRetryDelay)
+	if err == context.DeadlineExceeded {
+		return false, nil
+	}
+	return locked, err
+}
+
+// unlock releases the lock taken by lock()
+func (b *Bitcask) unlock() {
+	atomic.StoreInt32(&b.locked, 0)
+	if !fs.IsOS(b.config.FS) {
+		return
+	}
+	b.Flock.Unlock()
+	os.Remove(b.Flock.Path())
+}
+
+// isLocked returns true if the database holds its lock, that is until it is
+// closed or released after a failure (see release)
+func (b *Bitcask) isLocked() bool {
+	return atomic.LoadInt32(&b.locked) == 1
+}
+
+func loadDatafiles(path string, cfg *config.Config, cache *data.Cache) (datafiles map[int]data.Datafile, lastID int, err error) {
+	fns, err := internal.GetDatafiles(cfg.FS, path, cfg.DatafileExt, cfg.DatafileMagic)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	ids, err := internal.ParseIds(fns)
+	ids, err := internal.ParseIds(fns, cfg.DatafileExt)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	datafiles = make(map[int]data.Datafile, len(ids))
 	for _, id := range ids {
-		datafiles[id], err = data.NewDatafile(path, id, true, maxKeySize, maxValueSize)
+		if cache != nil {
+			datafiles[id], err = data.NewLazyDatafile(cache, cfg.FS, path, id, cfg.MaxKeySize, cfg.MaxValueSize, cfg.NoMmap, cfg.DatafileExt, cfg.DatafileMagic)
+		} else {
+			datafiles[id], err = data.NewDatafile(cfg.FS, path, id, true, cfg.MaxKeySize, cfg.MaxValueSize, cfg.NoMmap, cfg.DatafileExt, cfg.DatafileMagic, 0, 0, false)
+		}
 		if err != nil {
 			return
 		}
 
+		if cfg.VerifyFooters {
+			if _, err = data.VerifyFooter(cfg.FS, datafiles[id].Name()); err != nil {
+				err = fmt.Errorf("error verifying datafile %d: %w", id, err)
+				return
+			}
+		}
 	}
 	if len(ids) > 0 {
 		lastID = ids[len(ids)-1]
@@ -486,6 +3091,71 @@ func loadDatafiles(path string, maxKeySize uint32, maxValueSize uint64) (datafil
 	return
 }
 
+// repairLastDatafile verifies that the last datafile (the one that will be
+// appended to) ends on a valid entry boundary and, if not, truncates it to
+// the end of its last valid entry so new entries are never appended after a
+// partially written (torn) entry.
+func repairLastDatafile(path string, cfg *config.Config) error {
+	fns, err := internal.GetDatafiles(cfg.FS, path, cfg.DatafileExt, cfg.DatafileMagic)
+	if err != nil {
+		return err
+	}
+
+	ids, err := internal.ParseIds(fns, cfg.DatafileExt)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	df, err := data.NewDatafile(cfg.FS, path, ids[len(ids)-1], true, cfg.MaxKeySize, cfg.MaxValueSize, true, cfg.DatafileExt, cfg.DatafileMagic, 0, 0, false)
+	if err != nil {
+		return err
+	}
+
+	var (
+		offset  int64
+		corrupt bool
+	)
+	if cfg.DatafileMagic {
+		offset = int64(len(internal.DatafileMagic))
+	}
+	for {
+		e, n, err := df.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err == io.ErrUnexpectedEOF || codec.IsCorruptedData(err) {
+				corrupt = true
+				break
+			}
+			df.Close()
+			return err
+		}
+		offset = e.Offset + n
+	}
+
+	name := df.Name()
+	if err := df.Close(); err != nil {
+		return err
+	}
+
+	if !corrupt {
+		return nil
+	}
+	f, err := cfg.FS.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func getSortedDatafiles(datafiles map[int]data.Datafile) []data.Datafile {
 	out := make([]data.Datafile, len(datafiles))
 	idx := 0
@@ -499,35 +3169,48 @@ func getSortedDatafiles(datafiles map[int]data.Datafile) []data.Datafile {
 	return out
 }
 
-func loadIndex(path string, indexer index.Indexer, maxKeySize uint32, datafiles map[int]data.Datafile) (art.Tree, error) {
+// loadIndex loads the index from the index file returning whether it was
+// found, or otherwise rebuilds it from the datafiles.
+func loadIndex(ctx context.Context, path string, indexer index.Indexer, maxKeySize uint32, datafiles map[int]data.Datafile) (art.Tree, bool, error) {
 	t, found, err := indexer.Load(filepath.Join(path, "index"), maxKeySize)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if !found {
-		sortedDatafiles := getSortedDatafiles(datafiles)
-		for _, df := range sortedDatafiles {
-			var offset int64
-			for {
-				e, n, err := df.Read()
-				if err != nil {
-					if err == io.EOF {
-						break
-					}
-					return nil, err
-				}
+		if err := replayDatafiles(ctx, t, datafiles); err != nil {
+			return nil, false, err
+		}
+	}
+	return t, found, nil
+}
 
-				// Tombstone value  (deleted key)
-				if len(e.Value) == 0 {
-					t.Delete(e.Key)
-					offset += n
-					continue
+// replayDatafiles rebuilds the index `t` by reading every entry of the given
+// datafiles in order of their ids. If `ctx` is done first its error is
+// returned.
+func replayDatafiles(ctx context.Context, t art.Tree, datafiles map[int]data.Datafile) error {
+	sortedDatafiles := getSortedDatafiles(datafiles)
+	for _, df := range sortedDatafiles {
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			e, n, err := df.Read()
+			if err != nil {
+				if err == io.EOF {
+					break
 				}
-				item := internal.Item{FileID: df.FileID(), Offset: offset, Size: n}
-				t.Insert(e.Key, item)
-				offset += n
+				return err
+			}
+
+			// Tombstone value  (deleted key)
+			if len(e.Value) == 0 {
+				t.Delete(e.Key)
+				continue
 			}
+			item := internal.Item{FileID: df.FileID(), Offset: e.Offset, Size: n, Expiry: e.Expiry, ModTime: e.ModTime}
+			t.Insert(e.Key, item)
 		}
 	}
-	return t, nil
+	return nil
 }
@@ -2,8 +2,10 @@ package bitcask
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -12,12 +14,18 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/config"
+	"github.com/prologic/bitcask/internal/data"
+	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/internal/fs"
+	"github.com/prologic/bitcask/internal/index"
 	"github.com/prologic/bitcask/internal/mocks"
 )
 
@@ -121,6 +129,22 @@ func TestAll(t *testing.T) {
 		assert.Equal([][]byte{[]byte("bar")}, values)
 	})
 
+	t.Run("FoldWithValue", func(t *testing.T) {
+		var (
+			keys   [][]byte
+			values [][]byte
+		)
+
+		err := db.FoldWithValue(func(key, value []byte) error {
+			keys = append(keys, key)
+			values = append(values, value)
+			return nil
+		})
+		assert.NoError(err)
+		assert.Equal([][]byte{[]byte("foo")}, keys)
+		assert.Equal([][]byte{[]byte("bar")}, values)
+	})
+
 	t.Run("Delete", func(t *testing.T) {
 		err := db.Delete([]byte("foo"))
 		assert.NoError(err)
@@ -159,6 +183,40 @@ func TestDeleteAll(t *testing.T) {
 	assert.Equal(ErrKeyNotFound, err)
 }
 
+func TestDeleteMissingKey(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Idempotent", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Delete([]byte("foo")))
+		}
+		assert.Equal(int64(0), db.curr.Size())
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithStrictDeletes())
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Equal(ErrKeyNotFound, db.Delete([]byte("foo")))
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Delete([]byte("foo")))
+		assert.Equal(ErrKeyNotFound, db.Delete([]byte("foo")))
+	})
+}
+
 func TestReopen1(t *testing.T) {
 	assert := assert.New(t)
 	for i := 0; i < 10; i++ {
@@ -402,6 +460,45 @@ func TestReIndex(t *testing.T) {
 	})
 }
 
+func TestReopenTornWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Close())
+
+	// Simulate a partially written entry at the end of the datafile
+	f, err := os.OpenFile(filepath.Join(testdir, "000000000.data"), os.O_WRONLY|os.O_APPEND, 0640)
+	assert.NoError(err)
+	_, err = f.Write([]byte{0, 0, 0, 3, 0, 0})
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("hello"), []byte("world")))
+	assert.NoError(db.Close())
+
+	assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+
+	val, err = db.Get([]byte("hello"))
+	assert.NoError(err)
+	assert.Equal([]byte("world"), val)
+}
+
 func TestReIndexDeletedKeys(t *testing.T) {
 	assert := assert.New(t)
 
@@ -478,6 +575,53 @@ func TestReIndexDeletedKeys(t *testing.T) {
 	})
 }
 
+func TestNoIndexFile(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithNoIndexFile(true))
+	assert.NoError(err)
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("hello"), []byte("world")))
+	assert.NoError(db.Delete([]byte("hello")))
+	assert.NoError(db.Close())
+
+	assert.False(fs.Exists(fs.OS, filepath.Join(testdir, "index")))
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+
+	_, err = db.Get([]byte("hello"))
+	assert.Equal(ErrKeyNotFound, err)
+
+	// The setting is saved until it is turned off
+	assert.NoError(db.Close())
+	assert.False(fs.Exists(fs.OS, filepath.Join(testdir, "index")))
+
+	db, err = Open(testdir, WithNoIndexFile(false))
+	assert.NoError(err)
+	assert.NoError(db.Close())
+	assert.True(fs.Exists(fs.OS, filepath.Join(testdir, "index")))
+	data, err := ioutil.ReadFile(filepath.Join(testdir, "config.json"))
+	assert.NoError(err)
+	assert.NotContains(string(data), "no_index_file")
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+	assert.NoError(db.Reconfigure(WithNoIndexFile(true)))
+	assert.NoError(db.Close())
+	assert.False(fs.Exists(fs.OS, filepath.Join(testdir, "index")))
+}
+
 func TestSync(t *testing.T) {
 	assert := assert.New(t)
 
@@ -498,574 +642,832 @@ func TestSync(t *testing.T) {
 	})
 }
 
-func TestMaxKeySize(t *testing.T) {
+func TestClock(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	var db *Bitcask
-
-	t.Run("Open", func(t *testing.T) {
-		db, err = Open(testdir, WithMaxKeySize(16))
-		assert.NoError(err)
-	})
+	db, err := Open(testdir)
+	assert.NoError(err)
+	assert.WithinDuration(time.Now(), db.now(), time.Second)
+	assert.NoError(db.Close())
 
-	t.Run("Put", func(t *testing.T) {
-		key := []byte(strings.Repeat(" ", 17))
-		value := []byte("foobar")
-		err = db.Put(key, value)
-		assert.Error(err)
-		assert.Equal(ErrKeyTooLarge, err)
-	})
+	epoch := time.Unix(1234567890, 0)
+	db, err = Open(testdir, WithClock(func() time.Time { return epoch }))
+	assert.NoError(err)
+	defer db.Close()
+	assert.Equal(epoch, db.now())
 }
 
-func TestMaxValueSize(t *testing.T) {
+func TestCaseInsensitiveKeys(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	var db *Bitcask
+	db, err := Open(testdir, WithCaseInsensitiveKeys())
+	assert.NoError(err)
+	defer db.Close()
 
-	t.Run("Open", func(t *testing.T) {
-		db, err = Open(testdir, WithMaxValueSize(16))
-		assert.NoError(err)
-	})
+	assert.NoError(db.Put([]byte("Foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("FOOZ"), []byte("baz")))
 
-	t.Run("Put", func(t *testing.T) {
-		key := []byte("foo")
-		value := []byte(strings.Repeat(" ", 17))
-		err = db.Put(key, value)
-		assert.Error(err)
-		assert.Equal(ErrValueTooLarge, err)
-	})
+	val, err := db.Get([]byte("fOO"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+	assert.True(db.Has([]byte("foo")))
+
+	var keys [][]byte
+	assert.NoError(db.Scan([]byte("FO"), func(key []byte) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal([][]byte{[]byte("foo"), []byte("fooz")}, SortByteArrays(keys))
+
+	assert.NoError(db.Delete([]byte("FOO")))
+	assert.False(db.Has([]byte("Foo")))
+	assert.Equal(1, db.Len())
 }
 
-func TestStats(t *testing.T) {
-	var (
-		db  *Bitcask
-		err error
-	)
+func TestMaxOpenDatafiles(t *testing.T) {
+	assert := assert.New(t)
 
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxOpenDatafiles(2), WithMaxDatafileSize(32))
+	assert.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte(fmt.Sprintf("bar%d", i))))
+	}
+	assert.True(len(db.datafiles) > 2)
+
+	check := func() {
+		var wg sync.WaitGroup
+		for n := 0; n < 4; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 9; i >= 0; i-- {
+					val, err := db.Get([]byte(fmt.Sprintf("foo%d", i)))
+					assert.NoError(err)
+					assert.Equal([]byte(fmt.Sprintf("bar%d", i)), val)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	check()
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir, WithMaxOpenDatafiles(1), WithNoIndexFile(true))
+	assert.NoError(err)
+	defer db.Close()
+	check()
+	assert.NoError(db.Merge())
+	check()
+}
+
+func TestDedupWrites(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir)
-			assert.NoError(err)
-		})
+	db, err := Open(testdir, WithDedupWrites())
+	assert.NoError(err)
+	defer db.Close()
 
-		t.Run("Put", func(t *testing.T) {
-			err := db.Put([]byte("foo"), []byte("bar"))
-			assert.NoError(err)
-		})
+	n, err := db.PutN([]byte("foo"), []byte("bar"))
+	assert.NoError(err)
+	assert.Equal(int64(22), n)
 
-		t.Run("Get", func(t *testing.T) {
-			val, err := db.Get([]byte("foo"))
-			assert.NoError(err)
-			assert.Equal([]byte("bar"), val)
-		})
+	n, err = db.PutN([]byte("foo"), []byte("bar"))
+	assert.NoError(err)
+	assert.Equal(int64(0), n)
 
-		t.Run("Stats", func(t *testing.T) {
-			stats, err := db.Stats()
-			assert.NoError(err)
-			assert.Equal(stats.Datafiles, 0)
-			assert.Equal(stats.Keys, 1)
-		})
+	n, err = db.PutN([]byte("foo"), []byte("baz"))
+	assert.NoError(err)
+	assert.Equal(int64(22), n)
 
-		t.Run("Sync", func(t *testing.T) {
-			err = db.Sync()
-			assert.NoError(err)
-		})
+	size, err := db.DataSize()
+	assert.NoError(err)
+	assert.Equal(int64(44), size)
 
-		t.Run("Close", func(t *testing.T) {
-			err = db.Close()
-			assert.NoError(err)
-		})
-	})
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("baz"), val)
 }
 
-func TestStatsError(t *testing.T) {
-	var (
-		db  *Bitcask
-		err error
-	)
-
+func TestPutReader(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir)
-			assert.NoError(err)
-		})
+	db, err := Open(testdir, WithMaxValueSize(8))
+	assert.NoError(err)
+	defer db.Close()
 
-		t.Run("Put", func(t *testing.T) {
-			err := db.Put([]byte("foo"), []byte("bar"))
-			assert.NoError(err)
-		})
+	assert.NoError(db.PutReader([]byte("foo"), strings.NewReader("12345678")))
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("12345678"), val)
 
-		t.Run("Get", func(t *testing.T) {
-			val, err := db.Get([]byte("foo"))
-			assert.NoError(err)
-			assert.Equal([]byte("bar"), val)
-		})
+	size, err := db.DataSize()
+	assert.NoError(err)
 
-		t.Run("Stats", func(t *testing.T) {
-			stats, err := db.Stats()
-			assert.NoError(err)
-			assert.Equal(stats.Datafiles, 0)
-			assert.Equal(stats.Keys, 1)
-		})
-	})
+	err = db.PutReader([]byte("bar"), strings.NewReader("123456789"))
+	assert.Equal(ErrValueTooLarge, err)
+	assert.False(db.Has([]byte("bar")))
 
-	t.Run("Test", func(t *testing.T) {
-		skipIfWindows(t)
+	// Nothing was written for the oversized value
+	newSize, err := db.DataSize()
+	assert.NoError(err)
+	assert.Equal(size, newSize)
+}
 
-		t.Run("FabricatedDestruction", func(t *testing.T) {
-			// This would never happen in reality :D
-			// Or would it? :)
-			err = os.RemoveAll(testdir)
-			assert.NoError(err)
-		})
+func TestReverseScan(t *testing.T) {
+	assert := assert.New(t)
 
-		t.Run("Stats", func(t *testing.T) {
-			_, err := db.Stats()
-			assert.Error(err)
-		})
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	for _, key := range []string{"foo1", "bar", "foo3", "foo2"} {
+		assert.NoError(db.Put([]byte(key), []byte("value")))
+	}
+
+	var keys [][]byte
+	err = db.ReverseScan([]byte("foo"), func(key []byte) error {
+		keys = append(keys, key)
+		return nil
 	})
-}
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("foo3"), []byte("foo2"), []byte("foo1")}, keys)
 
-func TestMaxDatafileSize(t *testing.T) {
-	var (
-		db  *Bitcask
-		err error
-	)
+	errStop := errors.New("stop")
+	keys = nil
+	err = db.ReverseScan(nil, func(key []byte) error {
+		keys = append(keys, key)
+		return errStop
+	})
+	assert.Equal(errStop, err)
+	assert.Equal([][]byte{[]byte("foo3")}, keys)
+}
 
+func TestSecondaryIndex(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
 	defer os.RemoveAll(testdir)
 
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir, WithMaxDatafileSize(32))
-			assert.NoError(err)
-		})
+	// Index values by each of their comma separated tags
+	tags := WithSecondaryIndex("tags", func(key, value []byte) [][]byte {
+		return bytes.Split(value, []byte(","))
+	})
 
-		t.Run("Put", func(t *testing.T) {
-			err := db.Put([]byte("foo"), []byte("bar"))
-			assert.NoError(err)
-		})
-	})
+	db, err := Open(testdir, tags)
+	assert.NoError(err)
 
-	t.Run("Put", func(t *testing.T) {
-		for i := 0; i < 10; i++ {
-			err := db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("bar"))
-			assert.NoError(err)
-		}
-	})
+	assert.NoError(db.Put([]byte("foo"), []byte("red,green")))
+	assert.NoError(db.Put([]byte("bar"), []byte("green")))
+	assert.NoError(db.Put([]byte("baz"), []byte("blue")))
 
-	t.Run("Sync", func(t *testing.T) {
-		err = db.Sync()
-		assert.NoError(err)
-	})
+	keys, err := db.Lookup("tags", []byte("green"))
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("bar"), []byte("foo")}, keys)
 
-	t.Run("Get", func(t *testing.T) {
-		val, err := db.Get([]byte("foo"))
-		assert.NoError(err)
-		assert.Equal([]byte("bar"), val)
+	_, err = db.Lookup("missing", []byte("green"))
+	assert.Equal(ErrIndexNotFound, err)
 
-		for i := 0; i < 10; i++ {
-			val, err = db.Get([]byte(fmt.Sprintf("key_%d", i)))
-			assert.NoError(err)
-			assert.Equal([]byte("bar"), val)
-		}
-	})
+	assert.NoError(db.Put([]byte("foo"), []byte("red")))
+	assert.NoError(db.Delete([]byte("bar")))
 
-	t.Run("Close", func(t *testing.T) {
-		err = db.Close()
-		assert.NoError(err)
-	})
-}
+	keys, err = db.Lookup("tags", []byte("green"))
+	assert.NoError(err)
+	assert.Empty(keys)
+	assert.NoError(db.Close())
 
-func TestMerge(t *testing.T) {
-	var (
-		db  *Bitcask
-		err error
-	)
+	// The index is rebuilt when opening the database
+	db, err = Open(testdir, tags)
+	assert.NoError(err)
+	defer db.Close()
+
+	keys, err = db.Lookup("tags", []byte("red"))
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("foo")}, keys)
+
+	assert.NoError(db.DeleteAll())
+	keys, err = db.Lookup("tags", []byte("red"))
+	assert.NoError(err)
+	assert.Empty(keys)
+}
 
+func TestSecondaryIndexDelete(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir, WithMaxDatafileSize(32))
-			assert.NoError(err)
-		})
-
-		t.Run("Put", func(t *testing.T) {
-			err := db.Put([]byte("foo"), []byte("bar"))
-			assert.NoError(err)
-		})
+	db, err := Open(testdir, WithSecondaryIndex("tags", func(key, value []byte) [][]byte {
+		return bytes.Split(value, []byte(","))
+	}))
+	assert.NoError(err)
+	defer db.Close()
 
-		s1, err := db.Stats()
+	lookup := func(term string) [][]byte {
+		keys, err := db.Lookup("tags", []byte(term))
 		assert.NoError(err)
-		assert.Equal(0, s1.Datafiles)
-		assert.Equal(1, s1.Keys)
+		return keys
+	}
 
-		t.Run("Put", func(t *testing.T) {
-			for i := 0; i < 10; i++ {
-				err := db.Put([]byte("foo"), []byte("bar"))
-				assert.NoError(err)
-			}
-		})
+	// The terms of the value overwritten last are removed, even if the
+	// caller reuses the buffer of the values written
+	value := []byte("red,green")
+	assert.NoError(db.Put([]byte("foo"), value))
+	copy(value, "blu,white")
+	assert.NoError(db.Put([]byte("foo"), value))
+	assert.Empty(lookup("red"))
+	assert.Empty(lookup("green"))
+	assert.Equal([][]byte{[]byte("foo")}, lookup("blu"))
+
+	assert.NoError(db.Put([]byte("bar"), []byte("white")))
+	copy(value, "xxxxxxxxx")
+	assert.NoError(db.Delete([]byte("foo")))
+	assert.Empty(lookup("blu"))
+	assert.Equal([][]byte{[]byte("bar")}, lookup("white"))
+	assert.Empty(db.indexes["tags"].keys["foo"])
+
+	// Deleting again or a key never written leaves the others indexed
+	assert.NoError(db.Delete([]byte("foo")))
+	assert.NoError(db.Delete([]byte("baz")))
+	assert.Equal([][]byte{[]byte("bar")}, lookup("white"))
+
+	assert.NoError(db.Put([]byte("foo"), []byte("white")))
+	assert.NoError(db.Delete([]byte("bar")))
+	assert.Equal([][]byte{[]byte("foo")}, lookup("white"))
+	assert.Equal(1, db.indexes["tags"].terms.Size())
+}
 
-		s2, err := db.Stats()
-		assert.NoError(err)
-		assert.Equal(5, s2.Datafiles)
-		assert.Equal(1, s2.Keys)
-		assert.True(s2.Size > s1.Size)
+func TestPutN(t *testing.T) {
+	assert := assert.New(t)
 
-		t.Run("Merge", func(t *testing.T) {
-			err := db.Merge()
-			assert.NoError(err)
-		})
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-		s3, err := db.Stats()
-		assert.NoError(err)
-		assert.Equal(1, s3.Datafiles)
-		assert.Equal(1, s3.Keys)
-		assert.True(s3.Size > s1.Size)
-		assert.True(s3.Size < s2.Size)
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
 
-		t.Run("Sync", func(t *testing.T) {
-			err = db.Sync()
-			assert.NoError(err)
-		})
+	n, err := db.PutN([]byte("foo"), []byte("bar"))
+	assert.NoError(err)
+	assert.Equal(int64(22), n)
 
-		t.Run("Close", func(t *testing.T) {
-			err = db.Close()
-			assert.NoError(err)
-		})
-	})
+	n, err = db.PutN([]byte("hello"), []byte("world"))
+	assert.NoError(err)
+	assert.Equal(int64(26), n)
+
+	datafiles, err := db.Datafiles()
+	assert.NoError(err)
+	assert.Equal(int64(48), datafiles[0].Size)
+
+	_, err = db.PutN([]byte(strings.Repeat("k", int(DefaultMaxKeySize)+1)), []byte("bar"))
+	assert.Equal(ErrKeyTooLarge, err)
 }
 
-func TestGetErrors(t *testing.T) {
+func TestNoMmap(t *testing.T) {
 	assert := assert.New(t)
 
-	t.Run("ReadError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-		db, err := Open(testdir, WithMaxDatafileSize(32))
-		assert.NoError(err)
+	db, err := Open(testdir, WithNoMmap(), WithMaxDatafileSize(32))
+	assert.NoError(err)
 
-		err = db.Put([]byte("foo"), []byte("bar"))
+	for i := 0; i < 4; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+	assert.True(len(db.datafiles) > 0)
+
+	for i := 0; i < 4; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("foo%d", i)))
 		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	}
+	assert.NoError(db.Close())
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("FileID").Return(0)
-		mockDatafile.On("ReadAt", int64(0), int64(22)).Return(
-			internal.Entry{},
-			ErrMockError,
-		)
-		db.curr = mockDatafile
+	db, err = Open(testdir, WithNoMmap())
+	assert.NoError(err)
+	defer db.Close()
 
-		_, err = db.Get([]byte("foo"))
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
-	})
+	val, err := db.Get([]byte("foo0"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+}
 
-	t.Run("ChecksumError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+func TestDatafileFormat(t *testing.T) {
+	assert := assert.New(t)
 
-		db, err := Open(testdir, WithMaxDatafileSize(32))
-		assert.NoError(err)
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-		err = db.Put([]byte("foo"), []byte("bar"))
-		assert.NoError(err)
+	// Files of another system sharing the directory
+	foreign := []string{
+		filepath.Join(testdir, "000000999.bc"),
+		filepath.Join(testdir, "000000000.data"),
+	}
+	for _, fn := range foreign {
+		assert.NoError(ioutil.WriteFile(fn, []byte("garbage"), 0600))
+	}
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("FileID").Return(0)
-		mockDatafile.On("ReadAt", int64(0), int64(22)).Return(
-			internal.Entry{
-				Checksum: 0x0,
-				Key:      []byte("foo"),
-				Offset:   0,
-				Value:    []byte("bar"),
-			},
-			nil,
-		)
-		db.curr = mockDatafile
+	db, err := Open(testdir, WithDatafileExtension(".bc"), WithDatafileMagic(), WithMaxDatafileSize(64))
+	assert.NoError(err)
+	for i := 0; i < 5; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+	assert.NoError(db.Close())
 
-		_, err = db.Get([]byte("foo"))
-		assert.Error(err)
-		assert.Equal(ErrChecksumFailed, err)
-	})
+	header := make([]byte, len(internal.DatafileMagic))
+	f, err := os.Open(filepath.Join(testdir, "000000000.bc"))
+	assert.NoError(err)
+	_, err = io.ReadFull(f, header)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	assert.Equal(internal.DatafileMagic, string(header))
+
+	_, err = Open(testdir, WithDatafileExtension(".data"))
+	assert.Equal(ErrDatafileFormatChanged, err)
+
+	// Rebuild the index from the datafiles to exercise the header skipping
+	assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+	db, err = Open(testdir)
+	assert.NoError(err)
+	assert.NoError(db.Merge())
+	for i := 0; i < 5; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("foo%d", i)))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	}
+	assert.NoError(db.Close())
 
+	for _, fn := range foreign {
+		assert.True(fs.Exists(fs.OS, fn))
+	}
 }
 
-func TestPutErrors(t *testing.T) {
+func TestMaxKeySizeBoundary(t *testing.T) {
 	assert := assert.New(t)
 
-	t.Run("WriteError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-
-		db, err := Open(testdir)
-		assert.NoError(err)
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Size").Return(int64(0))
-		mockDatafile.On(
-			"Write",
-			internal.Entry{
-				Checksum: 0x76ff8caa,
-				Key:      []byte("foo"),
-				Offset:   0,
-				Value:    []byte("bar"),
-			},
-		).Return(int64(0), int64(0), ErrMockError)
-		db.curr = mockDatafile
+	db, err := Open(testdir, WithMaxKeySize(16))
+	assert.NoError(err)
 
-		err = db.Put([]byte("foo"), []byte("bar"))
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
-	})
+	key := []byte(strings.Repeat("k", 16))
+	assert.NoError(db.Put(key, []byte("foobar")))
+	assert.Equal(ErrKeyTooLarge, db.Put(append(key, 'k'), []byte("foobar")))
+	assert.NoError(db.Close())
 
-	t.Run("SyncError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
+	// The key must round-trip through both the index and the datafiles
+	for _, opts := range [][]Option{nil, {WithNoIndexFile(true)}} {
+		db, err = Open(testdir, opts...)
 		assert.NoError(err)
-		db, err := Open(testdir, WithSync(true))
+		val, err := db.Get(key)
 		assert.NoError(err)
-
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Size").Return(int64(0))
-		mockDatafile.On(
-			"Write",
-			internal.Entry{
-				Checksum: 0x78240498,
-				Key:      []byte("bar"),
-				Offset:   0,
-				Value:    []byte("baz"),
-			},
-		).Return(int64(0), int64(0), nil)
-		mockDatafile.On("Sync").Return(ErrMockError)
-		db.curr = mockDatafile
-
-		err = db.Put([]byte("bar"), []byte("baz"))
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
-	})
+		assert.Equal([]byte("foobar"), val)
+		assert.NoError(db.Close())
+	}
 }
 
-func TestOpenErrors(t *testing.T) {
+func TestTTL(t *testing.T) {
 	assert := assert.New(t)
 
-	t.Run("BadPath", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-		assert.NoError(ioutil.WriteFile(filepath.Join(testdir, "foo"), []byte("foo"), 0600))
+	now := time.Unix(1234567890, 0)
+	clock := WithClock(func() time.Time { return now })
 
-		_, err = Open(filepath.Join(testdir, "foo", "tmp.db"))
-		assert.Error(err)
-	})
+	db, err := Open(testdir, clock)
+	assert.NoError(err)
 
-	t.Run("BadOption", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.PutWithTTL([]byte("hello"), []byte("world"), time.Minute))
 
-		withBogusOption := func() Option {
-			return func(cfg *config.Config) error {
-				return errors.New("mocked error")
-			}
-		}
+	_, ok, err := db.TTL([]byte("foo"))
+	assert.NoError(err)
+	assert.False(ok)
 
-		_, err = Open(testdir, withBogusOption())
-		assert.Error(err)
-	})
+	ttl, ok, err := db.TTL([]byte("hello"))
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(time.Minute, ttl)
 
-	t.Run("LoadDatafilesError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+	_, _, err = db.TTL([]byte("missing"))
+	assert.Equal(ErrKeyNotFound, err)
 
-		db, err := Open(testdir)
-		assert.NoError(err)
+	now = now.Add(30 * time.Second)
+	ttl, _, err = db.TTL([]byte("hello"))
+	assert.NoError(err)
+	assert.Equal(30*time.Second, ttl)
+	assert.NoError(db.Close())
 
-		err = db.Put([]byte("foo"), []byte("bar"))
+	// The expiry survives both the index and a replay of the datafiles
+	for _, opts := range [][]Option{{clock}, {clock, WithNoIndexFile(true)}} {
+		db, err = Open(testdir, opts...)
 		assert.NoError(err)
-
-		err = db.Close()
+		ttl, _, err = db.TTL([]byte("hello"))
 		assert.NoError(err)
+		assert.Equal(30*time.Second, ttl)
+		assert.NoError(db.Close())
+	}
 
-		// Simulate some horrible that happened to the datafiles!
-		err = os.Rename(filepath.Join(testdir, "000000000.data"), filepath.Join(testdir, "000000000xxx.data"))
-		assert.NoError(err)
+	db, err = Open(testdir, clock)
+	assert.NoError(err)
+	defer db.Close()
 
-		_, err = Open(testdir)
-		assert.Error(err)
-		assert.Equal("strconv.ParseInt: parsing \"000000000xxx\": invalid syntax", err.Error())
-	})
+	now = now.Add(30 * time.Second)
+	_, _, err = db.TTL([]byte("hello"))
+	assert.Equal(ErrKeyNotFound, err)
+	_, err = db.Get([]byte("hello"))
+	assert.Equal(ErrKeyNotFound, err)
+	assert.False(db.Has([]byte("hello")))
+
+	var keys [][]byte
+	assert.NoError(db.Fold(func(key []byte) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal([][]byte{[]byte("foo")}, keys)
+
+	assert.NoError(db.Merge())
+	assert.Equal(1, db.Len())
 }
 
-func TestCloseErrors(t *testing.T) {
+func TestModTimes(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
 	defer os.RemoveAll(testdir)
 
-	t.Run("CloseIndexError", func(t *testing.T) {
-		db, err := Open(testdir, WithMaxDatafileSize(32))
-		assert.NoError(err)
+	now := time.Unix(1600000000, 0)
+	clock := WithClock(func() time.Time { return now })
 
-		mockIndexer := new(mocks.Indexer)
-		mockIndexer.On("Save", db.trie, filepath.Join(db.path, "index")).Return(ErrMockError)
-		db.indexer = mockIndexer
+	db, err := Open(testdir, clock)
+	assert.NoError(err)
 
-		err = db.Close()
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
-	})
+	// Not recorded unless enabled
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	_, ok := db.ModTime([]byte("foo"))
+	assert.False(ok)
+	assert.NoError(db.Close())
 
-	t.Run("CloseDatafilesError", func(t *testing.T) {
-		db, err := Open(testdir, WithMaxDatafileSize(32))
-		assert.NoError(err)
+	// Enabling is persisted with the database
+	db, err = Open(testdir, clock, WithModTimes())
+	assert.NoError(err)
+	assert.NoError(db.Close())
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Close").Return(ErrMockError)
-		db.datafiles[0] = mockDatafile
+	db, err = Open(testdir, clock)
+	assert.NoError(err)
+	defer func() { db.Close() }()
 
-		err = db.Close()
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
-	})
+	assert.NoError(db.Put([]byte("hello"), []byte("world")))
+	now = now.Add(time.Hour)
+	assert.NoError(db.PutWithTTL([]byte("foo"), []byte("baz"), time.Minute))
 
-	t.Run("CloseActiveDatafileError", func(t *testing.T) {
-		db, err := Open(testdir, WithMaxDatafileSize(32))
+	modTime, ok := db.ModTime([]byte("hello"))
+	assert.True(ok)
+	assert.Equal(time.Unix(1600000000, 0), modTime)
+
+	_, ok = db.ModTime([]byte("missing"))
+	assert.False(ok)
+
+	val, meta, err := db.GetWithMeta([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("baz"), val)
+	assert.Equal(now, meta.ModTime)
+	assert.Equal(now.Add(time.Minute), meta.Expiry)
+
+	check := func() {
+		modTime, ok := db.ModTime([]byte("hello"))
+		assert.True(ok)
+		assert.Equal(time.Unix(1600000000, 0), modTime)
+
+		_, meta, err := db.GetWithMeta([]byte("foo"))
 		assert.NoError(err)
+		assert.Equal(now, meta.ModTime)
+	}
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Close").Return(ErrMockError)
-		db.curr = mockDatafile
+	// Modification times are preserved by merges and restored from the index
+	// and the datafiles
+	assert.NoError(db.Merge())
+	check()
 
-		err = db.Close()
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
-	})
+	assert.NoError(db.Close())
+	db, err = Open(testdir, clock)
+	assert.NoError(err)
+	check()
+
+	assert.NoError(db.Close())
+	assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+	db, err = Open(testdir, clock)
+	assert.NoError(err)
+	check()
 }
 
-func TestDeleteErrors(t *testing.T) {
+func TestHasE(t *testing.T) {
 	assert := assert.New(t)
 
-	t.Run("WriteError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-		db, err := Open(testdir, WithMaxDatafileSize(32))
-		assert.NoError(err)
+	db, err := Open(testdir)
+	assert.NoError(err)
 
-		err = db.Put([]byte("foo"), []byte("bar"))
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	found, err := db.HasE([]byte("foo"))
+	assert.NoError(err)
+	assert.True(found)
+	found, err = db.HasE([]byte("missing"))
+	assert.NoError(err)
+	assert.False(found)
+
+	assert.NoError(db.Close())
+	found, err = db.HasE([]byte("foo"))
+	assert.Equal(ErrDatabaseClosed, err)
+	assert.False(found)
+	assert.False(db.Has([]byte("foo")))
+
+	t.Run("InMemory", func(t *testing.T) {
+		db, err := OpenInMemory()
 		assert.NoError(err)
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Size").Return(int64(0))
-		mockDatafile.On(
-			"Write",
-			internal.Entry{
-				Checksum: 0x0,
-				Key:      []byte("foo"),
-				Offset:   0,
-				Value:    []byte{},
-			},
-		).Return(int64(0), int64(0), ErrMockError)
-		db.curr = mockDatafile
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		found, err := db.HasE([]byte("foo"))
+		assert.NoError(err)
+		assert.True(found)
+		assert.True(db.Has([]byte("foo")))
 
-		err = db.Delete([]byte("foo"))
-		assert.Error(err)
+		assert.NoError(db.Close())
+		_, err = db.HasE([]byte("foo"))
+		assert.Equal(ErrDatabaseClosed, err)
 	})
 }
 
-func TestMergeErrors(t *testing.T) {
+type panicObserver struct {
+	NopObserver
+}
+
+func (panicObserver) DatafileRolled(oldID, newID int) { panic("rolled") }
+
+func TestPanicHandler(t *testing.T) {
 	assert := assert.New(t)
 
-	t.Run("RemoveDatabaseDirectory", func(t *testing.T) {
-		skipIfWindows(t)
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	var panics []interface{}
+	db, err := Open(
+		testdir,
+		WithMaxDatafileSize(64),
+		WithObserver(panicObserver{}),
+		WithSecondaryIndex("panic", func(key, value []byte) [][]byte {
+			if string(value) == "panic" {
+				panic("extract")
+			}
+			return [][]byte{value}
+		}),
+		WithPanicHandler(func(p interface{}) { panics = append(panics, p) }),
+	)
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("k%d", i)), []byte("bar")))
+	}
+	assert.NoError(db.Put([]byte("foo"), []byte("panic")))
+	assert.Contains(panics, "rolled")
+	assert.Contains(panics, "extract")
+
+	panics = nil
+	panicking := func(key []byte) error { panic("fold") }
+	assert.Equal(ErrCallbackPanicked, db.Fold(panicking))
+	assert.Equal(ErrCallbackPanicked, db.Scan(nil, panicking))
+	assert.Equal(ErrCallbackPanicked, db.ReverseScan(nil, panicking))
+	assert.Equal(ErrCallbackPanicked, db.FoldWithValue(func(key, value []byte) error { panic("fold") }))
+	assert.Equal(ErrCallbackPanicked, db.ForEachByFile(func(fileID int, key, value []byte) error { panic("fold") }))
+	assert.Equal([]interface{}{"fold", "fold", "fold", "fold", "fold"}, panics)
+
+	// The database is still usable
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
 
+	t.Run("NoHandler", func(t *testing.T) {
 		testdir, err := ioutil.TempDir("", "bitcask")
 		assert.NoError(err)
 		defer os.RemoveAll(testdir)
 
-		db, err := Open(testdir, WithMaxDatafileSize(32))
+		db, err := Open(testdir)
 		assert.NoError(err)
+		defer db.Close()
 
-		assert.NoError(os.RemoveAll(testdir))
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.PanicsWithValue("fold", func() {
+			db.FoldWithValue(func(key, value []byte) error { panic("fold") })
+		})
 
-		err = db.Merge()
-		assert.Error(err)
+		// A consumer of Keys() that stops receiving doesn't block writes
+		for range db.Keys() {
+			break
+		}
+		assert.NoError(db.Put([]byte("foo"), []byte("baz")))
+		assert.NoError(db.Merge())
 	})
+}
 
-	t.Run("EmptyCloseError", func(t *testing.T) {
+func TestPersist(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	now := time.Unix(1234567890, 0)
+	db, err := Open(testdir, WithClock(func() time.Time { return now }))
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.PutWithTTL([]byte("foo"), []byte("bar"), time.Minute))
+	assert.NoError(db.Persist([]byte("foo")))
+	assert.Equal(ErrKeyNotFound, db.Persist([]byte("missing")))
+
+	_, ok, err := db.TTL([]byte("foo"))
+	assert.NoError(err)
+	assert.False(ok)
+
+	now = now.Add(time.Hour)
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+}
+
+func TestPutTagged(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+
+	assert.NoError(db.PutTagged([]byte("json"), []byte(`{"a":1}`), 1))
+	assert.NoError(db.PutTagged([]byte("raw"), []byte("raw"), 2))
+	assert.NoError(db.Put([]byte("plain"), []byte("plain")))
+
+	val, tag, err := db.GetTagged([]byte("json"))
+	assert.NoError(err)
+	assert.Equal([]byte(`{"a":1}`), val)
+	assert.Equal(uint8(1), tag)
+
+	_, tag, err = db.GetTagged([]byte("plain"))
+	assert.NoError(err)
+	assert.Equal(uint8(0), tag)
+
+	_, _, err = db.GetTagged([]byte("missing"))
+	assert.Equal(ErrKeyNotFound, err)
+
+	// Tagged values are read like any other
+	val, err = db.Get([]byte("raw"))
+	assert.NoError(err)
+	assert.Equal([]byte("raw"), val)
+
+	// Overwriting clears the tag, appending and persisting keep it
+	assert.NoError(db.Put([]byte("raw"), []byte("raw")))
+	_, tag, err = db.GetTagged([]byte("raw"))
+	assert.NoError(err)
+	assert.Equal(uint8(0), tag)
+
+	assert.NoError(db.PutWithTTL([]byte("ttl"), []byte("a"), time.Hour))
+	assert.NoError(db.PutTagged([]byte("ttl"), []byte("a"), 3))
+	_, err = db.Append([]byte("json"), []byte(" "))
+	assert.NoError(err)
+	assert.NoError(db.Persist([]byte("json")))
+	_, tag, err = db.GetTagged([]byte("json"))
+	assert.NoError(err)
+	assert.Equal(uint8(1), tag)
+
+	// Tags survive merging and reopening
+	assert.NoError(db.Merge())
+	assert.NoError(db.Close())
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	val, tag, err = db.GetTagged([]byte("json"))
+	assert.NoError(err)
+	assert.Equal([]byte(`{"a":1} `), val)
+	assert.Equal(uint8(1), tag)
+	_, tag, err = db.GetTagged([]byte("ttl"))
+	assert.NoError(err)
+	assert.Equal(uint8(3), tag)
+
+	t.Run("DedupWrites", func(t *testing.T) {
 		testdir, err := ioutil.TempDir("", "bitcask")
 		assert.NoError(err)
 		defer os.RemoveAll(testdir)
 
-		db, err := Open(testdir)
+		db, err := Open(testdir, WithDedupWrites())
 		assert.NoError(err)
+		defer db.Close()
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Close").Return(ErrMockError)
-		db.curr = mockDatafile
+		// Only writes of the same value and tag are skipped
+		assert.NoError(db.PutTagged([]byte("foo"), []byte("bar"), 1))
+		assert.NoError(db.PutTagged([]byte("foo"), []byte("bar"), 2))
+		_, tag, err := db.GetTagged([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal(uint8(2), tag)
 
-		err = db.Merge()
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
+		n, err := db.PutN([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+		assert.NotZero(n)
+		n, err = db.PutN([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+		assert.Zero(n)
 	})
+}
 
-	t.Run("ReadError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+func TestMaxKeySize(t *testing.T) {
+	assert := assert.New(t)
 
-		db, err := Open(testdir)
-		assert.NoError(err)
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
 
-		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	var db *Bitcask
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("FileID").Return(0)
-		mockDatafile.On("ReadAt", int64(0), int64(22)).Return(
-			internal.Entry{},
-			ErrMockError,
-		)
-		db.curr = mockDatafile
+	t.Run("Open", func(t *testing.T) {
+		db, err = Open(testdir, WithMaxKeySize(16))
+		assert.NoError(err)
+	})
 
-		err = db.Merge()
+	t.Run("Put", func(t *testing.T) {
+		key := []byte(strings.Repeat(" ", 17))
+		value := []byte("foobar")
+		err = db.Put(key, value)
 		assert.Error(err)
-		assert.Equal(ErrMockError, err)
+		assert.Equal(ErrKeyTooLarge, err)
+	})
+}
+
+func TestMaxValueSize(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	var db *Bitcask
+
+	t.Run("Open", func(t *testing.T) {
+		db, err = Open(testdir, WithMaxValueSize(16))
+		assert.NoError(err)
 	})
 
+	t.Run("Put", func(t *testing.T) {
+		key := []byte("foo")
+		value := []byte(strings.Repeat(" ", 17))
+		err = db.Put(key, value)
+		assert.Error(err)
+		assert.Equal(ErrValueTooLarge, err)
+	})
 }
 
-func TestConcurrent(t *testing.T) {
+func TestStats(t *testing.T) {
 	var (
 		db  *Bitcask
 		err error
@@ -1083,56 +1485,26 @@ func TestConcurrent(t *testing.T) {
 		})
 
 		t.Run("Put", func(t *testing.T) {
-			err = db.Put([]byte("foo"), []byte("bar"))
+			err := db.Put([]byte("foo"), []byte("bar"))
 			assert.NoError(err)
 		})
-	})
-
-	t.Run("Concurrent", func(t *testing.T) {
-		t.Run("Put", func(t *testing.T) {
-			f := func(wg *sync.WaitGroup, x int) {
-				defer func() {
-					wg.Done()
-				}()
-				for i := 0; i <= 100; i++ {
-					if i%x == 0 {
-						key := []byte(fmt.Sprintf("k%d", i))
-						value := []byte(fmt.Sprintf("v%d", i))
-						err := db.Put(key, value)
-						assert.NoError(err)
-					}
-				}
-			}
-
-			wg := &sync.WaitGroup{}
-			wg.Add(3)
-
-			go f(wg, 2)
-			go f(wg, 3)
-			go f(wg, 5)
-
-			wg.Wait()
-		})
 
 		t.Run("Get", func(t *testing.T) {
-			f := func(wg *sync.WaitGroup, N int) {
-				defer func() {
-					wg.Done()
-				}()
-				for i := 0; i <= N; i++ {
-					value, err := db.Get([]byte("foo"))
-					assert.NoError(err)
-					assert.Equal([]byte("bar"), value)
-				}
-			}
+			val, err := db.Get([]byte("foo"))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+		})
 
-			wg := &sync.WaitGroup{}
-			wg.Add(3)
-			go f(wg, 100)
-			go f(wg, 100)
-			go f(wg, 100)
+		t.Run("Stats", func(t *testing.T) {
+			stats, err := db.Stats()
+			assert.NoError(err)
+			assert.Equal(stats.Datafiles, 0)
+			assert.Equal(stats.Keys, 1)
+		})
 
-			wg.Wait()
+		t.Run("Sync", func(t *testing.T) {
+			err = db.Sync()
+			assert.NoError(err)
 		})
 
 		t.Run("Close", func(t *testing.T) {
@@ -1142,13 +1514,95 @@ func TestConcurrent(t *testing.T) {
 	})
 }
 
-func TestScan(t *testing.T) {
+func TestDatafiles(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	var db *Bitcask
+	db, err := Open(testdir, WithMaxDatafileSize(32))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	}
+	assert.NoError(db.Put([]byte("hello"), []byte("world")))
+
+	infos, err := db.Datafiles()
+	assert.NoError(err)
+	assert.Equal([]DatafileInfo{
+		{ID: 0, Size: 44, Entries: 2},
+		{ID: 1, Size: 48, Entries: 2},
+	}, infos)
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+	assert.NoError(db.Delete([]byte("foo9")))
+
+	report, err := db.Check()
+	assert.NoError(err)
+	assert.True(report.OK())
+	assert.Equal(9, report.Keys)
+
+	item := func(key string) internal.Item {
+		value, found := db.trie.Search([]byte(key))
+		assert.True(found)
+		return value.(internal.Item)
+	}
+
+	// Point foo0 past the end of its datafile and foo1 at the entry of foo2
+	orphaned := item("foo0")
+	orphaned.Offset += 1 << 10
+	db.trie.Insert([]byte("foo0"), orphaned)
+	db.trie.Insert([]byte("foo1"), item("foo2"))
+
+	// Leave foo3 out of the index
+	db.trie.Delete([]byte("foo3"))
+
+	report, err = db.Check()
+	assert.NoError(err)
+	assert.False(report.OK())
+	assert.Equal(8, report.Keys)
+
+	assert.Len(report.Orphaned, 1)
+	assert.Equal([]byte("foo0"), report.Orphaned[0].Key)
+
+	assert.Len(report.Corrupt, 1)
+	assert.Equal([]byte("foo1"), report.Corrupt[0].Key)
+
+	// foo0, foo1 and foo3 don't point to their latest entries
+	var unindexed []string
+	for _, problem := range report.Unindexed {
+		unindexed = append(unindexed, string(problem.Key))
+	}
+	assert.Equal([]string{"foo0", "foo1", "foo3"}, unindexed)
+}
+
+func TestStatsError(t *testing.T) {
+	var (
+		db  *Bitcask
+		err error
+	)
+
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
 
 	t.Run("Setup", func(t *testing.T) {
 		t.Run("Open", func(t *testing.T) {
@@ -1157,238 +1611,3991 @@ func TestScan(t *testing.T) {
 		})
 
 		t.Run("Put", func(t *testing.T) {
-			var items = map[string][]byte{
-				"1":     []byte("1"),
-				"2":     []byte("2"),
-				"3":     []byte("3"),
-				"food":  []byte("pizza"),
-				"foo":   []byte([]byte("foo")),
-				"fooz":  []byte("fooz ball"),
-				"hello": []byte("world"),
-			}
-			for k, v := range items {
-				err = db.Put([]byte(k), v)
-				assert.NoError(err)
-			}
+			err := db.Put([]byte("foo"), []byte("bar"))
+			assert.NoError(err)
 		})
-	})
 
-	t.Run("Scan", func(t *testing.T) {
-		var (
-			vals     [][]byte
-			expected = [][]byte{
-				[]byte("foo"),
-				[]byte("fooz ball"),
-				[]byte("pizza"),
-			}
-		)
+		t.Run("Get", func(t *testing.T) {
+			val, err := db.Get([]byte("foo"))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+		})
 
-		err = db.Scan([]byte("fo"), func(key []byte) error {
-			val, err := db.Get(key)
+		t.Run("Stats", func(t *testing.T) {
+			stats, err := db.Stats()
 			assert.NoError(err)
-			vals = append(vals, val)
-			return nil
+			assert.Equal(stats.Datafiles, 0)
+			assert.Equal(stats.Keys, 1)
 		})
-		vals = SortByteArrays(vals)
-		assert.Equal(expected, vals)
 	})
 
-	t.Run("ScanErrors", func(t *testing.T) {
-		err = db.Scan([]byte("fo"), func(key []byte) error {
-			return ErrMockError
+	t.Run("Test", func(t *testing.T) {
+		skipIfWindows(t)
+
+		t.Run("FabricatedDestruction", func(t *testing.T) {
+			// This would never happen in reality :D
+			// Or would it? :)
+			err = os.RemoveAll(testdir)
+			assert.NoError(err)
+		})
+
+		t.Run("Stats", func(t *testing.T) {
+			_, err := db.Stats()
+			assert.Error(err)
 		})
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
 	})
 }
 
-func TestLocking(t *testing.T) {
+func TestMaxDatafileSize(t *testing.T) {
+	var (
+		db  *Bitcask
+		err error
+	)
+
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	db, err := Open(testdir)
-	assert.NoError(err)
-	defer db.Close()
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Open", func(t *testing.T) {
+			db, err = Open(testdir, WithMaxDatafileSize(32))
+			assert.NoError(err)
+		})
 
-	_, err = Open(testdir)
-	assert.Error(err)
-	assert.Equal(ErrDatabaseLocked, err)
-}
+		t.Run("Put", func(t *testing.T) {
+			err := db.Put([]byte("foo"), []byte("bar"))
+			assert.NoError(err)
+		})
+	})
 
-type benchmarkTestCase struct {
-	name string
-	size int
-}
+	t.Run("Put", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			err := db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("bar"))
+			assert.NoError(err)
+		}
+	})
 
-func BenchmarkGet(b *testing.B) {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		b.Fatal(err)
-	}
+	t.Run("Sync", func(t *testing.T) {
+		err = db.Sync()
+		assert.NoError(err)
+	})
 
-	testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
-	if err != nil {
-		b.Fatal(err)
-	}
-	defer os.RemoveAll(testdir)
+	t.Run("Get", func(t *testing.T) {
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
 
-	tests := []benchmarkTestCase{
-		{"128B", 128},
-		{"256B", 256},
-		{"512B", 512},
-		{"1K", 1024},
-		{"2K", 2048},
-		{"4K", 4096},
-		{"8K", 8192},
-		{"16K", 16384},
-		{"32K", 32768},
-	}
+		for i := 0; i < 10; i++ {
+			val, err = db.Get([]byte(fmt.Sprintf("key_%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+		}
+	})
 
-	for _, tt := range tests {
-		b.Run(tt.name, func(b *testing.B) {
-			b.SetBytes(int64(tt.size))
+	t.Run("Close", func(t *testing.T) {
+		err = db.Close()
+		assert.NoError(err)
+	})
+}
 
-			key := []byte("foo")
-			value := []byte(strings.Repeat(" ", tt.size))
+func TestMerge(t *testing.T) {
+	var (
+		db  *Bitcask
+		err error
+	)
 
-			options := []Option{
-				WithMaxKeySize(uint32(len(key))),
-				WithMaxValueSize(uint64(tt.size)),
-			}
-			db, err := Open(testdir, options...)
-			if err != nil {
-				b.Fatal(err)
-			}
+	assert := assert.New(t)
 
-			err = db.Put(key, value)
-			if err != nil {
-				b.Fatal(err)
-			}
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
 
-			b.ResetTimer()
-			for i := 0; i < b.N; i++ {
-				val, err := db.Get(key)
-				if err != nil {
-					b.Fatal(err)
-				}
-				if !bytes.Equal(val, value) {
-					b.Errorf("unexpected value")
-				}
-			}
-			b.StopTimer()
-			db.Close()
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Open", func(t *testing.T) {
+			db, err = Open(testdir, WithMaxDatafileSize(32))
+			assert.NoError(err)
 		})
-	}
+
+		t.Run("Put", func(t *testing.T) {
+			err := db.Put([]byte("foo"), []byte("bar"))
+			assert.NoError(err)
+		})
+
+		s1, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(0, s1.Datafiles)
+		assert.Equal(1, s1.Keys)
+
+		t.Run("Put", func(t *testing.T) {
+			for i := 0; i < 10; i++ {
+				err := db.Put([]byte("foo"), []byte("bar"))
+				assert.NoError(err)
+			}
+		})
+
+		s2, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(5, s2.Datafiles)
+		assert.Equal(1, s2.Keys)
+		assert.True(s2.Size > s1.Size)
+
+		t.Run("Merge", func(t *testing.T) {
+			err := db.Merge()
+			assert.NoError(err)
+		})
+
+		s3, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(1, s3.Datafiles)
+		assert.Equal(1, s3.Keys)
+		assert.True(s3.Size > s1.Size)
+		assert.True(s3.Size < s2.Size)
+
+		t.Run("Sync", func(t *testing.T) {
+			err = db.Sync()
+			assert.NoError(err)
+		})
+
+		t.Run("Close", func(t *testing.T) {
+			err = db.Close()
+			assert.NoError(err)
+		})
+	})
 }
 
-func BenchmarkPut(b *testing.B) {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		b.Fatal(err)
-	}
+func TestMergeKeepVersions(t *testing.T) {
+	assert := assert.New(t)
 
-	tests := []benchmarkTestCase{
-		{"128B", 128},
-		{"256B", 256},
-		{"1K", 1024},
-		{"2K", 2048},
-		{"4K", 4096},
-		{"8K", 8192},
-		{"16K", 16384},
-		{"32K", 32768},
-	}
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	variants := map[string][]Option{
-		"NoSync": {
-			WithSync(false),
-		},
-		"Sync": {
-			WithSync(true),
-		},
+	db, err := Open(testdir, WithMaxDatafileSize(64), WithMergeKeepVersions(3), WithInitialCapacity(16))
+	assert.NoError(err)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(db.Put([]byte("foo"), []byte(fmt.Sprintf("v%d", i))))
 	}
+	assert.NoError(db.Put([]byte("bar"), []byte("v0")))
+	assert.NoError(db.Put([]byte("baz"), []byte("v0")))
+	assert.NoError(db.Delete([]byte("baz")))
 
-	for name, options := range variants {
-		testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
-		if err != nil {
-			b.Fatal(err)
-		}
-		defer os.RemoveAll(testdir)
+	assert.NoError(db.Merge())
 
-		db, err := Open(testdir, options...)
-		if err != nil {
-			b.Fatal(err)
-		}
-		defer db.Close()
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("v4"), val)
 
-		for _, tt := range tests {
-			b.Run(tt.name+name, func(b *testing.B) {
-				b.SetBytes(int64(tt.size))
+	_, err = db.Get([]byte("baz"))
+	assert.Equal(ErrKeyNotFound, err)
 
-				key := []byte("foo")
-				value := []byte(strings.Repeat(" ", tt.size))
-				b.ResetTimer()
-				for i := 0; i < b.N; i++ {
-					err := db.Put(key, value)
-					if err != nil {
-						b.Fatal(err)
-					}
-				}
-			})
+	versions := make(map[string][]string)
+	for id := range db.datafiles {
+		df, err := data.NewDatafile(fs.OS, testdir, id, true, DefaultMaxKeySize, DefaultMaxValueSize, true, DefaultDatafileExtension, false, 0, 0, false)
+		assert.NoError(err)
+		for {
+			e, _, err := df.Read()
+			if err != nil {
+				assert.Equal(io.EOF, err)
+				break
+			}
+			versions[string(e.Key)] = append(versions[string(e.Key)], string(e.Value))
 		}
+		assert.NoError(df.Close())
 	}
+	assert.Equal(map[string][]string{
+		"foo": {"v2", "v3", "v4"},
+		"bar": {"v0"},
+	}, versions)
+
+	assert.NoError(db.Close())
 }
 
-func BenchmarkScan(b *testing.B) {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		b.Fatal(err)
+func TestClear(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(32))
+	assert.NoError(err)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
 	}
+	assert.NoError(db.Clear())
+	assert.Equal(0, db.Len())
+	assert.True(db.Flock.Locked())
 
-	testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
-	if err != nil {
-		b.Fatal(err)
+	datafiles, err := db.Datafiles()
+	assert.NoError(err)
+	assert.Equal([]DatafileInfo{{ID: 0}}, datafiles)
+
+	assert.NoError(db.Put([]byte("hello"), []byte("world")))
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+	assert.Equal(1, db.Len())
+	val, err := db.Get([]byte("hello"))
+	assert.NoError(err)
+	assert.Equal([]byte("world"), val)
+}
+
+func TestRecoveredFromIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	recovered := func(db *Bitcask) bool {
+		stats, err := db.Stats()
+		assert.NoError(err)
+		return stats.RecoveredFromIndex
 	}
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.False(recovered(db))
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	assert.True(recovered(db))
+	assert.NoError(db.Close())
+
+	assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+	assert.False(recovered(db))
+	assert.True(db.Has([]byte("foo")))
+}
+
+func TestDataSize(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
 	defer os.RemoveAll(testdir)
 
 	db, err := Open(testdir)
-	if err != nil {
-		b.Fatal(err)
-	}
+	assert.NoError(err)
 	defer db.Close()
 
-	var items = map[string][]byte{
-		"1":     []byte("1"),
-		"2":     []byte("2"),
-		"3":     []byte("3"),
-		"food":  []byte("pizza"),
-		"foo":   []byte([]byte("foo")),
-		"fooz":  []byte("fooz ball"),
-		"hello": []byte("world"),
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("hello"), []byte("world")))
+
+	size, err := db.DataSize()
+	assert.NoError(err)
+	assert.Equal(int64(48), size)
+
+	stats, err := db.Stats()
+	assert.NoError(err)
+	assert.True(stats.Size > size)
+}
+
+func TestMergeDatabases(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	sources := []string{filepath.Join(testdir, "a"), filepath.Join(testdir, "b")}
+	for i, source := range sources {
+		db, err := Open(source)
+		assert.NoError(err)
+		assert.NoError(db.Put([]byte("foo"), []byte(fmt.Sprintf("bar%d", i))))
+		assert.NoError(db.PutTagged([]byte(fmt.Sprintf("key%d", i)), []byte("value"), uint8(i+1)))
+		assert.NoError(db.Close())
 	}
-	for k, v := range items {
-		err := db.Put([]byte(k), v)
-		if err != nil {
-			b.Fatal(err)
+
+	// The sources are left untouched
+	snapshot := func() map[string][]byte {
+		files := make(map[string][]byte)
+		for _, source := range sources {
+			infos, err := ioutil.ReadDir(source)
+			assert.NoError(err)
+			for _, info := range infos {
+				fn := filepath.Join(source, info.Name())
+				files[fn], err = ioutil.ReadFile(fn)
+				assert.NoError(err)
+			}
 		}
+		return files
 	}
+	before := snapshot()
+	defer func() { assert.Equal(before, snapshot()) }()
 
-	var expected = [][]byte{[]byte("foo"), []byte("food"), []byte("fooz")}
+	t.Run("LastWins", func(t *testing.T) {
+		dest := filepath.Join(testdir, "dest")
+		assert.NoError(MergeDatabases(dest, sources...))
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		var keys [][]byte
-		err = db.Scan([]byte("fo"), func(key []byte) error {
-			keys = append(keys, key)
-			return nil
-		})
-		if err != nil {
-			b.Fatal(err)
+		db, err := Open(dest)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Equal(3, db.Len())
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar1"), val)
+
+		// Tags are carried over
+		_, tag, err := db.GetTagged([]byte("key1"))
+		assert.NoError(err)
+		assert.Equal(uint8(2), tag)
+	})
+
+	t.Run("Resolve", func(t *testing.T) {
+		dest := filepath.Join(testdir, "resolved")
+		firstWins := func(key, current, incoming []byte) ([]byte, error) {
+			return current, nil
 		}
-		keys = SortByteArrays(keys)
-		if !reflect.DeepEqual(expected, keys) {
-			b.Fatal(fmt.Errorf("expected keys=#%v got=%#v", expected, keys))
+		assert.NoError(MergeDatabasesWith(dest, firstWins, sources...))
+
+		db, err := Open(dest)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Equal(3, db.Len())
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar0"), val)
+	})
+
+	t.Run("SourceLocked", func(t *testing.T) {
+		db, err := Open(sources[1])
+		assert.NoError(err)
+		defer db.Close()
+
+		err = MergeDatabases(filepath.Join(testdir, "locked"), sources...)
+		assert.True(errors.Is(err, ErrDatabaseLocked))
+	})
+}
+
+func TestInspect(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithoutConfigFile())
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("foo"), []byte("baz")))
+	assert.NoError(db.Close())
+
+	snapshot := func() map[string][]byte {
+		files := make(map[string][]byte)
+		infos, err := ioutil.ReadDir(testdir)
+		assert.NoError(err)
+		for _, info := range infos {
+			fn := filepath.Join(testdir, info.Name())
+			files[fn], err = ioutil.ReadFile(fn)
+			assert.NoError(err)
 		}
+		return files
 	}
+	before := snapshot()
+
+	stats, datafiles, err := Inspect(testdir)
+	assert.NoError(err)
+	assert.Equal(1, stats.Keys)
+	assert.Equal(1, stats.Datafiles)
+	assert.Equal(int64(22), stats.DeadBytes)
+	assert.True(stats.RecoveredFromIndex)
+	assert.Equal([]DatafileInfo{{ID: 0, Size: 44, Entries: 2}}, datafiles)
+
+	// The database is left untouched
+	assert.Equal(before, snapshot())
+
+	// Only while no other process has it open
+	db, err = Open(testdir, WithoutConfigFile())
+	assert.NoError(err)
+	defer db.Close()
+	_, _, err = Inspect(testdir)
+	assert.True(errors.Is(err, ErrDatabaseLocked))
+}
+
+func TestSizeHistogram(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.Equal(SizeHistogram{}, db.SizeHistogram())
+
+	assert.NoError(db.Put([]byte("a"), []byte("x")))
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.PutWithTTL([]byte("hello"), []byte("world!!!"), time.Hour))
+
+	assert.Equal(SizeHistogram{
+		Keys:   []int{0, 1, 1, 1},
+		Values: []int{0, 1, 1, 0, 1},
+	}, db.SizeHistogram())
+
+	t.Run("Headers", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithEntryAlignment(8), WithLargeValueThreshold(64))
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.NoError(db.Put([]byte("a"), []byte("x")))
+		assert.NoError(db.PutTagged([]byte("foo"), []byte("bar"), 1))
+		assert.NoError(db.Put([]byte("large"), bytes.Repeat([]byte("x"), 100)))
+
+		assert.Equal(SizeHistogram{
+			Keys:   []int{0, 1, 1, 1},
+			Values: []int{0, 1, 1, 0, 0, 0, 0, 1},
+		}, db.SizeHistogram())
+	})
+}
+
+func TestMergeTrigger(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	var triggered int32
+	trigger := func(stats Stats) bool {
+		if stats.Datafiles >= 5 {
+			atomic.AddInt32(&triggered, 1)
+			return true
+		}
+		return false
+	}
+
+	db, err := Open(testdir, WithMaxDatafileSize(32), WithMergeTrigger(trigger))
+	assert.NoError(err)
+	defer db.Close()
+
+	for atomic.LoadInt32(&triggered) == 0 {
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	}
+
+	var stats Stats
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		// Stats() may fail while the merge is moving files around
+		if stats, err = db.Stats(); err == nil && stats.Datafiles == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(1, stats.Datafiles)
+	assert.Equal(1, stats.Keys)
+
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+}
+
+func TestDeadBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64), WithDatafileMagic())
+	assert.NoError(err)
+
+	deadBytes := func() int64 {
+		stats, err := db.Stats()
+		assert.NoError(err)
+		return stats.DeadBytes
+	}
+
+	// Each entry of a three byte key and value is 22 bytes
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("baz"), []byte("bar")))
+	assert.Equal(int64(0), deadBytes())
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	}
+	assert.Equal(int64(4*22), deadBytes())
+
+	// The deletion marker is dead too
+	assert.NoError(db.Delete([]byte("foo")))
+	assert.Equal(int64(5*22+19), deadBytes())
+
+	assert.NoError(db.Close())
+	db, err = Open(testdir, WithMaxDatafileSize(64), WithDatafileMagic())
+	assert.NoError(err)
+	defer db.Close()
+	assert.Equal(int64(5*22+19), deadBytes())
+
+	assert.NoError(db.Merge())
+	assert.Equal(int64(0), deadBytes())
+}
+
+func TestAutoMergeRatio(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	observer := &recordingObserver{}
+	db, err := Open(testdir, WithAutoMergeRatio(0.5), WithObserver(observer))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+
+	// 10 overwrites leave 10 of 20 entries dead, which isn't above the ratio
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte("foo0"), []byte("bar")))
+	}
+	stats, err := db.Stats()
+	assert.NoError(err)
+	assert.Equal(int64(10*23), stats.DeadBytes)
+	assert.Equal(int32(0), atomic.LoadInt32(&db.merging))
+	assert.Empty(observer.events)
+
+	// One more crosses it
+	assert.NoError(db.Put([]byte("foo0"), []byte("bar")))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats, err = db.Stats(); err == nil && stats.DeadBytes == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(int64(0), stats.DeadBytes)
+	assert.Equal(10, stats.Keys)
+}
+
+func TestMergeOnClose(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Merges", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithBackgroundMergeOnClose())
+		assert.NoError(err)
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		}
+		assert.NoError(db.Close())
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		stats, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(int64(0), stats.DeadBytes)
+		assert.Equal(1, stats.Keys)
+
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
+
+	t.Run("MergeFails", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithBackgroundMergeOnClose())
+		assert.NoError(err)
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+		db.writeErr = errDiskFull
+		err = db.Close()
+		assert.True(errors.Is(err, ErrReadOnly))
+
+		// The database was closed regardless
+		db, err = Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
+}
+
+func TestMaxDatafiles(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64), WithMaxDatafiles(2))
+	assert.NoError(err)
+	defer db.Close()
+
+	// Every third write of 22 bytes fills the current datafile
+	for i := 0; i < 100; i++ {
+		assert.NoError(db.Put([]byte("foo"), []byte(fmt.Sprintf("%03d", i))))
+
+		infos, err := db.Datafiles()
+		assert.NoError(err)
+		assert.LessOrEqual(len(infos), 2)
+	}
+
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("099"), val)
+
+	// Live data needing more datafiles than the cap still rolls over
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("k%02d", i)), []byte("bar")))
+	}
+	infos, err := db.Datafiles()
+	assert.NoError(err)
+	assert.Greater(len(infos), 2)
+	assert.Equal(11, db.Len())
+}
+
+func TestDatafileFooters(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64), WithDatafileFooters())
+	assert.NoError(err)
+
+	// Every third write of 22 bytes fills the current datafile
+	for i := 0; i < 7; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("k%02d", i)), []byte("bar")))
+	}
+	sealed := db.datafiles[db.curr.FileID()-1].Name()
+	last := db.curr.Name()
+	assert.NoError(db.Close())
+
+	ok, err := data.VerifyFooter(fs.OS, sealed)
+	assert.NoError(err)
+	assert.True(ok)
+	ok, err = data.VerifyFooter(fs.OS, last)
+	assert.NoError(err)
+	assert.False(ok)
+
+	db, err = Open(testdir, WithMaxDatafileSize(64), WithDatafileFooters(), WithVerifyDatafileFooters())
+	assert.NoError(err)
+	for i := 0; i < 7; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("k%02d", i)))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	}
+	assert.NoError(db.Close())
+
+	// A sealed datafile is found to have been modified
+	b, err := ioutil.ReadFile(sealed)
+	assert.NoError(err)
+	b[len(b)-codec.FooterSize-1] ^= 0xff
+	assert.NoError(ioutil.WriteFile(sealed, b, 0640))
+
+	_, err = Open(testdir, WithVerifyDatafileFooters())
+	assert.True(errors.Is(err, ErrFooterMismatch))
+
+	b[len(b)-codec.FooterSize-1] ^= 0xff
+	assert.NoError(ioutil.WriteFile(sealed, b, 0640))
+
+	// The footer of the last datafile is removed to keep writing to it
+	assert.NoError(os.Remove(last))
+	db, err = Open(testdir, WithMaxDatafileSize(128))
+	assert.NoError(err)
+	defer db.Close()
+	assert.Equal(sealed, db.curr.Name())
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	ok, err = data.VerifyFooter(fs.OS, sealed)
+	assert.NoError(err)
+	assert.False(ok)
+	val, err := db.Get([]byte("k00"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+
+	t.Run("DeadBytes", func(t *testing.T) {
+		for _, options := range [][]Option{
+			{WithMaxDatafileSize(64), WithDatafileFooters()},
+			{WithMaxDatafileSize(64), WithDatafileFooters(), WithMaxOpenDatafiles(1)},
+		} {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(err)
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir, options...)
+			assert.NoError(err)
+			for i := 0; i < 7; i++ {
+				assert.NoError(db.Put([]byte(fmt.Sprintf("k%02d", i)), []byte("bar")))
+			}
+			assert.Equal(int64(3*22), db.datafiles[0].Size())
+
+			// Footers aren't space a merge would reclaim
+			stats, err := db.Stats()
+			assert.NoError(err)
+			assert.Equal(int64(0), stats.DeadBytes)
+			assert.NoError(db.Close())
+		}
+	})
+
+	t.Run("LookalikeValue", func(t *testing.T) {
+		// The entry ends with the footer marker followed by its checksum
+		value := append([]byte("bar"), codec.EncodeFooter(0)[:codec.FooterSize-4]...)
+
+		for _, options := range [][]Option{
+			{WithMaxDatafileSize(32)},
+			{WithMaxDatafileSize(32), WithMaxOpenDatafiles(1)},
+		} {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(err)
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir, options...)
+			assert.NoError(err)
+			assert.NoError(db.Put([]byte("foo"), value))
+			assert.NoError(db.Put([]byte("bar"), []byte("baz")))
+			assert.NoError(db.Close())
+
+			db, err = Open(testdir, options...)
+			assert.NoError(err)
+			size := codec.Overhead(false, false) + int64(3+len(value))
+			assert.Equal(size, db.datafiles[0].Size())
+
+			stats, err := db.Stats()
+			assert.NoError(err)
+			assert.Equal(int64(0), stats.DeadBytes)
+			infos, err := db.Datafiles()
+			assert.NoError(err)
+			assert.Equal(1, infos[0].Entries)
+			val, err := db.Get([]byte("foo"))
+			assert.NoError(err)
+			assert.Equal(value, val)
+			assert.NoError(db.Close())
+		}
+	})
+}
+
+// corruptMergeFS is a FS whose datafiles written by Merge() have the checksum
+// of every entry corrupted while `corrupt` is set
+type corruptMergeFS struct {
+	fs.FS
+	corrupt *bool
+}
+
+type corruptFile struct {
+	fs.File
+}
+
+func (f corruptMergeFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil || !*f.corrupt || !strings.Contains(name, "/merge") || !strings.HasSuffix(name, DefaultDatafileExtension) {
+		return file, err
+	}
+	return corruptFile{File: file}, nil
+}
+
+func (f corruptFile) Write(p []byte) (int, error) {
+	b := append([]byte(nil), p...)
+	b[len(b)-1] ^= 0xff
+	return f.File.Write(b)
+}
+
+func TestForEachByFile(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	now := time.Unix(1234567890, 0)
+	db, err := Open(testdir, WithMaxDatafileSize(64), WithClock(func() time.Time { return now }))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	assert.NoError(db.Put([]byte("k0"), []byte("new")))
+	assert.NoError(db.Delete([]byte("k1")))
+	assert.NoError(db.PutWithTTL([]byte("k2"), []byte("ttl"), time.Minute))
+	now = now.Add(time.Hour)
+
+	var (
+		ids  []int
+		keys []string
+	)
+	assert.NoError(db.ForEachByFile(func(fileID int, key, value []byte) error {
+		expected, err := db.Get(key)
+		assert.NoError(err)
+		assert.Equal(expected, value)
+		ids = append(ids, fileID)
+		keys = append(keys, string(key))
+		return nil
+	}))
+	assert.True(sort.IntsAreSorted(ids))
+	assert.Greater(ids[len(ids)-1], ids[0])
+	assert.Equal([]string{"k3", "k4", "k5", "k6", "k7", "k8", "k9", "k0"}, keys)
+
+	// The error of the function stops the iteration
+	var n int
+	err = db.ForEachByFile(func(fileID int, key, value []byte) error {
+		n++
+		return ErrMockError
+	})
+	assert.Equal(ErrMockError, err)
+	assert.Equal(1, n)
+}
+
+func TestMergeVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	var corrupt bool
+	db, err := Open("bitcask", WithFileSystem(corruptMergeFS{FS: fs.NewMemFS(), corrupt: &corrupt}), WithMergeVerify())
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte("foo"), []byte(fmt.Sprintf("%03d", i))))
+	}
+	assert.NoError(db.Put([]byte("bar"), []byte("baz")))
+
+	// A corrupt merged database leaves the original datafiles in place
+	corrupt = true
+	err = db.Merge()
+	assert.True(errors.Is(err, ErrMergeVerifyFailed))
+	corrupt = false
+
+	stats, err := db.Stats()
+	assert.NoError(err)
+	assert.Equal(int64(9*22), stats.DeadBytes)
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("009"), val)
+
+	assert.NoError(db.Merge())
+	stats, err = db.Stats()
+	assert.NoError(err)
+	assert.Equal(int64(0), stats.DeadBytes)
+	val, err = db.Get([]byte("bar"))
+	assert.NoError(err)
+	assert.Equal([]byte("baz"), val)
+}
+
+func TestMergeVerifyKeyCount(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	now := time.Unix(1234567890, 0)
+	db, err := Open(testdir, WithMergeVerifyKeyCount(), WithClock(func() time.Time { return now }))
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("bar"), []byte("baz")))
+	assert.NoError(db.Delete([]byte("bar")))
+	assert.NoError(db.PutWithTTL([]byte("ttl"), []byte("baz"), time.Minute))
+	now = now.Add(time.Hour)
+
+	// Deleted and expired keys are accounted for
+	assert.NoError(db.Merge())
+	assert.Equal(1, db.Len())
+
+	// An empty value would be lost by replaying the merged datafiles
+	assert.NoError(db.Put([]byte("empty"), nil))
+	err = db.Merge()
+	assert.True(errors.Is(err, ErrMergeVerifyFailed))
+	assert.True(db.Has([]byte("empty")))
+
+	assert.NoError(db.Delete([]byte("empty")))
+	assert.NoError(db.MergeFilesBefore(db.curr.FileID()))
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+}
+func TestMergeTargetFileSize(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(32), WithMergeTargetFileSize(1<<20))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+
+	stats, err := db.Stats()
+	assert.NoError(err)
+	assert.Equal(4, stats.Datafiles)
+
+	assert.NoError(db.Merge())
+
+	stats, err = db.Stats()
+	assert.NoError(err)
+	assert.Equal(1, stats.Datafiles)
+	assert.Equal(10, stats.Keys)
+
+	cfg, err := config.Load(fs.OS, filepath.Join(testdir, "config.json"))
+	assert.NoError(err)
+	assert.Equal(32, cfg.MaxDatafileSize)
+}
+
+func TestMergeConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	merge := func(options ...Option) []byte {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, options...)
+		assert.NoError(err)
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("foo%d", i%50))
+			assert.NoError(db.Put(key, []byte(fmt.Sprintf("bar%d", i))))
+		}
+		assert.NoError(db.Merge())
+		assert.Equal(50, db.Len())
+
+		val, err := db.Get([]byte("foo7"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar57"), val)
+
+		data, err := ioutil.ReadFile(filepath.Join(testdir, "000000000.data"))
+		assert.NoError(err)
+		return data
+	}
+
+	// The merged datafile is the same as that of a sequential merge
+	assert.Equal(merge(), merge(WithMergeConcurrency(4)))
+
+	t.Run("ChecksumError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMergeConcurrency(4))
+		assert.NoError(err)
+		defer db.Close()
+
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+		}
+
+		// Corrupt the value of the first entry on disk
+		f, err := os.OpenFile(filepath.Join(testdir, "000000000.data"), os.O_WRONLY, 0640)
+		assert.NoError(err)
+		_, err = f.WriteAt([]byte("X"), 4+8+4)
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		assert.Equal(ErrChecksumFailed, db.Merge())
+
+		val, err := db.Get([]byte("foo9"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
+}
+
+type recordingObserver struct {
+	NopObserver
+	events []string
+}
+
+func (o *recordingObserver) DatafileRolled(oldID, newID int) {
+	o.events = append(o.events, fmt.Sprintf("rolled %d %d", oldID, newID))
+}
+
+func (o *recordingObserver) MergeFinished(before, after int, reclaimed int64) {
+	o.events = append(o.events, fmt.Sprintf("merged %d %d %t", before, after, reclaimed > 0))
+}
+
+func (o *recordingObserver) IndexWritten(keys int) {
+	o.events = append(o.events, fmt.Sprintf("index %d", keys))
+}
+
+func TestObserver(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	observer := &recordingObserver{}
+	db, err := Open(testdir, WithMaxDatafileSize(32), WithObserver(observer))
+	assert.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	}
+	assert.NoError(db.Merge())
+	assert.NoError(db.Close())
+
+	assert.Equal([]string{
+		"rolled 0 1",
+		"merged 2 1 true",
+		"index 1",
+	}, observer.events)
+}
+
+// chrootFS is a FS rooted at a directory of the file system of the
+// operating system
+type chrootFS struct {
+	root string
+}
+
+type chrootFile struct {
+	fs.File
+	name string
+}
+
+func (f chrootFile) Name() string {
+	return f.name
+}
+
+func (c chrootFS) path(name string) string {
+	return filepath.Join(c.root, name)
+}
+
+func (c chrootFS) Open(name string) (fs.File, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (c chrootFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	f, err := fs.OS.OpenFile(c.path(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return chrootFile{File: f, name: name}, nil
+}
+
+func (c chrootFS) Stat(name string) (os.FileInfo, error) {
+	return fs.OS.Stat(c.path(name))
+}
+
+func (c chrootFS) Remove(name string) error {
+	return fs.OS.Remove(c.path(name))
+}
+
+func (c chrootFS) Rename(oldpath, newpath string) error {
+	return fs.OS.Rename(c.path(oldpath), c.path(newpath))
+}
+
+func (c chrootFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return fs.OS.ReadDir(c.path(dirname))
+}
+
+func (c chrootFS) MkdirAll(path string, perm os.FileMode) error {
+	return fs.OS.MkdirAll(c.path(path), perm)
+}
+
+func TestFileSystem(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	// All files are accessed through the file system so the database path
+	// only exists within it
+	path := fmt.Sprintf("bitcask-%d", time.Now().UnixNano())
+	fsys := WithFileSystem(chrootFS{root: testdir})
+
+	db, err := Open(path, fsys, WithMaxDatafileSize(32))
+	assert.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+	assert.NoError(db.Delete([]byte("foo0")))
+	assert.NoError(db.Merge())
+
+	stats, err := db.Stats()
+	assert.NoError(err)
+	assert.Equal(9, stats.Keys)
+	assert.True(stats.Size > 0)
+	assert.NoError(db.Close())
+
+	db, err = Open(path, fsys)
+	assert.NoError(err)
+	defer db.Close()
+
+	val, err := db.Get([]byte("foo9"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+	assert.False(db.Has([]byte("foo0")))
+
+	assert.False(fs.Exists(fs.OS, path))
+	assert.True(fs.Exists(fs.OS, filepath.Join(testdir, path, "config.json")))
+	assert.True(fs.Exists(fs.OS, filepath.Join(testdir, path, "000000000.data")))
+}
+
+func TestOpenInMemory(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := OpenInMemory(WithMaxDatafileSize(32))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+	assert.NoError(db.Delete([]byte("foo0")))
+	assert.NoError(db.Sync())
+
+	stats, err := db.Stats()
+	assert.NoError(err)
+	assert.Equal(5, stats.Datafiles)
+
+	assert.NoError(db.Merge())
+	assert.NoError(db.Reopen())
+
+	val, err := db.Get([]byte("foo9"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+	assert.False(db.Has([]byte("foo0")))
+
+	var keys [][]byte
+	assert.NoError(db.Scan([]byte("foo"), func(key []byte) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(9, len(keys))
+
+	// Nothing is written to disk
+	assert.False(fs.Exists(fs.OS, "bitcask"))
+
+	// Every database is separate
+	other, err := OpenInMemory()
+	assert.NoError(err)
+	defer other.Close()
+	assert.Equal(0, other.Len())
+}
+
+func TestConcurrentGetRollover(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		// Every few writes rolls over the current datafile
+		for i := 0; i < 500; i++ {
+			assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			val, err := db.Get([]byte("foo"))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			_, err := db.Stats()
+			assert.NoError(err)
+			assert.NoError(db.Sync())
+		}
+	}()
+	wg.Wait()
+}
+
+func TestConcurrentMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(32))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+
+	t.Run("InProgress", func(t *testing.T) {
+		atomic.StoreInt32(&db.merging, 1)
+		assert.Equal(ErrMergeInProgress, db.Merge())
+		atomic.StoreInt32(&db.merging, 0)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		errs := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			go func() { errs <- db.Merge() }()
+		}
+
+		var merged int
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				assert.Equal(ErrMergeInProgress, err)
+			} else {
+				merged++
+			}
+		}
+		assert.True(merged > 0)
+
+		assert.Equal(100, db.Len())
+		for i := 0; i < 100; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("foo%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+		}
+	})
+}
+
+func TestMergeRecovery(t *testing.T) {
+	assert := assert.New(t)
+
+	setup := func() string {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+		for i := 0; i < 5; i++ {
+			assert.NoError(db.Put([]byte("foo"), []byte(fmt.Sprintf("old%d", i))))
+		}
+		assert.NoError(db.Close())
+
+		return testdir
+	}
+
+	t.Run("Rollback", func(t *testing.T) {
+		testdir := setup()
+		defer os.RemoveAll(testdir)
+
+		temp, err := ioutil.TempDir(testdir, "merge")
+		assert.NoError(err)
+		assert.NoError(ioutil.WriteFile(filepath.Join(temp, "000000000.data"), []byte("garbage"), 0600))
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.False(fs.Exists(fs.OS, temp))
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("old4"), val)
+	})
+
+	t.Run("Complete", func(t *testing.T) {
+		testdir := setup()
+		defer os.RemoveAll(testdir)
+
+		temp, err := ioutil.TempDir(testdir, "merge")
+		assert.NoError(err)
+
+		mdb, err := Open(temp)
+		assert.NoError(err)
+		assert.NoError(mdb.Put([]byte("foo"), []byte("new")))
+		assert.NoError(mdb.Put([]byte("bar"), []byte("baz")))
+		assert.NoError(mdb.Close())
+
+		assert.NoError(commitMerge(fs.OS, testdir, temp))
+
+		// Simulate a crash after the first merged file was moved into place
+		assert.NoError(os.Rename(filepath.Join(temp, "000000000.data"), filepath.Join(testdir, "000000000.data")))
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.False(fs.Exists(fs.OS, temp))
+		assert.False(fs.Exists(fs.OS, filepath.Join(testdir, mergeCommitFilename)))
+
+		stats, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(1, stats.Datafiles)
+		assert.Equal(2, stats.Keys)
+
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("new"), val)
+	})
+
+	t.Run("CompleteKeep", func(t *testing.T) {
+		testdir := setup()
+		defer os.RemoveAll(testdir)
+
+		temp, err := ioutil.TempDir(testdir, "merge")
+		assert.NoError(err)
+
+		mdb, err := Open(temp)
+		assert.NoError(err)
+		assert.NoError(mdb.Put([]byte("bar"), []byte("baz")))
+		assert.NoError(mdb.Close())
+
+		// The merged datafile only replaces the first one
+		assert.NoError(os.Remove(filepath.Join(temp, "index")))
+		assert.NoError(commitMerge(fs.OS, testdir, temp, "000000001.data", "000000002.data"))
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		stats, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(3, stats.Datafiles)
+		assert.Equal(2, stats.Keys)
+
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("old4"), val)
+		val, err = db.Get([]byte("bar"))
+		assert.NoError(err)
+		assert.Equal([]byte("baz"), val)
+	})
+}
+
+func TestMergeFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	setup := func() (string, *Bitcask) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+		for i := 0; i < 5; i++ {
+			assert.NoError(db.Put([]byte("foo"), []byte(fmt.Sprintf("bar%d", i))))
+		}
+		return testdir, db
+	}
+
+	// failRename makes the n-th call to rename fail
+	failRename := func(n int) func() {
+		errRename := errors.New("rename failed")
+		calls := 0
+		orig := rename
+		rename = func(fsys fs.FS, oldpath, newpath string) error {
+			calls++
+			if calls == n {
+				return errRename
+			}
+			return orig(fsys, oldpath, newpath)
+		}
+		return func() { rename = orig }
+	}
+
+	t.Run("BeforeCommit", func(t *testing.T) {
+		testdir, db := setup()
+		defer os.RemoveAll(testdir)
+		defer db.Close()
+
+		restore := failRename(1)
+		assert.Error(db.Merge())
+		restore()
+
+		// The database carries on with the original datafiles
+		assert.NoError(db.Health())
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar4"), val)
+		assert.NoError(db.Put([]byte("hello"), []byte("world")))
+		assert.NoError(db.Merge())
+	})
+
+	t.Run("AfterCommit", func(t *testing.T) {
+		testdir, db := setup()
+		defer os.RemoveAll(testdir)
+
+		restore := failRename(2)
+		assert.Error(db.Merge())
+		restore()
+
+		// The database is closed and the merge completed when reopened
+		assert.Error(db.Health())
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.NoError(db.Health())
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar4"), val)
+
+		stats, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(1, stats.Datafiles)
+	})
+
+	t.Run("AfterCommitWithSyncer", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		logf := func(format string, args ...interface{}) {}
+		db, err := Open(testdir,
+			WithMaxDatafileSize(32),
+			WithSyncInterval(time.Millisecond),
+			WithMetricsInterval(time.Millisecond, logf),
+		)
+		assert.NoError(err)
+		for i := 0; i < 5; i++ {
+			assert.NoError(db.Put([]byte("foo"), []byte(fmt.Sprintf("bar%d", i))))
+		}
+
+		// The syncer and metrics logger are stopped without deadlocking
+		restore := failRename(2)
+		done := make(chan error)
+		go func() { done <- db.Merge() }()
+		select {
+		case err := <-done:
+			assert.Error(err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("merge deadlocked")
+		}
+		restore()
+
+		assert.Error(db.Health())
+		assert.Nil(db.syncStop)
+		assert.Nil(db.metricsStop)
+	})
+}
+
+func TestGetErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("ReadError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("ReadAt", int64(0), int64(22)).Return(
+			internal.Entry{},
+			ErrMockError,
+		)
+		db.curr = mockDatafile
+
+		_, err = db.Get([]byte("foo"))
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+		assert.False(errors.Is(err, ErrKeyNotFound))
+	})
+
+	t.Run("ChecksumError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("ReadAt", int64(0), int64(22)).Return(
+			internal.Entry{
+				Checksum: 0x0,
+				Key:      []byte("foo"),
+				Offset:   0,
+				Value:    []byte("bar"),
+			},
+			nil,
+		)
+		db.curr = mockDatafile
+
+		_, err = db.Get([]byte("foo"))
+		assert.Error(err)
+		assert.Equal(ErrChecksumFailed, err)
+		assert.False(errors.Is(err, ErrKeyNotFound))
+	})
+
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("foo"), []byte("v1")))
+	assert.NoError(db.Close())
+
+	// Corrupt the value on disk
+	f, err := os.OpenFile(filepath.Join(testdir, "000000000.data"), os.O_WRONLY, 0640)
+	assert.NoError(err)
+	_, err = f.WriteAt([]byte("X"), 4+8+3)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	_, err = db.Get([]byte("foo"))
+	assert.Equal(ErrChecksumFailed, err)
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir, WithVerifyChecksums(false))
+	assert.NoError(err)
+	defer db.Close()
+
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("X1"), val)
+
+	it, err := db.Iterator(nil)
+	assert.NoError(err)
+	defer it.Close()
+	assert.True(it.Next())
+	assert.Equal([]byte("X1"), it.Value())
+}
+
+func TestChecksumOnWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	// Values written with checksums round-trip
+	db, err := Open(testdir)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("foo"), []byte("v1")))
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("v1"), val)
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir, WithChecksumOnWrite(false))
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("bar"), []byte("v2")))
+	val, err = db.Get([]byte("bar"))
+	assert.NoError(err)
+	assert.Equal([]byte("v2"), val)
+	assert.NoError(db.Close())
+
+	// Values written without checksums are read without verifying them
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	val, err = db.Get([]byte("bar"))
+	assert.NoError(err)
+	assert.Equal([]byte("v2"), val)
+
+	report, err := db.Check()
+	assert.NoError(err)
+	assert.True(report.OK())
+
+	// and gain one when merged
+	assert.NoError(db.Merge())
+	db.mu.RLock()
+	value, _ := db.trie.Search([]byte("bar"))
+	e, err := db.readEntry(value.(internal.Item))
+	db.mu.RUnlock()
+	assert.NoError(err)
+	assert.False(e.NoChecksum)
+	assert.True(e.Verify([]byte("v2")))
+}
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+
+	foo, stopFoo := db.Watch([]byte("foo"))
+	all, _ := db.Watch(nil)
+
+	assert.NoError(db.Put([]byte("foo1"), []byte("bar")))
+	assert.NoError(db.Put([]byte("hello"), []byte("world")))
+	assert.NoError(db.Delete([]byte("foo1")))
+	assert.NoError(db.Delete([]byte("missing")))
+
+	assert.Equal(Event{Type: EventPut, Key: []byte("foo1"), Value: []byte("bar")}, <-foo)
+	assert.Equal(Event{Type: EventDelete, Key: []byte("foo1")}, <-foo)
+	assert.Equal(0, len(foo))
+	assert.Equal(3, len(all))
+
+	stopFoo()
+	_, ok := <-foo
+	assert.False(ok)
+	stopFoo()
+
+	// Writes don't block on a watcher that falls behind
+	for i := 0; i < 2*watchBufferSize; i++ {
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	}
+	assert.Equal(watchBufferSize, len(all))
+
+	assert.NoError(db.Close())
+	for range all {
+	}
+}
+
+func TestCount(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	for _, key := range []string{"1", "2", "food", "foo", "fooz", "hello"} {
+		assert.NoError(db.Put([]byte(key), []byte("bar")))
+	}
+
+	assert.Equal(6, db.Count(nil))
+	assert.Equal(3, db.Count([]byte("fo")))
+	assert.Equal(1, db.Count([]byte("food")))
+	assert.Equal(0, db.Count([]byte("x")))
+
+	t.Run("KeyPrefix", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		assert.NoError(db.Put([]byte("a:foo"), []byte("bar")))
+		assert.NoError(db.Put([]byte("b:foo"), []byte("bar")))
+		assert.NoError(db.Close())
+
+		db, err = Open(testdir, WithKeyPrefix([]byte("a:")))
+		assert.NoError(err)
+		defer db.Close()
+		assert.Equal(1, db.Count(nil))
+		assert.Equal(1, db.Count([]byte("fo")))
+	})
+}
+
+func TestGetMany(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("v1")))
+	assert.NoError(db.Put([]byte("bar"), []byte("v2")))
+
+	// Corrupt the value of the first entry on disk
+	f, err := os.OpenFile(filepath.Join(testdir, "000000000.data"), os.O_WRONLY, 0640)
+	assert.NoError(err)
+	_, err = f.WriteAt([]byte("X"), 4+8+3)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	values, errs := db.GetMany([][]byte{[]byte("foo"), []byte("bar"), []byte("baz")})
+	assert.Equal(map[string][]byte{"bar": []byte("v2")}, values)
+	assert.Equal(map[string]error{"foo": ErrChecksumFailed}, errs)
+}
+
+func TestAppendRaw(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	encode := func(e internal.Entry) []byte {
+		var buf bytes.Buffer
+		_, err := codec.NewEncoder(&buf).Encode(e)
+		assert.NoError(err)
+		return buf.Bytes()
+	}
+
+	assert.NoError(db.Put([]byte("bar"), []byte("baz")))
+
+	meta, err := db.AppendRaw(encode(internal.NewEntry([]byte("foo"), []byte("bar"))))
+	assert.NoError(err)
+	assert.Equal(Meta{FileID: 0, Offset: 22, Size: 22}, meta)
+
+	val, m, err := db.GetWithMeta([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+	assert.Equal(meta, m)
+
+	// An empty value deletes the key
+	_, err = db.AppendRaw(encode(internal.NewEntry([]byte("foo"), nil)))
+	assert.NoError(err)
+	assert.False(db.Has([]byte("foo")))
+	assert.Equal(1, db.Len())
+
+	// Invalid entries aren't written
+	e := internal.NewEntry([]byte("foo"), []byte("qux"))
+	e.Checksum++
+	_, err = db.AppendRaw(encode(e))
+	assert.Equal(ErrChecksumFailed, err)
+	raw := encode(internal.NewEntry([]byte("foo"), []byte("qux")))
+	_, err = db.AppendRaw(raw[:len(raw)-1])
+	assert.True(errors.Is(err, ErrInvalidEntry))
+	_, err = db.AppendRaw(append(raw, raw...))
+	assert.True(errors.Is(err, ErrInvalidEntry))
+	_, err = db.AppendRaw(encode(internal.NewEntry([]byte(strings.Repeat("k", int(DefaultMaxKeySize)+1)), []byte("bar"))))
+	assert.True(errors.Is(err, ErrInvalidEntry))
+	assert.False(db.Has([]byte("foo")))
+
+	report, err := db.Check()
+	assert.NoError(err)
+	assert.True(report.OK())
+	assert.Equal(int64(22+22+19), db.curr.Size())
+}
+
+func TestReadErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("baz"), []byte("qux")))
+	assert.NoError(db.Sync())
+
+	t.Run("DatafileNotFound", func(t *testing.T) {
+		db.mu.Lock()
+		db.trie.Insert([]byte("missing"), internal.Item{FileID: 42, Offset: 0, Size: 22})
+		db.mu.Unlock()
+
+		_, err := db.Get([]byte("missing"))
+		assert.Equal(ErrDatafileNotFound, err)
+	})
+
+	t.Run("InvalidEntry", func(t *testing.T) {
+		// Overwrite the key size of the first entry with an invalid one
+		f, err := os.OpenFile(filepath.Join(testdir, "000000000.data"), os.O_WRONLY, 0640)
+		assert.NoError(err)
+		_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		_, err = db.Get([]byte("foo"))
+		assert.True(errors.Is(err, ErrInvalidEntry))
+	})
+
+	t.Run("ShortRead", func(t *testing.T) {
+		assert.NoError(os.Truncate(filepath.Join(testdir, "000000000.data"), 30))
+
+		_, err := db.Get([]byte("baz"))
+		assert.Equal(ErrShortRead, err)
+	})
+}
+
+func TestIndexMissingDatafile(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("hello"), []byte("world")))
+	assert.NoError(db.Close())
+
+	// Corrupt the index to point at a datafile that doesn't exist
+	indexer := index.NewIndexer(fs.OS)
+	trie, found, err := indexer.Load(filepath.Join(testdir, "index"), DefaultMaxKeySize)
+	assert.NoError(err)
+	assert.True(found)
+	value, _ := trie.Search([]byte("foo"))
+	item := value.(internal.Item)
+	item.FileID = 42
+	trie.Insert([]byte("foo"), item)
+	assert.NoError(indexer.Save(trie, filepath.Join(testdir, "index")))
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	_, err = db.Get([]byte("foo"))
+	assert.Equal(ErrDatafileNotFound, err)
+
+	_, err = db.Iterator(nil)
+	assert.Equal(ErrDatafileNotFound, err)
+
+	val, err := db.Get([]byte("hello"))
+	assert.NoError(err)
+	assert.Equal([]byte("world"), val)
+}
+
+func TestPreload(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("hello"), []byte("world")))
+
+	assert.NoError(db.Preload(context.Background(), nil))
+	assert.NoError(db.Preload(context.Background(), []byte("fo")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(context.Canceled, db.Preload(ctx, nil))
+
+	// Corrupt the value of the first entry on disk
+	f, err := os.OpenFile(filepath.Join(testdir, "000000000.data"), os.O_WRONLY, 0640)
+	assert.NoError(err)
+	_, err = f.WriteAt([]byte("X"), 4+8+3)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	assert.Equal(ErrChecksumFailed, db.Preload(context.Background(), nil))
+	assert.NoError(db.Preload(context.Background(), []byte("hello")))
+}
+
+func TestGetInto(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	buf := make([]byte, 8)
+	n, err := db.GetInto([]byte("foo"), buf)
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), buf[:n])
+
+	n, err = db.GetInto([]byte("foo"), buf[:2])
+	assert.Equal(ErrBufferTooSmall, err)
+	assert.Equal(3, n)
+
+	n, err = db.GetInto([]byte("baz"), buf)
+	assert.Equal(ErrKeyNotFound, err)
+	assert.Equal(0, n)
+}
+
+func TestGetOrLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	var calls int32
+	loader := func(key []byte) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return append([]byte("loaded "), key...), nil
+	}
+
+	t.Run("Hit", func(t *testing.T) {
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		val, err := db.GetOrLoad([]byte("foo"), loader)
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+		assert.Equal(int32(0), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("Miss", func(t *testing.T) {
+		val, err := db.GetOrLoad([]byte("hello"), loader)
+		assert.NoError(err)
+		assert.Equal([]byte("loaded hello"), val)
+		assert.Equal(int32(1), atomic.LoadInt32(&calls))
+
+		val, err = db.Get([]byte("hello"))
+		assert.NoError(err)
+		assert.Equal([]byte("loaded hello"), val)
+	})
+
+	t.Run("LoaderError", func(t *testing.T) {
+		_, err := db.GetOrLoad([]byte("missing"), func(key []byte) ([]byte, error) {
+			return nil, ErrMockError
+		})
+		assert.Equal(ErrMockError, err)
+		assert.False(db.Has([]byte("missing")))
+	})
+
+	t.Run("Coalesce", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		release := make(chan struct{})
+		slow := func(key []byte) ([]byte, error) {
+			<-release
+			return loader(key)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				val, err := db.GetOrLoad([]byte("world"), slow)
+				assert.NoError(err)
+				assert.Equal([]byte("loaded world"), val)
+			}()
+		}
+
+		// Give the calls time to miss and wait on the first one's load
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(int32(1), atomic.LoadInt32(&calls))
+	})
+}
+
+func TestReadRepair(t *testing.T) {
+	assert := assert.New(t)
+
+	setup := func(options ...Option) (*Bitcask, string) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		db, err := Open(testdir, options...)
+		assert.NoError(err)
+
+		assert.NoError(db.Put([]byte("foo"), []byte("v1")))
+		assert.NoError(db.Put([]byte("foo"), []byte("v2")))
+
+		// Corrupt the value of the second entry on disk
+		f, err := os.OpenFile(filepath.Join(testdir, "000000000.data"), os.O_WRONLY, 0640)
+		assert.NoError(err)
+		_, err = f.WriteAt([]byte("X"), 21+4+8+3)
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		return db, testdir
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		db, testdir := setup()
+		defer os.RemoveAll(testdir)
+		defer db.Close()
+
+		_, err := db.Get([]byte("foo"))
+		assert.Equal(ErrChecksumFailed, err)
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		db, testdir := setup(WithReadRepair())
+		defer os.RemoveAll(testdir)
+		defer db.Close()
+
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("v1"), val)
+
+		// The repaired value was rewritten as the current value
+		assert.NoError(db.Reopen())
+		val, err = db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("v1"), val)
+	})
+
+	t.Run("NoPriorVersion", func(t *testing.T) {
+		db, testdir := setup(WithReadRepair())
+		defer os.RemoveAll(testdir)
+		defer db.Close()
+
+		assert.NoError(db.Delete([]byte("foo")))
+		assert.NoError(db.Put([]byte("foo"), []byte("v3")))
+
+		f, err := os.OpenFile(filepath.Join(testdir, "000000000.data"), os.O_WRONLY, 0640)
+		assert.NoError(err)
+		_, err = f.WriteAt([]byte("X"), db.curr.Size()-6)
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		_, err = db.Get([]byte("foo"))
+		assert.Equal(ErrChecksumFailed, err)
+	})
+}
+
+func TestPutErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("WriteError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("Size").Return(int64(0))
+		mockDatafile.On(
+			"Write",
+			internal.Entry{
+				Checksum: 0x76ff8caa,
+				Key:      []byte("foo"),
+				Offset:   0,
+				Value:    []byte("bar"),
+			},
+		).Return(int64(0), int64(0), ErrMockError)
+		db.curr = mockDatafile
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("SyncError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		db, err := Open(testdir, WithSync(true))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("Size").Return(int64(0))
+		mockDatafile.On(
+			"Write",
+			internal.Entry{
+				Checksum: 0x78240498,
+				Key:      []byte("bar"),
+				Offset:   0,
+				Value:    []byte("baz"),
+			},
+		).Return(int64(0), int64(0), nil)
+		mockDatafile.On("Sync").Return(ErrMockError)
+		db.curr = mockDatafile
+
+		err = db.Put([]byte("bar"), []byte("baz"))
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+}
+
+func TestOpenErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("BadPath", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		assert.NoError(ioutil.WriteFile(filepath.Join(testdir, "foo"), []byte("foo"), 0600))
+
+		_, err = Open(filepath.Join(testdir, "foo", "tmp.db"))
+		assert.Error(err)
+	})
+
+	t.Run("BadOption", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		withBogusOption := func() Option {
+			return func(cfg *config.Config) error {
+				return errors.New("mocked error")
+			}
+		}
+
+		_, err = Open(testdir, withBogusOption())
+		assert.Error(err)
+	})
+
+	t.Run("LoadDatafilesError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+
+		err = db.Close()
+		assert.NoError(err)
+
+		// Simulate some horrible that happened to the datafiles!
+		err = os.Rename(filepath.Join(testdir, "000000000.data"), filepath.Join(testdir, "000000000xxx.data"))
+		assert.NoError(err)
+
+		_, err = Open(testdir)
+		assert.Error(err)
+		assert.Equal("strconv.ParseInt: parsing \"000000000xxx\": invalid syntax", err.Error())
+	})
+
+	t.Run("RecoverMergeError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		marker := filepath.Join(testdir, mergeCommitFilename)
+		assert.NoError(ioutil.WriteFile(marker, []byte("garbage"), 0600))
+
+		_, err = Open(testdir)
+		assert.Error(err)
+
+		// The lock was released
+		assert.NoError(os.Remove(marker))
+		db, err := Open(testdir)
+		assert.NoError(err)
+		assert.NoError(db.Close())
+	})
+}
+
+func TestCloseErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	t.Run("CloseIndexError", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		mockIndexer := new(mocks.Indexer)
+		mockIndexer.On("Save", db.trie, filepath.Join(db.path, "index")).Return(ErrMockError)
+		db.indexer = mockIndexer
+
+		err = db.Close()
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("CloseDatafilesError", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("Close").Return(ErrMockError)
+		db.datafiles[0] = mockDatafile
+
+		err = db.Close()
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("CloseActiveDatafileError", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("Close").Return(ErrMockError)
+		db.curr = mockDatafile
+
+		err = db.Close()
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+}
+
+func TestDeleteErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("WriteError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("Size").Return(int64(0))
+		mockDatafile.On(
+			"Write",
+			internal.Entry{
+				Checksum: 0x0,
+				Key:      []byte("foo"),
+				Offset:   0,
+				Value:    []byte{},
+			},
+		).Return(int64(0), int64(0), ErrMockError)
+		db.curr = mockDatafile
+
+		err = db.Delete([]byte("foo"))
+		assert.Error(err)
+	})
+}
+
+func TestMergeWhileWriting(t *testing.T) {
+	for _, n := range []int{1, 4} {
+		t.Run(fmt.Sprintf("Concurrency%d", n), func(t *testing.T) {
+			assert := assert.New(t)
+
+			testdir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(err)
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir, WithMaxDatafileSize(1<<16), WithMergeConcurrency(n))
+			assert.NoError(err)
+
+			expected := make(map[string]string)
+			for i := 0; i < 10000; i++ {
+				key := fmt.Sprintf("foo%d", i)
+				assert.NoError(db.Put([]byte(key), []byte("bar")))
+				expected[key] = "bar"
+			}
+
+			// Hammer the database with writes throughout several merges
+			for round := 0; round < 5; round++ {
+				done := make(chan error)
+				go func() { done <- db.Merge() }()
+
+				merged := false
+				for i := 0; i < 5000 && !merged; i++ {
+					select {
+					case err := <-done:
+						assert.NoError(err)
+						merged = true
+						continue
+					default:
+					}
+
+					key := fmt.Sprintf("foo%d", (round*1000+i*7)%10000)
+					if i%5 == 0 {
+						assert.NoError(db.Delete([]byte(key)))
+						delete(expected, key)
+					} else {
+						value := fmt.Sprintf("bar%d-%d", round, i)
+						assert.NoError(db.Put([]byte(key), []byte(value)))
+						expected[key] = value
+					}
+					key = fmt.Sprintf("new%d-%d", round, i)
+					assert.NoError(db.Put([]byte(key), []byte("baz")))
+					expected[key] = "baz"
+				}
+				if !merged {
+					assert.NoError(<-done)
+				}
+			}
+
+			check := func() {
+				assert.Equal(len(expected), db.Len())
+				for key, value := range expected {
+					val, err := db.Get([]byte(key))
+					assert.NoError(err)
+					assert.Equal([]byte(value), val)
+				}
+			}
+			check()
+
+			assert.NoError(db.Merge())
+			check()
+
+			assert.NoError(db.Close())
+			db, err = Open(testdir)
+			assert.NoError(err)
+			defer db.Close()
+			check()
+		})
+	}
+
+	t.Run("Clear", func(t *testing.T) {
+		assert := assert.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(1024))
+		assert.NoError(err)
+		defer db.Close()
+
+		for i := 0; i < 1000; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+		}
+
+		done := make(chan error)
+		go func() { done <- db.Merge() }()
+		assert.NoError(db.Clear())
+		assert.NoError(db.Put([]byte("hello"), []byte("world")))
+		assert.NoError(<-done)
+
+		assert.Equal(1, db.Len())
+		val, err := db.Get([]byte("hello"))
+		assert.NoError(err)
+		assert.Equal([]byte("world"), val)
+	})
+}
+
+func TestMergeErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("RemoveDatabaseDirectory", func(t *testing.T) {
+		skipIfWindows(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		assert.NoError(os.RemoveAll(testdir))
+
+		err = db.Merge()
+		assert.Error(err)
+	})
+
+	t.Run("EmptyCloseError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("Close").Return(ErrMockError)
+		db.curr = mockDatafile
+
+		err = db.Merge()
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("ReadError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("ReadAt", int64(0), int64(22)).Return(
+			internal.Entry{},
+			ErrMockError,
+		)
+		db.curr = mockDatafile
+
+		err = db.Merge()
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+}
+
+func TestConcurrent(t *testing.T) {
+	var (
+		db  *Bitcask
+		err error
+	)
+
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Open", func(t *testing.T) {
+			db, err = Open(testdir)
+			assert.NoError(err)
+		})
+
+		t.Run("Put", func(t *testing.T) {
+			err = db.Put([]byte("foo"), []byte("bar"))
+			assert.NoError(err)
+		})
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		t.Run("Put", func(t *testing.T) {
+			f := func(wg *sync.WaitGroup, x int) {
+				defer func() {
+					wg.Done()
+				}()
+				for i := 0; i <= 100; i++ {
+					if i%x == 0 {
+						key := []byte(fmt.Sprintf("k%d", i))
+						value := []byte(fmt.Sprintf("v%d", i))
+						err := db.Put(key, value)
+						assert.NoError(err)
+					}
+				}
+			}
+
+			wg := &sync.WaitGroup{}
+			wg.Add(3)
+
+			go f(wg, 2)
+			go f(wg, 3)
+			go f(wg, 5)
+
+			wg.Wait()
+		})
+
+		t.Run("Get", func(t *testing.T) {
+			f := func(wg *sync.WaitGroup, N int) {
+				defer func() {
+					wg.Done()
+				}()
+				for i := 0; i <= N; i++ {
+					value, err := db.Get([]byte("foo"))
+					assert.NoError(err)
+					assert.Equal([]byte("bar"), value)
+				}
+			}
+
+			wg := &sync.WaitGroup{}
+			wg.Add(3)
+			go f(wg, 100)
+			go f(wg, 100)
+			go f(wg, 100)
+
+			wg.Wait()
+		})
+
+		t.Run("Close", func(t *testing.T) {
+			err = db.Close()
+			assert.NoError(err)
+		})
+	})
+}
+
+func TestScan(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	var db *Bitcask
+
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Open", func(t *testing.T) {
+			db, err = Open(testdir)
+			assert.NoError(err)
+		})
+
+		t.Run("Put", func(t *testing.T) {
+			var items = map[string][]byte{
+				"1":     []byte("1"),
+				"2":     []byte("2"),
+				"3":     []byte("3"),
+				"food":  []byte("pizza"),
+				"foo":   []byte([]byte("foo")),
+				"fooz":  []byte("fooz ball"),
+				"hello": []byte("world"),
+			}
+			for k, v := range items {
+				err = db.Put([]byte(k), v)
+				assert.NoError(err)
+			}
+		})
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		var (
+			vals     [][]byte
+			expected = [][]byte{
+				[]byte("foo"),
+				[]byte("fooz ball"),
+				[]byte("pizza"),
+			}
+		)
+
+		err = db.Scan([]byte("fo"), func(key []byte) error {
+			val, err := db.Get(key)
+			assert.NoError(err)
+			vals = append(vals, val)
+			return nil
+		})
+		vals = SortByteArrays(vals)
+		assert.Equal(expected, vals)
+	})
+
+	t.Run("ScanErrors", func(t *testing.T) {
+		err = db.Scan([]byte("fo"), func(key []byte) error {
+			return ErrMockError
+		})
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("ConcurrentPut", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				assert.NoError(db.Put([]byte(fmt.Sprintf("fo%d", i)), []byte("bar")))
+			}
+		}()
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Scan([]byte("fo"), func(key []byte) error { return nil }))
+		}
+		<-done
+	})
+
+	t.Run("StopsAtFirstError", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("bar%d", i)), []byte("baz")))
+		}
+
+		// Callbacks that fail after several keys and would succeed again
+		// if they were called any further
+		var calls int
+		scan := func(key []byte) error {
+			calls++
+			if calls == 5 {
+				return ErrMockError
+			}
+			return nil
+		}
+		fold := func(key, value []byte) error {
+			return scan(key)
+		}
+
+		calls = 0
+		assert.Equal(ErrMockError, db.Scan([]byte("bar"), scan))
+		assert.Equal(5, calls)
+
+		calls = 0
+		assert.Equal(ErrMockError, db.Fold(scan))
+		assert.Equal(5, calls)
+
+		calls = 0
+		assert.Equal(ErrMockError, db.FoldWithValue(fold))
+		assert.Equal(5, calls)
+	})
+}
+
+func TestIterator(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte(fmt.Sprintf("v%d", i))))
+		assert.NoError(db.Put([]byte(fmt.Sprintf("bar%d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+
+	t.Run("Prefix", func(t *testing.T) {
+		it, err := db.Iterator([]byte("foo"))
+		assert.NoError(err)
+		defer it.Close()
+
+		var n int
+		for it.Next() {
+			assert.Equal([]byte(fmt.Sprintf("foo%d", n)), it.Key())
+			assert.Equal([]byte(fmt.Sprintf("v%d", n)), it.Value())
+			n++
+		}
+		assert.NoError(it.Err())
+		assert.Equal(10, n)
+	})
+
+	t.Run("SurvivesMerge", func(t *testing.T) {
+		it, err := db.Iterator(nil)
+		assert.NoError(err)
+		defer it.Close()
+
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("overwritten")))
+		}
+
+		done := make(chan error)
+		go func() { done <- db.Merge() }()
+
+		values := make(map[string]string)
+		for it.Next() {
+			values[string(it.Key())] = string(it.Value())
+		}
+		assert.NoError(it.Err())
+		assert.NoError(<-done)
+
+		assert.Len(values, 20)
+		for i := 0; i < 10; i++ {
+			assert.Equal(fmt.Sprintf("v%d", i), values[fmt.Sprintf("foo%d", i)])
+			assert.Equal(fmt.Sprintf("v%d", i), values[fmt.Sprintf("bar%d", i)])
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		it, err := db.Iterator(nil)
+		assert.NoError(err)
+		assert.NoError(it.Close())
+		assert.False(it.Next())
+	})
+}
+
+func TestKeyPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("foo"), []byte("global")))
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir, WithKeyPrefix([]byte("tenant1/")))
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.False(db.Has([]byte("foo")))
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("fooz"), []byte("baz")))
+	assert.NoError(db.Put([]byte("hello"), []byte("world")))
+
+	t.Run("Get", func(t *testing.T) {
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+		assert.True(db.Has([]byte("hello")))
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		var keys [][]byte
+		err := db.Scan([]byte("fo"), func(key []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+		assert.NoError(err)
+		assert.Equal([][]byte{[]byte("foo"), []byte("fooz")}, SortByteArrays(keys))
+	})
+
+	t.Run("Keys", func(t *testing.T) {
+		var keys [][]byte
+		for key := range db.Keys() {
+			keys = append(keys, key)
+		}
+		assert.Equal([][]byte{[]byte("foo"), []byte("fooz"), []byte("hello")}, SortByteArrays(keys))
+	})
+
+	t.Run("Fold", func(t *testing.T) {
+		var keys [][]byte
+		err := db.Fold(func(key []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+		assert.NoError(err)
+		assert.Equal([][]byte{[]byte("foo"), []byte("fooz"), []byte("hello")}, SortByteArrays(keys))
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		assert.NoError(db.Merge())
+		assert.Equal(4, db.Len())
+		val, err := db.Get([]byte("hello"))
+		assert.NoError(err)
+		assert.Equal([]byte("world"), val)
+	})
+
+	t.Run("DeleteAll", func(t *testing.T) {
+		assert.NoError(db.DeleteAll())
+		assert.Equal(1, db.Len())
+		assert.NoError(db.Close())
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("global"), val)
+	})
+}
+
+func TestSyncInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithSyncInterval(10*time.Millisecond))
+	assert.NoError(err)
+	assert.NotNil(db.syncStop)
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(db.Merge())
+
+	assert.NoError(db.Close())
+	assert.Nil(db.syncStop)
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+	assert.Nil(db.syncStop)
+
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+}
+
+func TestMetricsInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	db, err := Open(testdir, WithMetricsInterval(10*time.Millisecond, logf))
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(db.Close())
+	assert.Nil(db.metricsStop)
+
+	mu.Lock()
+	n := len(lines)
+	assert.Greater(n, 0)
+	assert.Contains(lines[n-1], "keys=1 ")
+	assert.Contains(lines[n-1], "live_bytes=22 ")
+	mu.Unlock()
+
+	// Nothing is logged once closed
+	time.Sleep(30 * time.Millisecond)
+	mu.Lock()
+	assert.Len(lines, n)
+	mu.Unlock()
+}
+
+func TestDatafileSync(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("%t", enabled), func(t *testing.T) {
+			assert := assert.New(t)
+
+			testdir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(err)
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir, WithMaxDatafileSize(16), WithDatafileSync(enabled))
+			assert.NoError(err)
+			assert.Equal(!enabled, db.config.NoDatafileSync)
+
+			for i := 0; i < 4; i++ {
+				key := []byte(fmt.Sprintf("foo%d", i))
+				assert.NoError(db.Put(key, []byte("bar")))
+			}
+			assert.Equal(3, len(db.datafiles))
+			assert.NoError(db.Close())
+
+			db, err = Open(testdir)
+			assert.NoError(err)
+			defer db.Close()
+
+			for i := 0; i < 4; i++ {
+				val, err := db.Get([]byte(fmt.Sprintf("foo%d", i)))
+				assert.NoError(err)
+				assert.Equal([]byte("bar"), val)
+			}
+		})
+	}
+}
+
+func TestPreallocateDatafile(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(32), WithPreallocateDatafile(1<<20))
+	assert.NoError(err)
+
+	for i := 0; i < 4; i++ {
+		key := []byte(fmt.Sprintf("foo%d", i))
+		assert.NoError(db.Put(key, []byte("bar")))
+	}
+	assert.NoError(db.Close())
+
+	// The space reserved beyond the entries written is released on close
+	datafiles, err := internal.GetDatafiles(fs.OS, testdir, DefaultDatafileExtension, false)
+	assert.NoError(err)
+	assert.Equal(2, len(datafiles))
+	for _, fn := range datafiles {
+		stat, err := os.Stat(fn)
+		assert.NoError(err)
+		assert.Equal(int64(46), stat.Size())
+	}
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 4; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("foo%d", i)))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithWriteTimeout(50*time.Millisecond))
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	// Simulate a long running operation holding the lock
+	db.mu.RLock()
+	assert.Equal(ErrWriteTimeout, db.Put([]byte("foo"), []byte("baz")))
+	assert.Equal(ErrWriteTimeout, db.Delete([]byte("foo")))
+	db.mu.RUnlock()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("baz")))
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("baz"), val)
+}
+
+func TestHealth(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	assert.NoError(db.Health())
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Health())
+
+	assert.NoError(db.Close())
+	assert.Error(db.Health())
+
+	t.Run("InMemory", func(t *testing.T) {
+		db, err := OpenInMemory()
+		assert.NoError(err)
+		assert.NoError(db.Health())
+
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Health())
+
+		assert.NoError(db.Close())
+		assert.Error(db.Health())
+	})
+}
+
+func TestLocking(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	_, err = Open(testdir)
+	assert.Error(err)
+	assert.Equal(ErrDatabaseLocked, err)
+}
+
+func TestEstimateRecovery(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	for i := 0; i < 4; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("k%02d", i)), []byte("bar")))
+	}
+
+	// The index file is only written on close
+	estimate, err := EstimateRecovery(testdir)
+	assert.NoError(err)
+	assert.Equal(RecoveryEstimate{Replay: true, Datafiles: 2, ReplayBytes: 4 * 22}, estimate)
+	assert.NoError(db.Close())
+
+	estimate, err = EstimateRecovery(testdir)
+	assert.NoError(err)
+	assert.True(estimate.IndexFound)
+	assert.Greater(estimate.IndexBytes, int64(0))
+	assert.False(estimate.Replay)
+	assert.Equal(2, estimate.Datafiles)
+	assert.Equal(int64(4*22), estimate.ReplayBytes)
+
+	estimate, err = EstimateRecovery(testdir, WithNoIndexFile(true))
+	assert.NoError(err)
+	assert.True(estimate.Replay)
+}
+
+func TestOpenContext(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithNoIndexFile(true))
+	assert.NoError(err)
+	for i := 0; i < 100; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+	assert.NoError(db.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = OpenContext(ctx, testdir)
+	assert.Equal(context.Canceled, err)
+
+	_, err = Open(testdir, WithOpenTimeout(time.Nanosecond))
+	assert.Equal(context.DeadlineExceeded, err)
+
+	// The lock was released by the failed opens
+	db, err = OpenContext(context.Background(), testdir)
+	assert.NoError(err)
+	defer db.Close()
+	assert.Equal(100, db.Len())
+}
+
+func TestLockTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+
+	start := time.Now()
+	_, err = Open(testdir, WithLockTimeout(50*time.Millisecond))
+	assert.Equal(ErrDatabaseLocked, err)
+	assert.True(time.Since(start) >= 50*time.Millisecond)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db.Close()
+	}()
+
+	db2, err := Open(testdir, WithLockTimeout(5*time.Second))
+	assert.NoError(err)
+	assert.NoError(db2.Close())
+}
+
+type benchmarkTestCase struct {
+	name string
+	size int
+}
+
+func BenchmarkGet(b *testing.B) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+
+	tests := []benchmarkTestCase{
+		{"128B", 128},
+		{"256B", 256},
+		{"512B", 512},
+		{"1K", 1024},
+		{"2K", 2048},
+		{"4K", 4096},
+		{"8K", 8192},
+		{"16K", 16384},
+		{"32K", 32768},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			b.SetBytes(int64(tt.size))
+
+			key := []byte("foo")
+			value := []byte(strings.Repeat(" ", tt.size))
+
+			options := []Option{
+				WithMaxKeySize(uint32(len(key))),
+				WithMaxValueSize(uint64(tt.size)),
+			}
+			db, err := Open(testdir, options...)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			err = db.Put(key, value)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				val, err := db.Get(key)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if !bytes.Equal(val, value) {
+					b.Errorf("unexpected value")
+				}
+			}
+			b.StopTimer()
+			db.Close()
+		})
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	tests := []benchmarkTestCase{
+		{"128B", 128},
+		{"256B", 256},
+		{"1K", 1024},
+		{"2K", 2048},
+		{"4K", 4096},
+		{"8K", 8192},
+		{"16K", 16384},
+		{"32K", 32768},
+	}
+
+	variants := map[string][]Option{
+		"NoSync": {
+			WithSync(false),
+		},
+		"Sync": {
+			WithSync(true),
+		},
+	}
+
+	for name, options := range variants {
+		testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, options...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer db.Close()
+
+		for _, tt := range tests {
+			b.Run(tt.name+name, func(b *testing.B) {
+				b.SetBytes(int64(tt.size))
+
+				key := []byte("foo")
+				value := []byte(strings.Repeat(" ", tt.size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					err := db.Put(key, value)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	var items = map[string][]byte{
+		"1":     []byte("1"),
+		"2":     []byte("2"),
+		"3":     []byte("3"),
+		"food":  []byte("pizza"),
+		"foo":   []byte([]byte("foo")),
+		"fooz":  []byte("fooz ball"),
+		"hello": []byte("world"),
+	}
+	for k, v := range items {
+		err := db.Put([]byte(k), v)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var expected = [][]byte{[]byte("foo"), []byte("food"), []byte("fooz")}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var keys [][]byte
+		err = db.Scan([]byte("fo"), func(key []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		keys = SortByteArrays(keys)
+		if !reflect.DeepEqual(expected, keys) {
+			b.Fatal(fmt.Errorf("expected keys=#%v got=%#v", expected, keys))
+		}
+	}
+}
+
+func BenchmarkMerge(b *testing.B) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	value := []byte(strings.Repeat(" ", 4096))
+
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Concurrency%d", n), func(b *testing.B) {
+			testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir, WithMergeConcurrency(n))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			for i := 0; i < 10000; i++ {
+				if err := db.Put([]byte(fmt.Sprintf("foo%d", i)), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.Merge(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLargeValueThreshold(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	blobs := func() []string {
+		fns, err := filepath.Glob(filepath.Join(testdir, blobsDir, "*"+blobExt))
+		assert.NoError(err)
+		return fns
+	}
+
+	db, err := Open(testdir, WithLargeValueThreshold(16))
+	assert.NoError(err)
+
+	large1 := bytes.Repeat([]byte("x"), 100)
+	large2 := bytes.Repeat([]byte("y"), 100)
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("large1"), large1))
+	assert.NoError(db.Put([]byte("large2"), large2))
+	assert.Len(blobs(), 2)
+
+	values := map[string][]byte{"foo": []byte("bar"), "large1": large1, "large2": large2}
+	for key, value := range values {
+		val, err := db.Get([]byte(key))
+		assert.NoError(err)
+		assert.Equal(value, val)
+	}
+
+	it, err := db.Iterator(nil)
+	assert.NoError(err)
+	for it.Next() {
+		assert.Equal(values[string(it.Key())], it.Value())
+	}
+	assert.NoError(it.Err())
+	assert.NoError(it.Close())
+
+	assert.NoError(db.FoldWithValue(func(key, value []byte) error {
+		assert.Equal(values[string(key)], value)
+		return nil
+	}))
+
+	// Merging only rewrites the references and removes the blob files
+	// no longer referenced
+	large1 = bytes.Repeat([]byte("z"), 100)
+	assert.NoError(db.Put([]byte("large1"), large1))
+	assert.NoError(db.Delete([]byte("large2")))
+	assert.Len(blobs(), 3)
+
+	assert.NoError(db.Merge())
+	assert.Len(blobs(), 1)
+
+	size, err := db.DataSize()
+	assert.NoError(err)
+	assert.Less(size, int64(100))
+
+	report, err := db.Check()
+	assert.NoError(err)
+	assert.True(report.OK())
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	val, err := db.Get([]byte("large1"))
+	assert.NoError(err)
+	assert.Equal(large1, val)
+	val, err = db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+	assert.False(db.Has([]byte("large2")))
+
+	assert.NoError(db.Clear())
+	assert.Len(blobs(), 0)
+}
+
+func TestGCBlobs(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithLargeValueThreshold(16))
+	assert.NoError(err)
+	defer db.Close()
+
+	stats, err := db.BlobStats()
+	assert.NoError(err)
+	assert.Equal(BlobStats{}, stats)
+	assert.NoError(db.GCBlobs())
+
+	large := bytes.Repeat([]byte("x"), 100)
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("large1"), large))
+	assert.NoError(db.Put([]byte("large2"), large))
+	assert.NoError(db.Put([]byte("large1"), bytes.Repeat([]byte("y"), 50)))
+	assert.NoError(db.Delete([]byte("large2")))
+
+	stats, err = db.BlobStats()
+	assert.NoError(err)
+	assert.Equal(BlobStats{Files: 3, Size: 250, DeadFiles: 2, DeadBytes: 200}, stats)
+
+	assert.NoError(db.GCBlobs())
+	stats, err = db.BlobStats()
+	assert.NoError(err)
+	assert.Equal(BlobStats{Files: 1, Size: 50}, stats)
+
+	val, err := db.Get([]byte("large1"))
+	assert.NoError(err)
+	assert.Equal(bytes.Repeat([]byte("y"), 50), val)
+
+	// New blob files keep being numbered after the ones removed
+	assert.NoError(db.Put([]byte("large2"), large))
+	val, err = db.Get([]byte("large2"))
+	assert.NoError(err)
+	assert.Equal(large, val)
+
+	report, err := db.Check()
+	assert.NoError(err)
+	assert.True(report.OK())
+}
+
+func TestReadEntryAt(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(16))
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Put([]byte("baz"), []byte("qux")))
+
+	for key, value := range map[string]string{"foo": "bar", "baz": "qux"} {
+		_, meta, err := db.GetWithMeta([]byte(key))
+		assert.NoError(err)
+
+		val, err := db.ReadEntryAt(meta.FileID, meta.Offset, meta.Size)
+		assert.NoError(err)
+		assert.Equal([]byte(value), val)
+	}
+
+	_, meta, err := db.GetWithMeta([]byte("baz"))
+	assert.NoError(err)
+	assert.Equal(1, meta.FileID)
+
+	t.Run("DatafileNotFound", func(t *testing.T) {
+		_, err := db.ReadEntryAt(42, meta.Offset, meta.Size)
+		assert.Equal(ErrDatafileNotFound, err)
+	})
+
+	t.Run("InvalidEntry", func(t *testing.T) {
+		for _, loc := range [][2]int64{
+			{-1, meta.Size},
+			{meta.Offset, 0},
+			{meta.Offset, meta.Size + 1},
+			{meta.Offset + 1, meta.Size - 1},
+			{meta.Offset, meta.Size - 1},
+		} {
+			_, err := db.ReadEntryAt(meta.FileID, loc[0], loc[1])
+			assert.Equal(ErrInvalidEntry, err, "offset %d size %d", loc[0], loc[1])
+		}
+	})
+}
+
+func TestAppend(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	now := time.Unix(1234567890, 0)
+	db, err := Open(testdir, WithMaxValueSize(1024), WithClock(func() time.Time { return now }))
+	assert.NoError(err)
+	defer db.Close()
+
+	n, err := db.Append([]byte("foo"), []byte("bar"))
+	assert.NoError(err)
+	assert.Equal(3, n)
+
+	n, err = db.Append([]byte("foo"), []byte("baz"))
+	assert.NoError(err)
+	assert.Equal(6, n)
+
+	n, err = db.Append([]byte("foo"), nil)
+	assert.NoError(err)
+	assert.Equal(6, n)
+
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("barbaz"), val)
+
+	_, err = db.Append([]byte("foo"), make([]byte, 1024))
+	assert.Equal(ErrValueTooLarge, err)
+
+	t.Run("KeepsTTL", func(t *testing.T) {
+		assert.NoError(db.PutWithTTL([]byte("ttl"), []byte("bar"), time.Minute))
+		_, err := db.Append([]byte("ttl"), []byte("baz"))
+		assert.NoError(err)
+
+		ttl, ok, err := db.TTL([]byte("ttl"))
+		assert.NoError(err)
+		assert.True(ok)
+		assert.Equal(time.Minute, ttl)
+
+		// An expired key is appended to as if it was not found
+		now = now.Add(time.Hour)
+		n, err := db.Append([]byte("ttl"), []byte("qux"))
+		assert.NoError(err)
+		assert.Equal(3, n)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					_, err := db.Append([]byte("log"), []byte("x"))
+					assert.NoError(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		val, err := db.Get([]byte("log"))
+		assert.NoError(err)
+		assert.Equal(800, len(val))
+	})
+}
+
+func TestWithoutConfigFile(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	configPath := filepath.Join(testdir, "config.json")
+
+	db, err := Open(testdir, WithoutConfigFile(), WithMaxKeySize(8))
+	assert.NoError(err)
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.Equal(ErrKeyTooLarge, db.Put([]byte("toolongkey"), []byte("bar")))
+	assert.NoError(db.Reconfigure(WithMaxKeySize(16)))
+	assert.NoError(db.Put([]byte("toolongkey"), []byte("bar")))
+	assert.NoError(db.Merge())
+	assert.NoError(db.Close())
+	_, err = os.Stat(configPath)
+	assert.True(os.IsNotExist(err))
+
+	// An existing config.json is ignored and left untouched
+	db, err = Open(testdir, WithMaxKeySize(16))
+	assert.NoError(err)
+	assert.NoError(db.Close())
+	config, err := ioutil.ReadFile(configPath)
+	assert.NoError(err)
+
+	db, err = Open(testdir, WithoutConfigFile(), WithMaxKeySize(32))
+	assert.NoError(err)
+	val, err := db.Get([]byte("toolongkey"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+	assert.NoError(db.Close())
+
+	after, err := ioutil.ReadFile(configPath)
+	assert.NoError(err)
+	assert.Equal(config, after)
+}
+
+func TestReconfigure(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxValueSize(8))
+	assert.NoError(err)
+
+	assert.NoError(db.Put([]byte("foo"), bytes.Repeat([]byte("a"), 8)))
+	assert.Equal(ErrValueTooLarge, db.Put([]byte("bar"), bytes.Repeat([]byte("b"), 16)))
+
+	assert.NoError(db.Reconfigure(WithMaxValueSize(32), WithSync(true), WithSyncInterval(time.Millisecond)))
+	assert.NoError(db.Put([]byte("bar"), bytes.Repeat([]byte("b"), 16)))
+
+	val, err := db.Get([]byte("bar"))
+	assert.NoError(err)
+	assert.Equal(bytes.Repeat([]byte("b"), 16), val)
+
+	cfg, err := config.Load(fs.OS, filepath.Join(testdir, "config.json"))
+	assert.NoError(err)
+	assert.Equal(uint64(32), cfg.MaxValueSize)
+	assert.True(cfg.Sync)
+
+	t.Run("Incompatible", func(t *testing.T) {
+		err := db.Reconfigure(WithMaxValueSize(8))
+		assert.True(errors.Is(err, ErrIncompatibleConfig))
+		err = db.Reconfigure(WithMaxKeySize(2))
+		assert.True(errors.Is(err, ErrIncompatibleConfig))
+		err = db.Reconfigure(WithModTimes())
+		assert.True(errors.Is(err, ErrIncompatibleConfig))
+		assert.Equal(ErrDatafileFormatChanged, db.Reconfigure(WithDatafileMagic()))
+
+		// Options changing other settings aren't ignored
+		err = db.Reconfigure(WithStrictDeletes())
+		assert.True(errors.Is(err, ErrIncompatibleConfig))
+		err = db.Reconfigure(WithSecondaryIndex("all", func(key, value []byte) [][]byte { return nil }))
+		assert.True(errors.Is(err, ErrIncompatibleConfig))
+		assert.Nil(db.config.SecondaryIndexes)
+
+		// Nothing was changed
+		assert.NoError(db.Put([]byte("baz"), bytes.Repeat([]byte("c"), 32)))
+	})
+
+	assert.NoError(db.Reconfigure(WithMaxValueSize(32), WithSyncInterval(0)))
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	val, err = db.Get([]byte("baz"))
+	assert.NoError(err)
+	assert.Equal(bytes.Repeat([]byte("c"), 32), val)
+	assert.Equal(ErrValueTooLarge, db.Put([]byte("baz"), bytes.Repeat([]byte("c"), 33)))
+
+	t.Run("SyncIntervalAndClose", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithSyncInterval(time.Millisecond))
+		assert.NoError(err)
+
+		// Restarting the syncer races with stopping it on Close()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				interval := time.Duration(i%2+1) * time.Millisecond
+				if db.Reconfigure(WithSyncInterval(interval)) != nil {
+					return
+				}
+			}
+		}()
+		assert.NoError(db.Close())
+		wg.Wait()
+
+		assert.Nil(db.syncStop)
+		assert.Equal(ErrDatabaseClosed, db.Reconfigure(WithNoIndexFile(true)))
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		// Concurrent calls don't undo each other's changes
+		var wg sync.WaitGroup
+		for _, opt := range []Option{WithMaxKeySize(64), WithSync(true), WithSyncInterval(time.Millisecond)} {
+			wg.Add(1)
+			go func(opt Option) {
+				defer wg.Done()
+				assert.NoError(db.Reconfigure(opt))
+			}(opt)
+		}
+		wg.Wait()
+
+		db.mu.RLock()
+		assert.Equal(uint32(64), db.config.MaxKeySize)
+		assert.True(db.config.Sync)
+		assert.Equal(time.Millisecond, db.config.SyncInterval)
+		db.mu.RUnlock()
+		assert.NotNil(db.syncStop)
+	})
+}
+
+func TestMergeFilesBefore(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	defer db.Close()
+
+	// Three entries of 22 bytes per datafile
+	for i := 0; i < 9; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("k%02d", i)), []byte("old")))
+	}
+	assert.NoError(db.Put([]byte("k00"), []byte("new")))
+	assert.NoError(db.Put([]byte("k01"), []byte("new")))
+	assert.NoError(db.Delete([]byte("k03")))
+
+	datafileIDs := func() (ids []int) {
+		infos, err := db.Datafiles()
+		assert.NoError(err)
+		for _, info := range infos {
+			ids = append(ids, info.ID)
+		}
+		return
+	}
+	assert.Equal([]int{0, 1, 2, 3}, datafileIDs())
+
+	kept, err := ioutil.ReadFile(filepath.Join(testdir, "000000002.data"))
+	assert.NoError(err)
+
+	assert.NoError(db.MergeFilesBefore(0))
+	assert.Equal([]int{0, 1, 2, 3}, datafileIDs())
+
+	// The live keys k02, k04 and k05 of the datafiles 0 and 1 fit in one
+	assert.NoError(db.MergeFilesBefore(2))
+	assert.Equal([]int{0, 2, 3}, datafileIDs())
+
+	data, err := ioutil.ReadFile(filepath.Join(testdir, "000000002.data"))
+	assert.NoError(err)
+	assert.Equal(kept, data)
+
+	check := func() {
+		assert.Equal(8, db.Len())
+		for i := 0; i < 9; i++ {
+			key := []byte(fmt.Sprintf("k%02d", i))
+			val, err := db.Get(key)
+			switch i {
+			case 0, 1:
+				assert.NoError(err)
+				assert.Equal([]byte("new"), val)
+			case 3:
+				assert.Equal(ErrKeyNotFound, err)
+			default:
+				assert.NoError(err)
+				assert.Equal([]byte("old"), val)
+			}
+		}
+	}
+	check()
+
+	// Merging past the current datafile merges all of them
+	assert.NoError(db.MergeFilesBefore(100))
+	assert.Equal([]int{0, 1, 2}, datafileIDs())
+	check()
+}
+
+func TestEntryAlignment(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	_, err = Open(testdir, WithEntryAlignment(0))
+	assert.Error(err)
+	_, err = Open(testdir, WithEntryAlignment(512))
+	assert.Error(err)
+
+	db, err := Open(testdir, WithEntryAlignment(64), WithDatafileMagic(), WithMaxDatafileSize(256))
+	assert.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("foo%d", i))
+		assert.NoError(db.Put(key, bytes.Repeat([]byte("a"), i*10+1)))
+
+		_, meta, err := db.GetWithMeta(key)
+		assert.NoError(err)
+		assert.Equal(int64(0), (meta.Offset+meta.Size)%64)
+	}
+	assert.NoError(db.PutWithTTL([]byte("ttl"), []byte("bar"), time.Hour))
+
+	check := func(db *Bitcask) {
+		for i := 0; i < 10; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("foo%d", i)))
+			assert.NoError(err)
+			assert.Equal(bytes.Repeat([]byte("a"), i*10+1), val)
+		}
+		val, err := db.Get([]byte("ttl"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	}
+	check(db)
+
+	assert.NoError(db.Merge())
+	check(db)
+	assert.NoError(db.Close())
+
+	// The padding is skipped without the option
+	db, err = Open(testdir, WithNoIndexFile(true))
+	assert.NoError(err)
+	defer db.Close()
+	check(db)
+}
+
+func TestRotate(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.Equal(0, db.CurrentDatafile())
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	assert.NoError(db.Rotate())
+	assert.Equal(1, db.CurrentDatafile())
+	assert.NoError(db.Put([]byte("baz"), []byte("qux")))
+
+	_, meta, err := db.GetWithMeta([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal(0, meta.FileID)
+	_, meta, err = db.GetWithMeta([]byte("baz"))
+	assert.NoError(err)
+	assert.Equal(1, meta.FileID)
+
+	// Datafiles before a rotation can be merged on their own
+	assert.NoError(db.Put([]byte("foo"), []byte("new")))
+	assert.NoError(db.Rotate())
+	assert.NoError(db.MergeFilesBefore(db.CurrentDatafile()))
+
+	infos, err := db.Datafiles()
+	assert.NoError(err)
+	if assert.Len(infos, 2) {
+		assert.Equal(2, infos[0].Entries)
+		assert.Equal(2, infos[1].ID)
+		assert.Equal(0, infos[1].Entries)
+	}
+
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("new"), val)
+	val, err = db.Get([]byte("baz"))
+	assert.NoError(err)
+	assert.Equal([]byte("qux"), val)
+}
+
+// faultyFS is a FS whose files fail writes, after writing half of the data,
+// while `fail` is set
+type faultyFS struct {
+	fs.FS
+	fail *bool
+}
+
+type faultyFile struct {
+	fs.File
+	fail *bool
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (f faultyFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return faultyFile{File: file, fail: f.fail}, nil
+}
+
+func (f faultyFile) Write(p []byte) (int, error) {
+	if *f.fail {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, errDiskFull
+	}
+	return f.File.Write(p)
+}
+
+func TestReadOnlyAfterError(t *testing.T) {
+	assert := assert.New(t)
+
+	var fail bool
+	db, err := Open("bitcask", WithFileSystem(faultyFS{FS: fs.NewMemFS(), fail: &fail}), WithReadOnlyAfterError())
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	fail = true
+	assert.True(errors.Is(db.Put([]byte("foo"), []byte("baz")), errDiskFull))
+	fail = false
+
+	assert.Equal(ErrReadOnly, db.Put([]byte("foo"), []byte("baz")))
+	assert.Equal(ErrReadOnly, db.Delete([]byte("foo")))
+	assert.Equal(ErrReadOnly, db.Rotate())
+	assert.Equal(ErrReadOnly, db.Merge())
+
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+
+	// The partially written entry is truncated on reset
+	assert.NoError(db.ResetReadOnly())
+	assert.NoError(db.Put([]byte("foo"), []byte("baz")))
+
+	val, err = db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("baz"), val)
+
+	report, err := db.Check()
+	assert.NoError(err)
+	assert.True(report.OK())
+
+	t.Run("Disabled", func(t *testing.T) {
+		var fail bool
+		db, err := Open("bitcask", WithFileSystem(faultyFS{FS: fs.NewMemFS(), fail: &fail}))
+		assert.NoError(err)
+		defer db.Close()
+
+		fail = true
+		assert.True(errors.Is(db.Put([]byte("foo"), []byte("bar")), errDiskFull))
+		fail = false
+		assert.NotEqual(ErrReadOnly, db.Put([]byte("foo"), []byte("bar")))
+	})
+}
+
+func TestScanPage(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	for _, key := range []string{"1", "2", "foo", "food", "fooz", "foozz", "hello"} {
+		assert.NoError(db.Put([]byte(key), []byte("bar")))
+	}
+
+	keys, next, err := db.ScanPage([]byte("foo"), nil, 2)
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("foo"), []byte("food")}, keys)
+	assert.Equal([]byte("food"), next)
+
+	keys, next, err = db.ScanPage([]byte("foo"), next, 2)
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("fooz"), []byte("foozz")}, keys)
+	assert.Nil(next)
+
+	keys, next, err = db.ScanPage([]byte("foo"), []byte("foozz"), 2)
+	assert.NoError(err)
+	assert.Empty(keys)
+	assert.Nil(next)
+
+	// A page that isn't full is the last one
+	keys, next, err = db.ScanPage(nil, []byte("fooz"), 10)
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("foozz"), []byte("hello")}, keys)
+	assert.Nil(next)
+
+	// The cursor needn't be an existing key
+	keys, _, err = db.ScanPage(nil, []byte("3"), 1)
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("foo")}, keys)
+
+	_, _, err = db.ScanPage(nil, nil, 0)
+	assert.Equal(ErrInvalidLimit, err)
+}
+
+// dirSyncFS is a FS counting the syncs of the directory `dir`
+type dirSyncFS struct {
+	fs.FS
+	dir   string
+	syncs *int
+}
+
+type dirSyncFile struct {
+	fs.File
+	syncs *int
+}
+
+func (f dirSyncFS) Open(name string) (fs.File, error) {
+	file, err := f.FS.Open(name)
+	if err != nil || name != f.dir {
+		return file, err
+	}
+	return dirSyncFile{File: file, syncs: f.syncs}, nil
+}
+
+func (f dirSyncFile) Sync() error {
+	*f.syncs++
+	return f.File.Sync()
+}
+
+func TestSyncDir(t *testing.T) {
+	assert := assert.New(t)
+
+	var syncs int
+	db, err := Open("bitcask", WithFileSystem(dirSyncFS{FS: fs.NewMemFS(), dir: "bitcask", syncs: &syncs}))
+	assert.NoError(err)
+	defer db.Close()
+
+	// Creating the first datafile syncs the directory
+	assert.Equal(1, syncs)
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.Sync())
+	assert.Equal(2, syncs)
 }
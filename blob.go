@@ -0,0 +1,301 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+const (
+	// blobsDir is the directory of the database holding the blob files of
+	// large values (see WithLargeValueThreshold)
+	blobsDir = "blobs"
+
+	blobExt = ".blob"
+)
+
+// errInvalidBlobRef is returned reading an entry whose blob reference is
+// malformed
+var errInvalidBlobRef = errors.New("error: invalid blob reference")
+
+// blobStore stores large values in blob files of their own, one per value,
+// which are referenced from the datafiles by their id. Blob files are never
+// modified once written; those no longer referenced are removed by Merge()
+// and GCBlobs().
+type blobStore struct {
+	fs   fs.FS
+	path string
+
+	mu      sync.Mutex
+	next    uint64
+	scanned bool
+}
+
+func newBlobStore(fsys fs.FS, path string) *blobStore {
+	return &blobStore{fs: fsys, path: filepath.Join(path, blobsDir)}
+}
+
+func (s *blobStore) filename(id uint64) string {
+	return filepath.Join(s.path, fmt.Sprintf("%09d%s", id, blobExt))
+}
+
+// ids returns the ids of the blob files on disk
+func (s *blobStore) ids() ([]uint64, error) {
+	sizes, err := s.sizes()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(sizes))
+	for id := range sizes {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// sizes returns the sizes of the blob files on disk by id
+func (s *blobStore) sizes() (map[uint64]int64, error) {
+	infos, err := s.fs.ReadDir(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	sizes := make(map[uint64]int64, len(infos))
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), blobExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), blobExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		sizes[id] = info.Size()
+	}
+	return sizes, nil
+}
+
+// write stores `value` in a new blob file synced to disk and returns the
+// reference to it
+func (s *blobStore) write(value []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.scanned {
+		ids, err := s.ids()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if id >= s.next {
+				s.next = id + 1
+			}
+		}
+		s.scanned = true
+	}
+
+	if err := s.fs.MkdirAll(s.path, 0755); err != nil {
+		return nil, err
+	}
+
+	id := s.next
+	fn := s.filename(id)
+	f, err := s.fs.OpenFile(fn, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.next++
+
+	if _, err = f.Write(value); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		s.fs.Remove(fn)
+		return nil, err
+	}
+
+	ref := make([]byte, 8)
+	binary.BigEndian.PutUint64(ref, id)
+	return ref, nil
+}
+
+// read returns the value of the blob file referenced by `ref`
+func (s *blobStore) read(ref []byte) ([]byte, error) {
+	id, err := blobID(ref)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(s.fs, s.filename(id))
+}
+
+// size returns the size of the value of the blob file referenced by `ref`
+func (s *blobStore) size(ref []byte) (int64, error) {
+	id, err := blobID(ref)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := s.fs.Stat(s.filename(id))
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// value returns the value of the entry `e`, reading it from its blob file if
+// it is stored in one
+func (s *blobStore) value(e internal.Entry) ([]byte, error) {
+	if !e.Blob {
+		return e.Value, nil
+	}
+	return s.read(e.Value)
+}
+
+// remove removes the blob files `ids`
+func (s *blobStore) remove(ids []uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		if err := s.fs.Remove(s.filename(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeUnreferenced removes the blob files whose id isn't in `refs`
+func (s *blobStore) removeUnreferenced(refs map[uint64]struct{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids, err := s.ids()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, ok := refs[id]; ok {
+			continue
+		}
+		if err := s.fs.Remove(s.filename(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAll removes all the blob files
+func (s *blobStore) removeAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return fs.RemoveAll(s.fs, s.path)
+}
+
+// BlobStats describes the blob files of the large values of a database (see
+// WithLargeValueThreshold)
+type BlobStats struct {
+	Files int
+	Size  int64
+
+	// DeadFiles is the number of blob files no longer referenced by any key,
+	// as their keys were overwritten or deleted, and DeadBytes is their size,
+	// which GCBlobs() or Merge() reclaim
+	DeadFiles int
+	DeadBytes int64
+}
+
+// BlobStats returns statistics about the blob files of the database. Finding
+// the blob files still referenced requires reading the entry of every key,
+// during which writes are blocked.
+func (b *Bitcask) BlobStats() (BlobStats, error) {
+	stats, _, err := b.blobGarbage()
+	return stats, err
+}
+
+// GCBlobs removes the blob files no longer referenced by any key (see
+// BlobStats) without merging the datafiles. Writes are only blocked while the
+// entry of every key is read to find the blob files still referenced. If a
+// merge is in progress ErrMergeInProgress is returned.
+//
+// The values of the blob files removed can no longer be read by Iterators
+// created before, nor as previous versions of their keys (see
+// WithReadRepair and WithMergeKeepVersions).
+func (b *Bitcask) GCBlobs() error {
+	if !atomic.CompareAndSwapInt32(&b.merging, 0, 1) {
+		return ErrMergeInProgress
+	}
+	defer atomic.StoreInt32(&b.merging, 0)
+
+	_, dead, err := b.blobGarbage()
+	if err != nil {
+		return err
+	}
+	return b.blobs.remove(dead)
+}
+
+// blobGarbage returns the statistics of the blob files and the ids of those
+// not referenced by any key, including expired keys. Blob files written after
+// the blob files are listed are never returned, so new values aren't removed
+// by GCBlobs().
+func (b *Bitcask) blobGarbage() (BlobStats, []uint64, error) {
+	var stats BlobStats
+
+	sizes, err := b.blobs.sizes()
+	if err != nil || len(sizes) == 0 {
+		return stats, nil, err
+	}
+
+	refs := make(map[uint64]struct{})
+	b.mu.RLock()
+	b.walkPrefix(nil, func(node art.Node) bool {
+		var e internal.Entry
+		if e, err = b.readEntry(node.Value().(internal.Item)); err != nil {
+			return false
+		}
+		if e.Blob {
+			if id, err := blobID(e.Value); err == nil {
+				refs[id] = struct{}{}
+			}
+		}
+		return true
+	})
+	b.mu.RUnlock()
+	if err != nil {
+		return stats, nil, err
+	}
+
+	var dead []uint64
+	for id, size := range sizes {
+		stats.Files++
+		stats.Size += size
+		if _, ok := refs[id]; !ok {
+			stats.DeadFiles++
+			stats.DeadBytes += size
+			dead = append(dead, id)
+		}
+	}
+	return stats, dead, nil
+}
+
+// blobID returns the id of the blob file referenced by `ref`
+func blobID(ref []byte) (uint64, error) {
+	if len(ref) != 8 {
+		return 0, errInvalidBlobRef
+	}
+	return binary.BigEndian.Uint64(ref), nil
+}
@@ -0,0 +1,141 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+)
+
+// CheckProblem is an inconsistency between the index and the datafiles
+// found by Check(). Key is the key as stored (including any key prefix).
+type CheckProblem struct {
+	Key    []byte
+	FileID int
+	Offset int64
+	Err    error
+}
+
+func (p CheckProblem) String() string {
+	return fmt.Sprintf("key %q at %d:%d: %v", p.Key, p.FileID, p.Offset, p.Err)
+}
+
+// CheckReport is the result of Check()
+type CheckReport struct {
+	// Keys is the number of keys of the index that were checked
+	Keys int
+
+	// Orphaned are keys of the index pointing to a missing datafile or past
+	// the end of their datafile
+	Orphaned []CheckProblem
+
+	// Corrupt are keys of the index pointing to an entry that can't be read
+	// (including its blob file, if any), is of another key or fails its
+	// checksum
+	Corrupt []CheckProblem
+
+	// Unindexed are the latest entries of live keys in the datafiles that
+	// the index doesn't point to
+	Unindexed []CheckProblem
+}
+
+// OK returns true if no inconsistencies were found
+func (r CheckReport) OK() bool {
+	return len(r.Orphaned) == 0 && len(r.Corrupt) == 0 && len(r.Unindexed) == 0
+}
+
+var (
+	errMissingDatafile = errors.New("datafile not found")
+	errPastEOF         = errors.New("entry past the end of the datafile")
+	errKeyMismatch     = errors.New("entry of another key")
+	errNotIndexed      = errors.New("live entry not in the index")
+)
+
+// Check verifies the consistency of the whole database: every key of the
+// index must point to a readable entry of that key with a valid checksum,
+// and the latest entry of every live key in the datafiles must be indexed.
+// Writes are blocked (reads carry on) while it reads every datafile in full,
+// so it should only be used to diagnose a database. An error is returned if the
+// datafiles can't be read at all.
+func (b *Bitcask) Check() (report CheckReport, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	b.trie.ForEach(func(node art.Node) bool {
+		report.Keys++
+
+		item := node.Value().(internal.Item)
+		problem := CheckProblem{Key: node.Key(), FileID: item.FileID, Offset: item.Offset}
+
+		var df data.Datafile
+		if item.FileID == b.curr.FileID() {
+			df = b.curr
+		} else if df = b.datafiles[item.FileID]; df == nil {
+			problem.Err = errMissingDatafile
+			report.Orphaned = append(report.Orphaned, problem)
+			return true
+		}
+
+		if item.Offset+item.Size > df.Size() {
+			problem.Err = errPastEOF
+			report.Orphaned = append(report.Orphaned, problem)
+			return true
+		}
+
+		var value []byte
+		e, err := df.ReadAt(item.Offset, item.Size)
+		if err == nil {
+			value, err = b.blobs.value(e)
+		}
+		switch {
+		case err != nil:
+			problem.Err = err
+		case !bytes.Equal(e.Key, node.Key()):
+			problem.Err = errKeyMismatch
+		case !e.Verify(value):
+			problem.Err = ErrChecksumFailed
+		default:
+			return true
+		}
+		report.Corrupt = append(report.Corrupt, problem)
+		return true
+	})
+
+	// Replay the datafiles to find the latest entry of every live key
+	live := art.New()
+	for _, id := range b.datafileIDs() {
+		err = b.scanDatafile(id, func(e internal.Entry, item internal.Item) error {
+			if len(e.Value) == 0 {
+				live.Delete(e.Key)
+			} else {
+				live.Insert(e.Key, item)
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	live.ForEach(func(node art.Node) bool {
+		item := node.Value().(internal.Item)
+		if value, found := b.trie.Search(node.Key()); found {
+			indexed := value.(internal.Item)
+			if indexed.FileID == item.FileID && indexed.Offset == item.Offset {
+				return true
+			}
+		}
+		report.Unindexed = append(report.Unindexed, CheckProblem{
+			Key:    node.Key(),
+			FileID: item.FileID,
+			Offset: item.Offset,
+			Err:    errNotIndexed,
+		})
+		return true
+	})
+
+	return
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/prologic/bitcask"
+)
+
+var checkCmd = &cobra.Command{
+	Use:     "check",
+	Aliases: []string{"fsck", "verify"},
+	Short:   "Checks the consistency of the Database",
+	Long: `This checks that every key of the index points to a readable entry of
+that key with a valid checksum in its datafile, and that the latest entry of
+every live key in the datafiles is indexed. Every inconsistency found is
+reported and the command exits with a non-zero status if there are any.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := viper.GetString("path")
+
+		os.Exit(check(path))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(checkCmd)
+}
+
+func check(path string) int {
+	db, err := bitcask.Open(path)
+	if err != nil {
+		log.WithError(err).Error("error opening database")
+		return 1
+	}
+	defer db.Close()
+
+	report, err := db.Check()
+	if err != nil {
+		log.WithError(err).Error("error checking database")
+		return 1
+	}
+
+	for _, problem := range report.Orphaned {
+		fmt.Printf("orphaned: %s\n", problem)
+	}
+	for _, problem := range report.Corrupt {
+		fmt.Printf("corrupt: %s\n", problem)
+	}
+	for _, problem := range report.Unindexed {
+		fmt.Printf("unindexed: %s\n", problem)
+	}
+
+	fmt.Printf(
+		"%d keys checked: %d orphaned, %d corrupt, %d unindexed\n",
+		report.Keys, len(report.Orphaned), len(report.Corrupt), len(report.Unindexed),
+	)
+
+	if !report.OK() {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/prologic/bitcask"
+	"github.com/prologic/bitcask/internal/config"
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+var infoCmd = &cobra.Command{
+	Use:     "info",
+	Aliases: []string{},
+	Short:   "Display information about the Database",
+	Long: `This displays the statistics of the Database (including the bytes a merge
+would reclaim), its configuration as persisted in config.json (if any) and the
+size and number of entries of every Datafile. The Database is only read, which
+fails while another process has it open.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := viper.GetString("path")
+
+		os.Exit(info(path))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(infoCmd)
+}
+
+// databaseInfo is the information displayed by the info command
+type databaseInfo struct {
+	Stats     bitcask.Stats
+	Config    *config.Config `json:",omitempty"`
+	Datafiles []bitcask.DatafileInfo
+}
+
+func info(path string) int {
+	var (
+		info databaseInfo
+		err  error
+	)
+
+	// Databases created WithoutConfigFile() have no config.json
+	configPath := filepath.Join(path, "config.json")
+	if fs.Exists(fs.OS, configPath) {
+		if info.Config, err = config.Load(fs.OS, configPath); err != nil {
+			log.WithError(err).Error("error loading config")
+			return 1
+		}
+	}
+
+	if info.Stats, info.Datafiles, err = bitcask.Inspect(path); err != nil {
+		log.WithError(err).Error("error inspecting database")
+		return 1
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		log.WithError(err).Error("error marshalling info")
+		return 1
+	}
+
+	fmt.Println(string(data))
+
+	return 0
+}
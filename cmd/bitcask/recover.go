@@ -1,15 +1,20 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 
+	art "github.com/plar/go-adaptive-radix-tree"
 	"github.com/prologic/bitcask"
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/config"
+	"github.com/prologic/bitcask/internal/data"
 	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/internal/fs"
 	"github.com/prologic/bitcask/internal/index"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -22,56 +27,142 @@ var recoveryCmd = &cobra.Command{
 	Short:   "Analyzes and recovers the index file for corruption scenarios",
 	Long: `This analyze files to detect different forms of persistence corruption in 
 persisted files. It also allows to recover the files to the latest point of integrity.
-Recovered files have the .recovered extension`,
+Recovered files have the .recovered extension and are written to the current
+directory, unless --in-place is given in which case the recovered index file
+atomically replaces the index file of the Database. The keys of a corrupted
+index file stored after the corruption are left out of the recovered one.`,
 	Args: cobra.ExactArgs(0),
 	PreRun: func(cmd *cobra.Command, args []string) {
 		viper.BindPFlag("dry-run", cmd.Flags().Lookup("dry-run"))
+		viper.BindPFlag("report-format", cmd.Flags().Lookup("report-format"))
+		viper.BindPFlag("in-place", cmd.Flags().Lookup("in-place"))
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		path := viper.GetString("path")
 		dryRun := viper.GetBool("dry-run")
-		os.Exit(recover(path, dryRun))
+		inPlace := viper.GetBool("in-place")
+		format := viper.GetString("report-format")
+
+		switch format {
+		case "":
+			os.Exit(recover(path, dryRun, inPlace, nil))
+		case "json":
+			var report recoveryReport
+			status := recover(path, dryRun, inPlace, &report)
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				log.WithError(err).Error("error marshalling report")
+				os.Exit(1)
+			}
+			fmt.Println(string(data))
+			os.Exit(status)
+		default:
+			log.Errorf("unsupported report format %q", format)
+			os.Exit(1)
+		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(recoveryCmd)
 	recoveryCmd.Flags().BoolP("dry-run", "n", false, "Will only check files health without applying recovery if unhealthy")
+	recoveryCmd.Flags().Bool("in-place", false, "Replace the index file of the Database with the recovered one")
+	recoveryCmd.Flags().String("report-format", "", "Print a report of what was found and recovered in the given format (json)")
+}
+
+// recoveryReport is the report of the recover command describing what was
+// found and recovered
+type recoveryReport struct {
+	DryRun    bool
+	Index     indexReport
+	Datafiles []datafileReport
+	Error     string
+}
+
+// indexReport describes the index file as found and recovered
+type indexReport struct {
+	Found     bool
+	Corrupted bool
+	// Offset is where the corruption starts and Keys the number of keys
+	// read before it, which are all the keys if the index isn't corrupted
+	Offset    int64
+	Keys      int
+	Recovered string
+}
+
+// datafileReport describes a datafile as found and recovered
+type datafileReport struct {
+	Path      string
+	Corrupted bool
+	// Offset is where the corruption starts (or the size of the datafile)
+	// and Entries the number of entries read before it. The DroppedBytes
+	// from Offset onwards are left out of the recovered datafile.
+	Offset       int64
+	Entries      int
+	DroppedBytes int64
+	Recovered    string
+	// FooterVerified is set if the datafile's footer checksum matched, in
+	// which case its entries weren't decoded and counted
+	FooterVerified bool
 }
 
-func recover(path string, dryRun bool) int {
+// recover checks and recovers the database at `path`, filling in `report` if
+// it isn't nil, and returns the exit status of the command
+func recover(path string, dryRun, inPlace bool, report *recoveryReport) int {
+	if report == nil {
+		report = &recoveryReport{}
+	}
+	report.DryRun = dryRun
+	fail := func(err error, msg string) int {
+		log.WithError(err).Info(msg)
+		report.Error = fmt.Sprintf("%s: %v", msg, err)
+		return 1
+	}
+
 	maxKeySize := bitcask.DefaultMaxKeySize
 	maxValueSize := bitcask.DefaultMaxValueSize
-	if cfg, err := config.Load(filepath.Join(path, "config.json")); err == nil {
+	noIndexFile := false
+	ext := bitcask.DefaultDatafileExtension
+	magic := false
+	if cfg, err := config.Load(fs.OS, filepath.Join(path, "config.json")); err == nil {
 		maxKeySize = cfg.MaxKeySize
 		maxValueSize = cfg.MaxValueSize
+		noIndexFile = cfg.NoIndexFile
+		if cfg.DatafileExt != "" {
+			ext = cfg.DatafileExt
+		}
+		magic = cfg.DatafileMagic
 	}
 
-	if err := recoverIndex(filepath.Join(path, "index"), maxKeySize, dryRun); err != nil {
-		log.WithError(err).Info("recovering index file")
-		return 1
+	if noIndexFile {
+		log.Debug("database has no index file, skipping index recovery")
+	} else if err := recoverIndex(filepath.Join(path, "index"), maxKeySize, dryRun, inPlace, &report.Index); err != nil {
+		return fail(err, "recovering index file")
 	}
 
-	datafiles, err := internal.GetDatafiles(path)
+	datafiles, err := internal.GetDatafiles(fs.OS, path, ext, magic)
 	if err != nil {
-		log.WithError(err).Info("coudn't list existing datafiles")
-		return 1
+		return fail(err, "coudn't list existing datafiles")
 	}
 	for _, file := range datafiles {
-		if err := recoverDatafile(file, maxKeySize, maxValueSize, dryRun); err != nil {
-			log.WithError(err).Info("recovering data file")
-			return 1
+		dr := datafileReport{Path: file}
+		err := recoverDatafile(file, maxKeySize, maxValueSize, magic, dryRun, &dr)
+		report.Datafiles = append(report.Datafiles, dr)
+		if err != nil {
+			return fail(err, "recovering data file")
 		}
 	}
 
 	return 0
 }
 
-func recoverIndex(path string, maxKeySize uint32, dryRun bool) error {
-	t, found, err := index.NewIndexer().Load(path, maxKeySize)
+func recoverIndex(path string, maxKeySize uint32, dryRun, inPlace bool, report *indexReport) error {
+	t, found, err := index.NewIndexer(fs.OS).Load(path, maxKeySize)
 	if err != nil && !index.IsIndexCorruption(err) {
 		log.WithError(err).Info("opening the index file")
 	}
+	report.Found = found
+	report.Keys = t.Size()
 	if !found {
 		log.Info("index file doesn't exist, will be recreated on next run.")
 		return nil
@@ -82,6 +173,11 @@ func recoverIndex(path string, maxKeySize uint32, dryRun bool) error {
 		return nil
 	}
 	log.Debugf("index file is corrupted: %v", err)
+	report.Corrupted = true
+	var cerr *index.CorruptionError
+	if errors.As(err, &cerr) {
+		report.Offset = cerr.Offset
+	}
 
 	if dryRun {
 		log.Debug("dry-run mode, not writing to a file")
@@ -89,43 +185,107 @@ func recoverIndex(path string, maxKeySize uint32, dryRun bool) error {
 	}
 
 	// Leverage that t has the partiatially read tree even on corrupted files
-	err = index.NewIndexer().Save(t, "index.recovered")
+	if inPlace {
+		return replaceIndex(path, t, report)
+	}
+	err = index.NewIndexer(fs.OS).Save(t, "index.recovered")
 	if err != nil {
 		return fmt.Errorf("writing the recovered index file: %w", err)
 	}
+	report.Recovered = "index.recovered"
 	log.Debug("the index was recovered in the index.recovered new file")
 
 	return nil
 }
 
-func recoverDatafile(path string, maxKeySize uint32, maxValueSize uint64, dryRun bool) error {
+// replaceIndex atomically replaces the index file at `path` with the index
+// `t` by writing it to a temporary file renamed over the index file
+func replaceIndex(path string, t art.Tree, report *indexReport) error {
+	tmp := path + ".recovered"
+	if err := index.NewIndexer(fs.OS).Save(t, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing the recovered index file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("replacing the index file: %w", err)
+	}
+	if err := fs.SyncDir(fs.OS, filepath.Dir(path)); err != nil {
+		return fmt.Errorf("syncing the database directory: %w", err)
+	}
+	report.Recovered = path
+	log.Debugf("the index was recovered in place in %s", path)
+
+	return nil
+}
+
+func recoverDatafile(path string, maxKeySize uint32, maxValueSize uint64, magic bool, dryRun bool, report *datafileReport) error {
+	_, file := filepath.Split(path)
+
+	// A datafile sealed with a footer is checked without decoding it
+	ok, err := data.VerifyFooter(fs.OS, path)
+	if err != nil && err != data.ErrFooterMismatch {
+		return fmt.Errorf("verifying the datafile footer: %w", err)
+	}
+	if ok && err == nil {
+		if stat, err := os.Stat(path); err == nil {
+			report.Offset = stat.Size() - codec.FooterSize
+		}
+		report.FooterVerified = true
+		log.Debugf("%s is not corrupted (footer verified)", file)
+		return nil
+	}
+	if err == data.ErrFooterMismatch {
+		log.Debugf("%s doesn't match its footer, decoding it", file)
+	}
+
 	f, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("opening the datafile: %w", err)
 	}
 	defer f.Close()
-	_, file := filepath.Split(path)
 	fr, err := os.OpenFile(fmt.Sprintf("%s.recovered", file), os.O_CREATE|os.O_WRONLY, os.ModePerm)
 	if err != nil {
 		return fmt.Errorf("creating the recovered datafile: %w", err)
 	}
 	defer fr.Close()
 
+	if magic {
+		// Carry the magic header over to the recovered datafile
+		header := make([]byte, len(internal.DatafileMagic))
+		if _, err := io.ReadFull(f, header); err != nil {
+			return fmt.Errorf("reading the datafile magic: %w", err)
+		}
+		if _, err := fr.Write(header); err != nil {
+			return fmt.Errorf("writing to recovered datafile: %w", err)
+		}
+		report.Offset = int64(len(header))
+	}
+
 	dec := codec.NewDecoder(f, maxKeySize, maxValueSize)
 	enc := codec.NewEncoder(fr)
 	e := internal.Entry{}
 	for {
-		_, err = dec.Decode(&e)
+		n, err := dec.Decode(&e)
 		if err == io.EOF {
 			break
 		}
-		if codec.IsCorruptedData(err) {
+		if err == io.ErrUnexpectedEOF || codec.IsCorruptedData(err) {
 			log.Debugf("%s is corrupted, a best-effort recovery was done", file)
+			report.Corrupted = true
+			if stat, err := f.Stat(); err == nil {
+				report.DroppedBytes = stat.Size() - report.Offset
+			}
+			if !dryRun {
+				report.Recovered = fr.Name()
+			}
 			return nil
 		}
 		if err != nil {
 			return fmt.Errorf("unexpected error while reading datafile: %w", err)
 		}
+		report.Offset += n
+		report.Entries++
 		if dryRun {
 			continue
 		}
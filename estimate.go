@@ -0,0 +1,86 @@
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/config"
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+// RecoveryEstimate describes how the index of a database is restored when it
+// is opened (see EstimateRecovery)
+type RecoveryEstimate struct {
+	// IndexFound is true if there is an index file, which is loaded instead
+	// of replaying the datafiles, and IndexBytes is its size
+	IndexFound bool
+	IndexBytes int64
+
+	// Replay is true if the index must be rebuilt by reading every entry
+	// of the datafiles
+	Replay bool
+
+	// Datafiles is the number of datafiles and ReplayBytes their total
+	// size, all of which are read when replaying
+	Datafiles   int
+	ReplayBytes int64
+
+	// MergePending is true if a committed Merge() is completed first,
+	// which replaces the datafiles and index file estimated here
+	MergePending bool
+}
+
+// EstimateRecovery estimates the work of opening the database at `path` with
+// the given options without opening or locking it, for example to choose an
+// open timeout (see WithOpenTimeout). The index is rebuilt from the datafiles
+// if there is no index file or WithNoIndexFile is given.
+func EstimateRecovery(path string, options ...Option) (RecoveryEstimate, error) {
+	var estimate RecoveryEstimate
+
+	opts, err := optionsConfig(options)
+	if err != nil {
+		return estimate, err
+	}
+	fsys := opts.FS
+
+	// The datafile format is as persisted by the database
+	cfg := newDefaultConfig()
+	configPath := filepath.Join(path, "config.json")
+	if !opts.NoConfigFile && fs.Exists(fsys, configPath) {
+		if cfg, err = config.Load(fsys, configPath); err != nil {
+			return estimate, err
+		}
+		if cfg.DatafileExt == "" {
+			cfg.DatafileExt = DefaultDatafileExtension
+		}
+	}
+	for _, opt := range options {
+		if err := opt(cfg); err != nil {
+			return estimate, err
+		}
+	}
+
+	estimate.MergePending = fs.Exists(fsys, filepath.Join(path, mergeCommitFilename))
+
+	stat, err := fsys.Stat(filepath.Join(path, "index"))
+	switch {
+	case err == nil:
+		estimate.IndexFound = true
+		estimate.IndexBytes = stat.Size()
+	case !os.IsNotExist(err):
+		return estimate, err
+	}
+	estimate.Replay = !estimate.IndexFound || cfg.NoIndexFile
+
+	fns, err := internal.GetDatafiles(fsys, path, cfg.DatafileExt, cfg.DatafileMagic)
+	if err != nil {
+		return estimate, err
+	}
+	estimate.Datafiles = len(fns)
+	if estimate.ReplayBytes, err = internal.DataSize(fsys, path, cfg.DatafileExt, cfg.DatafileMagic); err != nil {
+		return estimate, err
+	}
+
+	return estimate, nil
+}
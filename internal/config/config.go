@@ -2,8 +2,10 @@ package config
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"os"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
 )
 
 // Config contains the bitcask configuration parameters
@@ -12,13 +14,59 @@ type Config struct {
 	MaxKeySize      uint32 `json:"max_key_size"`
 	MaxValueSize    uint64 `json:"max_value_size"`
 	Sync            bool   `json:"sync"`
+	NoIndexFile     bool   `json:"no_index_file,omitempty"`
+	DatafileExt     string `json:"datafile_ext,omitempty"`
+	DatafileMagic   bool   `json:"datafile_magic,omitempty"`
+	ModTimes        bool   `json:"mod_times,omitempty"`
+
+	MergeKeepVersions int    `json:"-"`
+	KeyPrefix         []byte `json:"-"`
+	InitialCapacity   int    `json:"-"`
+	StrictDeletes     bool   `json:"-"`
+	ReadRepair        bool   `json:"-"`
+	NoMmap            bool   `json:"-"`
+	MaxOpenDatafiles  int    `json:"-"`
+	MaxDatafiles      int    `json:"-"`
+	DedupWrites       bool   `json:"-"`
+	NoDatafileSync    bool   `json:"-"`
+	NoVerifyChecksums bool   `json:"-"`
+	NoWriteChecksums  bool   `json:"-"`
+	MergeOnClose      bool   `json:"-"`
+	DatafileFooters   bool   `json:"-"`
+	VerifyFooters     bool   `json:"-"`
+	MergeVerify       bool   `json:"-"`
+	NoConfigFile      bool   `json:"-"`
+
+	MergeTargetFileSize int           `json:"-"`
+	MergeConcurrency    int           `json:"-"`
+	MergeVerifyKeyCount bool          `json:"-"`
+	PreallocateDatafile int           `json:"-"`
+	LargeValueThreshold int           `json:"-"`
+	EntryAlignment      int           `json:"-"`
+	ReadOnlyAfterError  bool          `json:"-"`
+	LockTimeout         time.Duration `json:"-"`
+	OpenTimeout         time.Duration `json:"-"`
+	SyncInterval        time.Duration `json:"-"`
+	MetricsInterval     time.Duration `json:"-"`
+	WriteTimeout        time.Duration `json:"-"`
+
+	MergeTrigger   func(internal.Stats) bool `json:"-"`
+	AutoMergeRatio float64                   `json:"-"`
+	Clock          func() time.Time          `json:"-"`
+	KeyNormalizer  func([]byte) []byte       `json:"-"`
+	Observer       internal.Observer         `json:"-"`
+	FS             fs.FS                     `json:"-"`
+
+	SecondaryIndexes map[string]func(key, value []byte) [][]byte `json:"-"`
+	MetricsLogf      func(string, ...interface{})                `json:"-"`
+	PanicHandler     func(interface{})                           `json:"-"`
 }
 
-// Load loads a configuration from the given path
-func Load(path string) (*Config, error) {
+// Load loads a configuration from the given path on `fsys`
+func Load(fsys fs.FS, path string) (*Config, error) {
 	var cfg Config
 
-	data, err := ioutil.ReadFile(path)
+	data, err := fs.ReadFile(fsys, path)
 	if err != nil {
 		return nil, err
 	}
@@ -30,25 +78,12 @@ func Load(path string) (*Config, error) {
 	return &cfg, nil
 }
 
-// Save saves the configuration to the provided path
-func (c *Config) Save(path string) error {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-
+// Save saves the configuration to the provided path on `fsys`
+func (c *Config) Save(fsys fs.FS, path string) error {
 	data, err := json.Marshal(c)
 	if err != nil {
 		return err
 	}
 
-	if _, err = f.Write(data); err != nil {
-		return err
-	}
-
-	if err = f.Sync(); err != nil {
-		return err
-	}
-
-	return f.Close()
+	return fs.WriteFile(fsys, path, data, 0600)
 }
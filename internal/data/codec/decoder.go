@@ -1,6 +1,7 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 
@@ -14,6 +15,11 @@ var (
 	errTruncatedData         = errors.New("data is truncated")
 )
 
+// maxPrealloc is the largest entry Decode allocates in full before reading
+// it; larger ones grow as they are read so a corrupt size can't exhaust the
+// memory
+const maxPrealloc = 1 << 20
+
 // NewDecoder creates a streaming Entry decoder.
 func NewDecoder(r io.Reader, maxKeySize uint32, maxValueSize uint64) *Decoder {
 	return &Decoder{
@@ -44,53 +50,164 @@ func (d *Decoder) Decode(v *internal.Entry) (int64, error) {
 		return 0, err
 	}
 
-	actualKeySize, actualValueSize, err := getKeyValueSizes(prefixBuf, d.maxKeySize, d.maxValueSize)
+	// The footer of a sealed datafile follows its last entry
+	if isFooterPrefix(prefixBuf) {
+		if _, err := io.ReadFull(d.r, make([]byte, checksumSize)); err != nil {
+			return 0, errTruncatedData
+		}
+		return 0, io.EOF
+	}
+
+	actualKeySize, actualValueSize, flags, err := getKeyValueSizes(prefixBuf, d.maxKeySize, d.maxValueSize)
 	if err != nil {
 		return 0, err
 	}
 
-	buf := make([]byte, uint64(actualKeySize)+actualValueSize+checksumSize)
-	if _, err = io.ReadFull(d.r, buf); err != nil {
+	size := uint64(actualKeySize) + actualValueSize + checksumSize
+	if flags&expiryFlag != 0 {
+		size += expirySize
+	}
+	if flags&modTimeFlag != 0 {
+		size += modTimeSize
+	}
+	if flags&tagFlag != 0 {
+		size += tagSize
+	}
+	size += paddingSize(flags)
+	buf, err := readN(d.r, size)
+	if err != nil {
 		return 0, errTruncatedData
 	}
 
-	decodeWithoutPrefix(buf, actualKeySize, v)
-	return int64(keySize + valueSize + uint64(actualKeySize) + actualValueSize + checksumSize), nil
+	if err := decodeWithoutPrefix(buf, actualKeySize, flags, v); err != nil {
+		return 0, err
+	}
+	return int64(keySize + valueSize + size), nil
 }
 
-// DecodeEntry decodes a serialized entry
+// DecodeEntry decodes a serialized entry, which must be the whole of `b`
 func DecodeEntry(b []byte, e *internal.Entry, maxKeySize uint32, maxValueSize uint64) error {
-	valueOffset, _, err := getKeyValueSizes(b, maxKeySize, maxValueSize)
+	if len(b) < keySize+valueSize {
+		return errTruncatedData
+	}
+
+	valueOffset, actualValueSize, flags, err := getKeyValueSizes(b, maxKeySize, maxValueSize)
 	if err != nil {
 		return errors.Wrap(err, "key/value sizes are invalid")
 	}
 
-	decodeWithoutPrefix(b[keySize+valueSize:], valueOffset, e)
+	// The sizes are only bounded by the configured maxima
+	if actualValueSize > uint64(len(b)) {
+		return errTruncatedData
+	}
+	size := uint64(valueOffset) + actualValueSize + uint64(Overhead(flags&expiryFlag != 0, flags&modTimeFlag != 0)) + paddingSize(flags)
+	if flags&tagFlag != 0 {
+		size += tagSize
+	}
+	if uint64(len(b)) != size {
+		return errTruncatedData
+	}
 
-	return nil
+	return decodeWithoutPrefix(b[keySize+valueSize:], valueOffset, flags, e)
 }
 
-func getKeyValueSizes(buf []byte, maxKeySize uint32, maxValueSize uint64) (uint32, uint64, error) {
+// readN reads exactly `n` bytes from `r`
+func readN(r io.Reader, n uint64) ([]byte, error) {
+	if n <= maxPrealloc {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// PrefixSize is the size of the key and value size prefix entries start with
+const PrefixSize = keySize + valueSize
+
+// DecodeValueSize returns the size of the value of the entry starting with
+// the prefix `prefix` (see PrefixSize) and whether the value is a reference
+// to a blob file rather than the value itself
+func DecodeValueSize(prefix []byte) (uint64, bool) {
+	size := binary.BigEndian.Uint64(prefix[keySize:PrefixSize])
+	flags := size & (expiryFlag | modTimeFlag | blobFlag | noChecksumFlag | tagFlag | paddingMask)
+	return size &^ flags, flags&blobFlag != 0
+}
+
+// getKeyValueSizes returns the key and value sizes of the prefix `buf` along
+// with the flags set in the value size
+func getKeyValueSizes(buf []byte, maxKeySize uint32, maxValueSize uint64) (uint32, uint64, uint64, error) {
 	actualKeySize := binary.BigEndian.Uint32(buf[:keySize])
 	actualValueSize := binary.BigEndian.Uint64(buf[keySize:])
 
+	flags := actualValueSize & (expiryFlag | modTimeFlag | blobFlag | noChecksumFlag | tagFlag | paddingMask)
+	actualValueSize &^= flags
+
 	if actualKeySize > maxKeySize || actualValueSize > maxValueSize || actualKeySize == 0 {
 
-		return 0, 0, errInvalidKeyOrValueSize
+		return 0, 0, 0, errInvalidKeyOrValueSize
 	}
 
-	return actualKeySize, actualValueSize, nil
+	return actualKeySize, actualValueSize, flags, nil
+}
+
+// paddingSize returns the length of the padding of an entry with the flags
+// `flags`
+func paddingSize(flags uint64) uint64 {
+	return (flags & paddingMask) >> paddingShift
 }
 
-func decodeWithoutPrefix(buf []byte, valueOffset uint32, v *internal.Entry) {
+// decodeWithoutPrefix decodes the entry `buf` following its key and value size
+// prefix, returning errTruncatedData if it is shorter than the key of
+// `valueOffset` bytes and what the flags `flags` add
+func decodeWithoutPrefix(buf []byte, valueOffset uint32, flags uint64, v *internal.Entry) error {
+	min := uint64(valueOffset) + checksumSize + paddingSize(flags)
+	if flags&modTimeFlag != 0 {
+		min += modTimeSize
+	}
+	if flags&expiryFlag != 0 {
+		min += expirySize
+	}
+	if flags&tagFlag != 0 {
+		min += tagSize
+	}
+	if uint64(len(buf)) < min {
+		return errTruncatedData
+	}
+
+	buf = buf[:uint64(len(buf))-paddingSize(flags)]
+	v.Tag = 0
+	if flags&tagFlag != 0 {
+		v.Tag = buf[len(buf)-tagSize]
+		buf = buf[:len(buf)-tagSize]
+	}
+	v.ModTime = 0
+	if flags&modTimeFlag != 0 {
+		v.ModTime = int64(binary.BigEndian.Uint64(buf[len(buf)-modTimeSize:]))
+		buf = buf[:len(buf)-modTimeSize]
+	}
+	v.Expiry = 0
+	if flags&expiryFlag != 0 {
+		v.Expiry = int64(binary.BigEndian.Uint64(buf[len(buf)-expirySize:]))
+		buf = buf[:len(buf)-expirySize]
+	}
+	v.Blob = flags&blobFlag != 0
+	v.NoChecksum = flags&noChecksumFlag != 0
 	v.Key = buf[:valueOffset]
 	v.Value = buf[valueOffset : len(buf)-checksumSize]
 	v.Checksum = binary.BigEndian.Uint32(buf[len(buf)-checksumSize:])
+	return nil
 }
 
 // IsCorruptedData indicates if the error correspondes to possible data corruption
 func IsCorruptedData(err error) bool {
-	switch err {
+	switch errors.Cause(err) {
 	case errCantDecodeOnNilEntry, errInvalidKeyOrValueSize, errTruncatedData:
 		return true
 	default:
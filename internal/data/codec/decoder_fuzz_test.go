@@ -0,0 +1,49 @@
+//go:build go1.18
+// +build go1.18
+
+package codec
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+func FuzzDecode(f *testing.F) {
+	for _, e := range []internal.Entry{
+		internal.NewEntry([]byte("foo"), []byte("bar")),
+		{Key: []byte("foo"), Value: []byte("bar"), Expiry: 1, ModTime: 2, Blob: true},
+		{Key: []byte("k"), Value: nil, NoChecksum: true},
+	} {
+		var buf bytes.Buffer
+		if _, err := NewEncoder(&buf).EncodeAligned(e, 0, 16); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes(), uint32(64), uint64(1<<16))
+	}
+	f.Add(EncodeFooter(42), uint32(64), uint64(1<<16))
+	f.Add([]byte{0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint32(math.MaxUint32), uint64(math.MaxUint64))
+
+	f.Fuzz(func(t *testing.T, b []byte, maxKeySize uint32, maxValueSize uint64) {
+		var e internal.Entry
+		dec := NewDecoder(bytes.NewReader(b), maxKeySize, maxValueSize)
+		for {
+			n, err := dec.Decode(&e)
+			if err != nil {
+				if err != io.EOF && err != io.ErrUnexpectedEOF && !IsCorruptedData(err) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				break
+			}
+			if n <= 0 || n > int64(len(b)) {
+				t.Fatalf("decoded %d bytes of %d", n, len(b))
+			}
+		}
+
+		// Decoding the whole buffer at once must not panic either
+		DecodeEntry(b, &e, maxKeySize, maxValueSize)
+	})
+}
@@ -3,7 +3,9 @@ package codec
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"io"
+	"math"
 	"testing"
 
 	"github.com/prologic/bitcask/internal"
@@ -107,3 +109,131 @@ func TestTruncatedData(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeEntrySize(t *testing.T) {
+	assert := assert.New(t)
+	maxKeySize, maxValueSize := uint32(10), uint64(20)
+
+	var buf bytes.Buffer
+	_, err := NewEncoder(&buf).Encode(internal.NewEntry([]byte("foo"), []byte("bar")))
+	assert.NoError(err)
+	data := buf.Bytes()
+
+	assert.NoError(DecodeEntry(data, &internal.Entry{}, maxKeySize, maxValueSize))
+
+	tests := []struct {
+		data []byte
+		name string
+	}{
+		{data: data[:keySize], name: "short prefix"},
+		{data: data[:len(data)-1], name: "truncated entry"},
+		{data: append(data[:len(data):len(data)], 0), name: "trailing bytes"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(errTruncatedData, DecodeEntry(test.data, &internal.Entry{}, maxKeySize, maxValueSize))
+		})
+	}
+}
+
+func TestDecodeUpstreamFormat(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// Two entries as laid out on disk by upstream prologic/bitcask:
+	// key size (uint32), value size (uint64), key, value, crc32 (uint32).
+	// The second entry is a tombstone (zero length value).
+	upstreamHex := "0000000500000000000000076d796b65796d7976616c7565000651bd" +
+		"00000003000000000000000062617a00000000"
+	data, err := hex.DecodeString(upstreamHex)
+	assert.NoError(err)
+
+	expected := []internal.Entry{
+		{Key: []byte("mykey"), Value: []byte("myvalue"), Checksum: 414141},
+		{Key: []byte("baz"), Value: []byte{}, Checksum: 0},
+	}
+
+	t.Run("Stream", func(t *testing.T) {
+		decoder := NewDecoder(bytes.NewBuffer(data), 32, 32)
+		for _, e := range expected {
+			var actual internal.Entry
+			n, err := decoder.Decode(&actual)
+			if assert.NoError(err) {
+				assert.Equal(int64(keySize+valueSize+len(e.Key)+len(e.Value)+checksumSize), n)
+				assert.Equal(e.Key, actual.Key)
+				assert.Equal(e.Value, actual.Value)
+				assert.Equal(e.Checksum, actual.Checksum)
+			}
+		}
+		_, err := decoder.Decode(&internal.Entry{})
+		assert.Equal(io.EOF, err)
+	})
+
+	t.Run("ReadAt", func(t *testing.T) {
+		var actual internal.Entry
+		size := keySize + valueSize + len(expected[0].Key) + len(expected[0].Value) + checksumSize
+		if assert.NoError(DecodeEntry(data[:size], &actual, 32, 32)) {
+			assert.Equal(expected[0].Key, actual.Key)
+			assert.Equal(expected[0].Value, actual.Value)
+			assert.Equal(expected[0].Checksum, actual.Checksum)
+		}
+	})
+
+	t.Run("ReEncode", func(t *testing.T) {
+		var buf bytes.Buffer
+		encoder := NewEncoder(&buf)
+		for _, e := range expected {
+			_, err := encoder.Encode(e)
+			assert.NoError(err)
+		}
+		assert.Equal(upstreamHex, hex.EncodeToString(buf.Bytes()))
+	})
+}
+
+func TestDecodeFooter(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	_, err := NewEncoder(&buf).Encode(internal.NewEntry([]byte("foo"), []byte("bar")))
+	assert.NoError(err)
+	footer := EncodeFooter(42)
+	assert.Len(footer, FooterSize)
+	buf.Write(footer)
+
+	checksum, ok := DecodeFooter(footer)
+	assert.True(ok)
+	assert.Equal(uint32(42), checksum)
+	_, ok = DecodeFooter(buf.Bytes()[:FooterSize])
+	assert.False(ok)
+
+	// The footer ends the entries
+	decoder := NewDecoder(&buf, 3, 3)
+	var e internal.Entry
+	_, err = decoder.Decode(&e)
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), e.Value)
+	_, err = decoder.Decode(&e)
+	assert.Equal(io.EOF, err)
+
+	// A footer without its checksum is truncated
+	decoder = NewDecoder(bytes.NewReader(footer[:FooterSize-1]), 3, 3)
+	_, err = decoder.Decode(&e)
+	assert.True(IsCorruptedData(err))
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// A value size beyond the end of the entry
+	b := []byte{0, 0, 0, 1, 0xf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xf0, 'k', 0, 0, 0, 0}
+	var e internal.Entry
+	err := DecodeEntry(b, &e, math.MaxUint32, math.MaxUint64)
+	assert.True(IsCorruptedData(err))
+
+	// A huge value size isn't allocated before it is read
+	_, err = NewDecoder(bytes.NewReader(b), math.MaxUint32, math.MaxUint64).Decode(&e)
+	assert.Equal(errTruncatedData, err)
+}
@@ -9,12 +9,63 @@ import (
 	"github.com/prologic/bitcask/internal"
 )
 
+var (
+	errKeySizeTooLarge  = errors.New("key size too large")
+	errInvalidAlignment = errors.New("alignment is invalid")
+)
+
 const (
-	keySize      = 4
+	keySize      = internal.KeySizeWidth
 	valueSize    = 8
 	checksumSize = 4
+	expirySize   = 8
+	modTimeSize  = 8
+	tagSize      = 1
+
+	// expiryFlag is set in the value size prefix of entries with an expiry,
+	// which is then stored after the checksum. Entries without an expiry are
+	// encoded exactly as before expiries were supported.
+	expiryFlag = uint64(1) << 63
+
+	// modTimeFlag is set in the value size prefix of entries with a
+	// modification time, which is then stored after the expiry (if any)
+	modTimeFlag = uint64(1) << 62
+
+	// blobFlag is set in the value size prefix of entries whose value is a
+	// reference to the blob file holding the actual value
+	blobFlag = uint64(1) << 61
+
+	// noChecksumFlag is set in the value size prefix of entries written
+	// without computing the checksum of their value
+	noChecksumFlag = uint64(1) << 60
+
+	// tagFlag is set in the value size prefix of entries with a tag, which
+	// is then stored after the modification time (if any). It limits value
+	// sizes to 2^51 bytes.
+	tagFlag = uint64(1) << 51
+
+	// paddingShift is the position in the value size prefix of the length of
+	// the zero padding appended to aligned entries (see EncodeAligned)
+	paddingShift = 52
+	paddingMask  = uint64(0xff) << paddingShift
+
+	// MaxAlignment is the largest alignment entries can be encoded with
+	MaxAlignment = 256
 )
 
+// Overhead returns the number of bytes used by an encoded entry in addition
+// to its key and value
+func Overhead(hasExpiry, hasModTime bool) int64 {
+	n := int64(keySize + valueSize + checksumSize)
+	if hasExpiry {
+		n += expirySize
+	}
+	if hasModTime {
+		n += modTimeSize
+	}
+	return n
+}
+
 // NewEncoder creates a streaming Entry encoder.
 func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{w: bufio.NewWriter(w)}
@@ -29,9 +80,54 @@ type Encoder struct {
 // Encode takes any Entry and streams it to the underlying writer.
 // Messages are framed with a key-length and value-length prefix.
 func (e *Encoder) Encode(msg internal.Entry) (int64, error) {
+	return e.encode(msg, 0)
+}
+
+// EncodeAligned encodes `msg` like Encode() padded so that, written at
+// `offset`, it ends on a multiple of `align` bytes (at most MaxAlignment).
+// The length of the padding is recorded in the value size prefix so the
+// decoder skips it.
+func (e *Encoder) EncodeAligned(msg internal.Entry, offset, align int64) (int64, error) {
+	if align < 0 || align > MaxAlignment {
+		return 0, errInvalidAlignment
+	}
+
+	var padding int64
+	if align > 1 {
+		size := int64(len(msg.Key)+len(msg.Value)) + Overhead(msg.Expiry != 0, msg.ModTime != 0)
+		if msg.Tag != 0 {
+			size += tagSize
+		}
+		padding = (align - (offset+size)%align) % align
+	}
+	return e.encode(msg, padding)
+}
+
+func (e *Encoder) encode(msg internal.Entry, padding int64) (int64, error) {
+	if uint64(len(msg.Key)) > internal.MaxKeySize {
+		return 0, errKeySizeTooLarge
+	}
+
+	valueSizeAndFlags := uint64(len(msg.Value)) | uint64(padding)<<paddingShift
+	if msg.Expiry != 0 {
+		valueSizeAndFlags |= expiryFlag
+	}
+	if msg.ModTime != 0 {
+		valueSizeAndFlags |= modTimeFlag
+	}
+	if msg.Blob {
+		valueSizeAndFlags |= blobFlag
+	}
+	if msg.NoChecksum {
+		valueSizeAndFlags |= noChecksumFlag
+	}
+	if msg.Tag != 0 {
+		valueSizeAndFlags |= tagFlag
+	}
+
 	var bufKeyValue = make([]byte, keySize+valueSize)
 	binary.BigEndian.PutUint32(bufKeyValue[:keySize], uint32(len(msg.Key)))
-	binary.BigEndian.PutUint64(bufKeyValue[keySize:keySize+valueSize], uint64(len(msg.Value)))
+	binary.BigEndian.PutUint64(bufKeyValue[keySize:keySize+valueSize], valueSizeAndFlags)
 	if _, err := e.w.Write(bufKeyValue); err != nil {
 		return 0, errors.Wrap(err, "failed writing key & value length prefix")
 	}
@@ -43,15 +139,49 @@ func (e *Encoder) Encode(msg internal.Entry) (int64, error) {
 		return 0, errors.Wrap(err, "failed writing value data")
 	}
 
-	bufChecksumSize := bufKeyValue[:checksumSize]
-	binary.BigEndian.PutUint32(bufChecksumSize, msg.Checksum)
-	if _, err := e.w.Write(bufChecksumSize); err != nil {
+	bufChecksum := make([]byte, checksumSize)
+	binary.BigEndian.PutUint32(bufChecksum, msg.Checksum)
+	if _, err := e.w.Write(bufChecksum); err != nil {
 		return 0, errors.Wrap(err, "failed writing checksum data")
 	}
 
+	n := int64(keySize + valueSize + len(msg.Key) + len(msg.Value) + checksumSize)
+
+	if msg.Expiry != 0 {
+		bufExpiry := make([]byte, expirySize)
+		binary.BigEndian.PutUint64(bufExpiry, uint64(msg.Expiry))
+		if _, err := e.w.Write(bufExpiry); err != nil {
+			return 0, errors.Wrap(err, "failed writing expiry data")
+		}
+		n += expirySize
+	}
+
+	if msg.ModTime != 0 {
+		bufModTime := make([]byte, modTimeSize)
+		binary.BigEndian.PutUint64(bufModTime, uint64(msg.ModTime))
+		if _, err := e.w.Write(bufModTime); err != nil {
+			return 0, errors.Wrap(err, "failed writing modification time data")
+		}
+		n += modTimeSize
+	}
+
+	if msg.Tag != 0 {
+		if err := e.w.WriteByte(msg.Tag); err != nil {
+			return 0, errors.Wrap(err, "failed writing tag")
+		}
+		n += tagSize
+	}
+
+	if padding > 0 {
+		if _, err := e.w.Write(make([]byte, padding)); err != nil {
+			return 0, errors.Wrap(err, "failed writing padding")
+		}
+		n += padding
+	}
+
 	if err := e.w.Flush(); err != nil {
 		return 0, errors.Wrap(err, "failed flushing data")
 	}
 
-	return int64(keySize + valueSize + len(msg.Key) + len(msg.Value) + checksumSize), nil
+	return n, nil
 }
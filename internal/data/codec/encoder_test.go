@@ -2,6 +2,7 @@ package codec
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"testing"
 
@@ -27,3 +28,208 @@ func TestEncode(t *testing.T) {
 		assert.Equal(expectedHex, hex.EncodeToString(buf.Bytes()))
 	}
 }
+
+func TestEncodeLayout(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	key := []byte("foo")
+	value := []byte("bar")
+	checksum := uint32(0xdeadbeef)
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	n, err := encoder.Encode(internal.Entry{Key: key, Value: value, Checksum: checksum})
+	assert.NoError(err)
+
+	expected := make([]byte, keySize+valueSize+len(key)+len(value)+checksumSize)
+	binary.BigEndian.PutUint32(expected, uint32(len(key)))
+	binary.BigEndian.PutUint64(expected[keySize:], uint64(len(value)))
+	copy(expected[keySize+valueSize:], key)
+	copy(expected[keySize+valueSize+len(key):], value)
+	binary.BigEndian.PutUint32(expected[keySize+valueSize+len(key)+len(value):], checksum)
+
+	assert.Equal(int64(len(expected)), n)
+	assert.Equal(expected, buf.Bytes())
+
+	var e internal.Entry
+	if assert.NoError(DecodeEntry(buf.Bytes(), &e, 32, 32)) {
+		assert.Equal(key, e.Key)
+		assert.Equal(value, e.Value)
+		assert.Equal(checksum, e.Checksum)
+	}
+}
+
+func TestEncodeExpiry(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	n, err := encoder.Encode(internal.Entry{Key: []byte("foo"), Value: []byte("bar"), Checksum: 42, Expiry: 1234567890})
+	assert.NoError(err)
+	assert.Equal(int64(keySize+valueSize+6+checksumSize+expirySize), n)
+	assert.Equal(Overhead(true, false)+6, n)
+	assert.Equal(int64(buf.Len()), n)
+
+	var e internal.Entry
+	if assert.NoError(DecodeEntry(buf.Bytes(), &e, 32, 32)) {
+		assert.Equal([]byte("foo"), e.Key)
+		assert.Equal([]byte("bar"), e.Value)
+		assert.Equal(uint32(42), e.Checksum)
+		assert.Equal(int64(1234567890), e.Expiry)
+	}
+
+	e = internal.Entry{}
+	m, err := NewDecoder(&buf, 32, 32).Decode(&e)
+	assert.NoError(err)
+	assert.Equal(n, m)
+	assert.Equal([]byte("bar"), e.Value)
+	assert.Equal(int64(1234567890), e.Expiry)
+}
+
+func TestEncodeModTime(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	n, err := encoder.Encode(internal.Entry{Key: []byte("foo"), Value: []byte("bar"), Checksum: 42, Expiry: 1234567890, ModTime: 987654321})
+	assert.NoError(err)
+	assert.Equal(Overhead(true, true)+6, n)
+	assert.Equal(int64(buf.Len()), n)
+
+	var e internal.Entry
+	if assert.NoError(DecodeEntry(buf.Bytes(), &e, 32, 32)) {
+		assert.Equal([]byte("bar"), e.Value)
+		assert.Equal(uint32(42), e.Checksum)
+		assert.Equal(int64(1234567890), e.Expiry)
+		assert.Equal(int64(987654321), e.ModTime)
+	}
+
+	buf.Reset()
+	n, err = encoder.Encode(internal.Entry{Key: []byte("foo"), Value: []byte("bar"), Checksum: 42, ModTime: 987654321})
+	assert.NoError(err)
+	assert.Equal(Overhead(false, true)+6, n)
+
+	e = internal.Entry{}
+	m, err := NewDecoder(&buf, 32, 32).Decode(&e)
+	assert.NoError(err)
+	assert.Equal(n, m)
+	assert.Equal([]byte("bar"), e.Value)
+	assert.Equal(int64(0), e.Expiry)
+	assert.Equal(int64(987654321), e.ModTime)
+}
+
+func TestEncodeBlob(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	n, err := NewEncoder(&buf).Encode(internal.Entry{Key: []byte("foo"), Value: []byte("ref"), Checksum: 42, Blob: true})
+	assert.NoError(err)
+	assert.Equal(Overhead(false, false)+6, n)
+
+	var e internal.Entry
+	if assert.NoError(DecodeEntry(buf.Bytes(), &e, 32, 32)) {
+		assert.True(e.Blob)
+		assert.Equal([]byte("ref"), e.Value)
+		assert.Equal(uint32(42), e.Checksum)
+		assert.Equal(int64(0), e.Expiry)
+	}
+
+	buf.Reset()
+	_, err = NewEncoder(&buf).Encode(internal.Entry{Key: []byte("foo"), Value: []byte("bar"), Checksum: 42})
+	assert.NoError(err)
+
+	e = internal.Entry{}
+	if assert.NoError(DecodeEntry(buf.Bytes(), &e, 32, 32)) {
+		assert.False(e.Blob)
+	}
+}
+
+func TestEncodeNoChecksum(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	n, err := NewEncoder(&buf).Encode(internal.Entry{Key: []byte("foo"), Value: []byte("bar"), NoChecksum: true})
+	assert.NoError(err)
+	assert.Equal(Overhead(false, false)+6, n)
+
+	var e internal.Entry
+	if assert.NoError(DecodeEntry(buf.Bytes(), &e, 32, 32)) {
+		assert.True(e.NoChecksum)
+		assert.Equal([]byte("bar"), e.Value)
+	}
+}
+
+func TestEncodeTag(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	n, err := NewEncoder(&buf).Encode(internal.Entry{Key: []byte("foo"), Value: []byte("bar"), Checksum: 42, Expiry: 1234567890, Tag: 3})
+	assert.NoError(err)
+	assert.Equal(Overhead(true, false)+tagSize+6, n)
+
+	var e internal.Entry
+	if assert.NoError(DecodeEntry(buf.Bytes(), &e, 32, 32)) {
+		assert.Equal(uint8(3), e.Tag)
+		assert.Equal([]byte("bar"), e.Value)
+		assert.Equal(int64(1234567890), e.Expiry)
+	}
+
+	// Untagged entries are encoded as before
+	buf.Reset()
+	n, err = NewEncoder(&buf).Encode(internal.Entry{Key: []byte("foo"), Value: []byte("bar"), Checksum: 42})
+	assert.NoError(err)
+	assert.Equal(Overhead(false, false)+6, n)
+
+	e = internal.Entry{Tag: 3}
+	m, err := NewDecoder(&buf, 32, 32).Decode(&e)
+	assert.NoError(err)
+	assert.Equal(n, m)
+	assert.Equal(uint8(0), e.Tag)
+}
+
+func TestEncodeAligned(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+
+	entries := []internal.Entry{
+		{Key: []byte("foo"), Value: []byte("bar"), Checksum: 42},
+		{Key: []byte("foo"), Value: bytes.Repeat([]byte("a"), 100), Checksum: 42, Expiry: 1234567890},
+		{Key: []byte("foo"), Value: []byte("bar"), Checksum: 42, ModTime: 987654321},
+		{Key: []byte("foo"), Value: []byte("bar"), Checksum: 42, ModTime: 987654321, Tag: 7},
+	}
+
+	var sizes []int64
+	for _, e := range entries {
+		n, err := encoder.EncodeAligned(e, int64(buf.Len())+3, 64)
+		assert.NoError(err)
+		assert.Equal(int64(0), (int64(buf.Len())+3)%64)
+		sizes = append(sizes, n)
+	}
+
+	decoder := NewDecoder(bytes.NewReader(buf.Bytes()), 32, 128)
+	offset := int64(0)
+	for i, expected := range entries {
+		var e internal.Entry
+		n, err := decoder.Decode(&e)
+		assert.NoError(err)
+		assert.Equal(sizes[i], n)
+		assert.Equal(expected, e)
+
+		e = internal.Entry{}
+		assert.NoError(DecodeEntry(buf.Bytes()[offset:offset+n], &e, 32, 128))
+		assert.Equal(expected, e)
+		offset += n
+	}
+
+	_, err := encoder.EncodeAligned(entries[0], 0, MaxAlignment+1)
+	assert.Equal(errInvalidAlignment, err)
+}
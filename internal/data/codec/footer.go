@@ -0,0 +1,37 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// FooterSize is the size of the footer sealed datafiles end with
+const FooterSize = keySize + valueSize + checksumSize
+
+// footerMarker follows the zero key size starting a footer, which no entry
+// starts with, in place of the value size
+var footerMarker = []byte("bcfooter")
+
+// EncodeFooter returns the footer of a sealed datafile whose contents before
+// the footer have the CRC `checksum`
+func EncodeFooter(checksum uint32) []byte {
+	b := make([]byte, FooterSize)
+	copy(b[keySize:], footerMarker)
+	binary.BigEndian.PutUint32(b[keySize+valueSize:], checksum)
+	return b
+}
+
+// DecodeFooter returns the checksum recorded in the footer `b` and whether
+// `b` is a footer at all
+func DecodeFooter(b []byte) (uint32, bool) {
+	if len(b) != FooterSize || !isFooterPrefix(b) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b[keySize+valueSize:]), true
+}
+
+// isFooterPrefix returns true if the key and value size prefix `prefix`
+// starts a footer rather than an entry
+func isFooterPrefix(prefix []byte) bool {
+	return binary.BigEndian.Uint32(prefix[:keySize]) == 0 && bytes.Equal(prefix[keySize:keySize+valueSize], footerMarker)
+}
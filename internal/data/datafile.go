@@ -2,6 +2,10 @@ package data
 
 import (
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
@@ -9,16 +13,25 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/internal/fs"
 	"golang.org/x/exp/mmap"
 )
 
 const (
-	defaultDatafileFilename = "%09d.data"
+	datafileFilename = "%09d"
 )
 
 var (
-	errReadonly  = errors.New("error: read only datafile")
-	errReadError = errors.New("error: read error")
+	// ErrShortRead is the error returned by ReadAt when the datafile ends
+	// before the entry read
+	ErrShortRead = errors.New("error: short read")
+
+	// ErrFooterMismatch is the error returned by VerifyFooter when the
+	// contents of a sealed datafile don't match the checksum of its footer
+	ErrFooterMismatch = errors.New("error: datafile footer checksum mismatch")
+
+	errReadonly = errors.New("error: read only datafile")
+	errBadMagic = errors.New("error: datafile magic mismatch")
 
 	mxMemPool sync.RWMutex
 )
@@ -32,42 +45,70 @@ type Datafile interface {
 	Size() int64
 	Read() (internal.Entry, int64, error)
 	ReadAt(index, size int64) (internal.Entry, error)
+	ReadValueSize(index int64) (int64, bool, error)
 	Write(internal.Entry) (int64, int64, error)
+	WriteRaw([]byte) (int64, int64, error)
+	Seal() error
 }
 
 type datafile struct {
 	sync.RWMutex
 
 	id           int
-	r            *os.File
-	ra           *mmap.ReaderAt
-	w            *os.File
+	name         string
+	r            io.ReaderAt
+	w            io.Writer
+	closers      []io.Closer
 	offset       int64
+	roffset      int64
 	dec          *codec.Decoder
 	enc          *codec.Encoder
 	maxKeySize   uint32
 	maxValueSize uint64
+	preallocated bool
+	align        int64
+	crc          hash.Hash32
 }
 
-// NewDatafile opens an existing datafile
-func NewDatafile(path string, id int, readonly bool, maxKeySize uint32, maxValueSize uint64) (Datafile, error) {
+// NewDatafile opens an existing datafile on `fsys`. Readonly datafiles are
+// memory mapped for reads unless `noMmap` is true or `fsys` isn't the file
+// system of the operating system. The datafile's name is its id followed by
+// `ext`. If `magic` is true, new datafiles are written with the
+// internal.DatafileMagic header and existing ones must start with it. If
+// `preallocate` is greater than zero, disk space for that many bytes is
+// reserved for writable datafiles (see fs.Preallocate) and released again
+// when they are closed. If `align` is greater than one, the entries written
+// are padded to end on a multiple of `align` bytes (see codec.EncodeAligned).
+// If `footer` is true, writable datafiles are sealed with a footer holding the
+// checksum of their contents (see Seal). The footer of a readonly datafile is
+// not part of its Size and that of a writable one is removed.
+func NewDatafile(fsys fs.FS, path string, id int, readonly bool, maxKeySize uint32, maxValueSize uint64, noMmap bool, ext string, magic bool, preallocate, align int64, footer bool) (Datafile, error) {
 	var (
-		r   *os.File
-		ra  *mmap.ReaderAt
-		w   *os.File
+		r   fs.File
+		w   fs.File
 		err error
 	)
 
-	fn := filepath.Join(path, fmt.Sprintf(defaultDatafileFilename, id))
+	fn := filepath.Join(path, fmt.Sprintf(datafileFilename, id)+ext)
 
 	if !readonly {
-		w, err = os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		w, err = fsys.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
 		if err != nil {
 			return nil, err
 		}
+		if magic {
+			if err := writeMagic(w); err != nil {
+				return nil, err
+			}
+		}
+		if preallocate > 0 {
+			if err := fs.Preallocate(w, preallocate); err != nil {
+				return nil, errors.Wrap(err, "error preallocating datafile")
+			}
+		}
 	}
 
-	r, err = os.Open(fn)
+	r, err = fsys.Open(fn)
 	if err != nil {
 		return nil, err
 	}
@@ -76,27 +117,108 @@ func NewDatafile(path string, id int, readonly bool, maxKeySize uint32, maxValue
 		return nil, errors.Wrap(err, "error calling Stat()")
 	}
 
-	ra, err = mmap.Open(fn)
+	var roffset int64
+	if magic {
+		// Start reading entries after the header
+		header := make([]byte, len(internal.DatafileMagic))
+		if _, err := r.ReadAt(header, 0); err != nil || string(header) != internal.DatafileMagic {
+			r.Close()
+			return nil, errBadMagic
+		}
+		roffset = int64(len(header))
+	}
+
+	df := &datafile{
+		id:           id,
+		name:         fn,
+		r:            r,
+		closers:      []io.Closer{r},
+		offset:       stat.Size(),
+		roffset:      roffset,
+		maxKeySize:   maxKeySize,
+		maxValueSize: maxValueSize,
+		preallocated: !readonly && preallocate > 0,
+		align:        align,
+	}
+
+	// Only readonly datafiles are read through the memory map, which
+	// fails reads of empty files
+	if readonly && !noMmap && fs.IsOS(fsys) && stat.Size() > 0 {
+		ra, err := mmap.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		df.r = ra
+		df.closers = append(df.closers, ra)
+	}
+
+	size, err := sealedSize(df.r, df.offset)
 	if err != nil {
+		df.Close()
 		return nil, err
 	}
 
-	offset := stat.Size()
+	if readonly {
+		df.offset = size
+	} else {
+		// A writable datafile is only sealed if it was about to be
+		// replaced by the next one, so resume writing it in place
+		if size != df.offset {
+			df.offset = size
+			if err := w.Truncate(df.offset); err != nil {
+				r.Close()
+				return nil, errors.Wrap(err, "error removing datafile footer")
+			}
+		}
+		df.w = w
+		if footer {
+			df.crc = crc32.NewIEEE()
+			if _, err := io.Copy(df.crc, io.NewSectionReader(r, 0, df.offset)); err != nil {
+				r.Close()
+				return nil, errors.Wrap(err, "error reading datafile")
+			}
+		}
+	}
 
-	dec := codec.NewDecoder(r, maxKeySize, maxValueSize)
-	enc := codec.NewEncoder(w)
+	df.init()
+	return df, nil
+}
 
-	return &datafile{
+// NewDatafileFrom returns the datafile `id` reading the `size` bytes of
+// entries in `r` and, unless `w` is nil, writing entries by appending them
+// to `w`, which must be visible to `r`. This doesn't need a file system or a
+// memory map, for example to test reading and writing entries in memory.
+// Closing the datafile closes `r` and `w` if they are io.Closers and Sync()
+// syncs `w` if it has a Sync method. See NewDatafile for the other
+// arguments.
+func NewDatafileFrom(id int, r io.ReaderAt, size int64, w io.Writer, maxKeySize uint32, maxValueSize uint64) Datafile {
+	df := &datafile{
 		id:           id,
 		r:            r,
-		ra:           ra,
 		w:            w,
-		offset:       offset,
-		dec:          dec,
-		enc:          enc,
+		offset:       size,
 		maxKeySize:   maxKeySize,
 		maxValueSize: maxValueSize,
-	}, nil
+	}
+	if c, ok := r.(io.Closer); ok {
+		df.closers = append(df.closers, c)
+	}
+	df.init()
+	return df
+}
+
+// init creates the decoder reading entries sequentially from `roffset` and
+// the encoder appending entries
+func (df *datafile) init() {
+	df.dec = codec.NewDecoder(io.NewSectionReader(df.r, df.roffset, math.MaxInt64-df.roffset), df.maxKeySize, df.maxValueSize)
+	if df.w == nil {
+		return
+	}
+	if df.crc != nil {
+		df.enc = codec.NewEncoder(io.MultiWriter(df.w, df.crc))
+	} else {
+		df.enc = codec.NewEncoder(df.w)
+	}
 }
 
 func (df *datafile) FileID() int {
@@ -104,13 +226,14 @@ func (df *datafile) FileID() int {
 }
 
 func (df *datafile) Name() string {
-	return df.r.Name()
+	return df.name
 }
 
 func (df *datafile) Close() error {
 	defer func() {
-		df.ra.Close()
-		df.r.Close()
+		for i := len(df.closers) - 1; i >= 0; i-- {
+			df.closers[i].Close()
+		}
 	}()
 
 	// Readonly datafile -- Nothing further to close on the write side
@@ -122,14 +245,46 @@ func (df *datafile) Close() error {
 	if err != nil {
 		return err
 	}
-	return df.w.Close()
+
+	// Release the space reserved beyond what was written
+	if df.preallocated {
+		if err := df.w.(fs.File).Truncate(df.offset); err != nil {
+			return err
+		}
+	}
+
+	if c, ok := df.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
-func (df *datafile) Sync() error {
+// Seal closes the writable datafile after writing its footer, if it was
+// opened with one, so that its integrity can be verified with VerifyFooter.
+// No more entries can be written to it once sealed.
+func (df *datafile) Seal() error {
 	if df.w == nil {
-		return nil
+		return errReadonly
+	}
+
+	df.Lock()
+	if df.crc != nil {
+		if _, err := df.w.Write(codec.EncodeFooter(df.crc.Sum32())); err != nil {
+			df.Unlock()
+			return err
+		}
+		df.offset += codec.FooterSize
 	}
-	return df.w.Sync()
+	df.Unlock()
+
+	return df.Close()
+}
+
+func (df *datafile) Sync() error {
+	if s, ok := df.w.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
 }
 
 func (df *datafile) Size() int64 {
@@ -138,7 +293,8 @@ func (df *datafile) Size() int64 {
 	return df.offset
 }
 
-// Read reads the next entry from the datafile
+// Read reads the next entry from the datafile. The entry's Offset is set to
+// its position in the datafile.
 func (df *datafile) Read() (e internal.Entry, n int64, err error) {
 	df.Lock()
 	defer df.Unlock()
@@ -147,34 +303,57 @@ func (df *datafile) Read() (e internal.Entry, n int64, err error) {
 	if err != nil {
 		return
 	}
+	e.Offset = df.roffset
+	df.roffset += n
 
 	return
 }
 
+// seek makes Read() read the entry located at `offset` next. It is only used
+// with readonly datafiles.
+func (df *datafile) seek(offset int64) {
+	df.Lock()
+	defer df.Unlock()
+
+	if offset == df.roffset {
+		return
+	}
+	df.roffset = offset
+	df.init()
+}
+
 // ReadAt the entry located at index offset with expected serialized size
 func (df *datafile) ReadAt(index, size int64) (e internal.Entry, err error) {
-	var n int
-
 	b := make([]byte, size)
 
-	if df.w == nil {
-		n, err = df.ra.ReadAt(b, index)
-	} else {
-		n, err = df.r.ReadAt(b, index)
-	}
-	if err != nil {
-		return
-	}
+	n, err := df.r.ReadAt(b, index)
 	if int64(n) != size {
-		err = errReadError
+		if err == nil || err == io.EOF {
+			err = ErrShortRead
+		}
 		return
 	}
 
-	codec.DecodeEntry(b, &e, df.maxKeySize, df.maxValueSize)
+	err = codec.DecodeEntry(b, &e, df.maxKeySize, df.maxValueSize)
 
 	return
 }
 
+// ReadValueSize reads the value size of the entry located at index offset
+// from its header, along with whether its value is a blob reference
+func (df *datafile) ReadValueSize(index int64) (int64, bool, error) {
+	b := make([]byte, codec.PrefixSize)
+	if n, err := df.r.ReadAt(b, index); n != len(b) {
+		if err == nil || err == io.EOF {
+			err = ErrShortRead
+		}
+		return 0, false, err
+	}
+
+	size, blob := codec.DecodeValueSize(b)
+	return int64(size), blob, nil
+}
+
 func (df *datafile) Write(e internal.Entry) (int64, int64, error) {
 	if df.w == nil {
 		return -1, 0, errReadonly
@@ -185,11 +364,123 @@ func (df *datafile) Write(e internal.Entry) (int64, int64, error) {
 
 	e.Offset = df.offset
 
-	n, err := df.enc.Encode(e)
+	n, err := df.enc.EncodeAligned(e, df.offset, df.align)
 	if err != nil {
+		// The checksum no longer matches what was written
+		df.crc = nil
 		return -1, 0, err
 	}
 	df.offset += n
 
 	return e.Offset, n, nil
 }
+
+// WriteRaw appends the encoded entry `b` as it is, without padding it. The
+// caller must have checked that `b` is a valid entry (see codec.DecodeEntry).
+func (df *datafile) WriteRaw(b []byte) (int64, int64, error) {
+	if df.w == nil {
+		return -1, 0, errReadonly
+	}
+
+	df.Lock()
+	defer df.Unlock()
+
+	w := df.w
+	if df.crc != nil {
+		w = io.MultiWriter(df.w, df.crc)
+	}
+
+	offset := df.offset
+	n, err := w.Write(b)
+	if err != nil {
+		// The checksum no longer matches what was written
+		df.crc = nil
+		return -1, 0, err
+	}
+	df.offset += int64(n)
+
+	return offset, int64(n), nil
+}
+
+// writeMagic writes the datafile magic header to `w` if the file is empty
+func writeMagic(w fs.File) error {
+	stat, err := w.Stat()
+	if err != nil {
+		return errors.Wrap(err, "error calling Stat()")
+	}
+	if stat.Size() > 0 {
+		return nil
+	}
+	_, err = w.Write([]byte(internal.DatafileMagic))
+	return err
+}
+
+// VerifyFooter checks the datafile `name` on `fsys` against the checksum in
+// its footer, returning false if it has no footer and ErrFooterMismatch if
+// its contents don't match it.
+func VerifyFooter(fsys fs.FS, name string) (bool, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, "error calling Stat()")
+	}
+
+	checksum, ok := readFooter(f, stat.Size())
+	if !ok {
+		return false, nil
+	}
+
+	sum, err := checksumOf(f, stat.Size()-codec.FooterSize)
+	if err != nil {
+		return true, err
+	}
+	if sum != checksum {
+		return true, ErrFooterMismatch
+	}
+	return true, nil
+}
+
+// readFooter returns the checksum in the footer of the datafile `r` of
+// `size` bytes and whether it ends with a footer at all
+func readFooter(r io.ReaderAt, size int64) (uint32, bool) {
+	if size < codec.FooterSize {
+		return 0, false
+	}
+	b := make([]byte, codec.FooterSize)
+	if _, err := r.ReadAt(b, size-codec.FooterSize); err != nil {
+		return 0, false
+	}
+	return codec.DecodeFooter(b)
+}
+
+// sealedSize returns the size of the datafile `r` of `size` bytes without its
+// footer, if it ends with one matching its contents. The checksum tells a
+// footer apart from an entry whose value happens to end with the same bytes.
+func sealedSize(r io.ReaderAt, size int64) (int64, error) {
+	checksum, ok := readFooter(r, size)
+	if !ok {
+		return size, nil
+	}
+	sum, err := checksumOf(r, size-codec.FooterSize)
+	if err != nil {
+		return 0, err
+	}
+	if sum != checksum {
+		return size, nil
+	}
+	return size - codec.FooterSize, nil
+}
+
+// checksumOf returns the CRC of the first `n` bytes of `r`
+func checksumOf(r io.ReaderAt, n int64) (uint32, error) {
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(r, 0, n)); err != nil {
+		return 0, errors.Wrap(err, "error reading datafile")
+	}
+	return crc.Sum32(), nil
+}
@@ -0,0 +1,110 @@
+package data
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
+	"github.com/stretchr/testify/assert"
+)
+
+// buffer is an in-memory file read and appended to by a datafile
+type buffer struct {
+	b []byte
+}
+
+func (b *buffer) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.b = append(b.b, p...)
+	return len(p), nil
+}
+
+func TestNewDatafileFrom(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := &buffer{}
+	df := NewDatafileFrom(0, buf, 0, buf, 32, 32)
+
+	offset, n, err := df.Write(internal.NewEntry([]byte("foo"), []byte("bar")))
+	assert.NoError(err)
+	assert.Equal(int64(0), offset)
+	assert.Equal(int64(22), n)
+	_, _, err = df.Write(internal.NewEntry([]byte("baz"), []byte("qux")))
+	assert.NoError(err)
+	assert.Equal(int64(44), df.Size())
+
+	e, err := df.ReadAt(22, 22)
+	assert.NoError(err)
+	assert.Equal([]byte("baz"), e.Key)
+	assert.True(e.Verify(e.Value))
+
+	_, err = df.ReadAt(44, 22)
+	assert.Equal(ErrShortRead, err)
+
+	// Entries are read sequentially from an existing buffer
+	df = NewDatafileFrom(0, buf, int64(len(buf.b)), nil, 32, 32)
+	e, n, err = df.Read()
+	assert.NoError(err)
+	assert.Equal([]byte("foo"), e.Key)
+	assert.Equal(int64(22), n)
+	e, _, err = df.Read()
+	assert.NoError(err)
+	assert.Equal(int64(22), e.Offset)
+	_, _, err = df.Read()
+	assert.Equal(io.EOF, err)
+
+	_, _, err = df.Write(internal.NewEntry([]byte("foo"), []byte("bar")))
+	assert.Equal(errReadonly, err)
+	assert.NoError(df.Close())
+}
+
+func TestLazyDatafileRead(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	cache := NewCache(1)
+	var datafiles []Datafile
+	for id := 0; id < 2; id++ {
+		df, err := NewDatafile(fs.OS, testdir, id, false, 32, 32, false, ".data", true, 0, 0, false)
+		assert.NoError(err)
+		for i := 0; i < 3; i++ {
+			_, _, err := df.Write(internal.NewEntry([]byte(fmt.Sprintf("k%d%d", id, i)), []byte("bar")))
+			assert.NoError(err)
+		}
+		assert.NoError(df.Close())
+
+		df, err = NewLazyDatafile(cache, fs.OS, testdir, id, 32, 32, false, ".data", true)
+		assert.NoError(err)
+		defer df.Close()
+		datafiles = append(datafiles, df)
+	}
+
+	// Reading the other datafile closes the one being read in between
+	for i := 0; i < 3; i++ {
+		e, _, err := datafiles[0].Read()
+		assert.NoError(err)
+		assert.Equal([]byte(fmt.Sprintf("k0%d", i)), e.Key)
+
+		_, err = datafiles[1].ReadAt(e.Offset, 22)
+		assert.NoError(err)
+	}
+	_, _, err = datafiles[0].Read()
+	assert.Equal(io.EOF, err)
+}
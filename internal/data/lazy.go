@@ -0,0 +1,245 @@
+package data
+
+import (
+	"container/list"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+// Cache limits how many lazy datafiles (see NewLazyDatafile) are open at
+// once by closing the least recently used ones.
+type Cache struct {
+	mu    sync.Mutex
+	max   int
+	lru   *list.List
+	elems map[*lazyDatafile]*list.Element
+}
+
+// NewCache creates a new Cache keeping at most `max` datafiles open
+func NewCache(max int) *Cache {
+	return &Cache{
+		max:   max,
+		lru:   list.New(),
+		elems: make(map[*lazyDatafile]*list.Element),
+	}
+}
+
+// touch marks `df` as the most recently used datafile and returns the
+// datafiles that must be released to stay within the limit
+func (c *Cache) touch(df *lazyDatafile) (victims []*lazyDatafile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.elems[df]; ok {
+		c.lru.MoveToFront(elem)
+	} else {
+		c.elems[df] = c.lru.PushFront(df)
+	}
+
+	for c.lru.Len() > c.max {
+		victim := c.lru.Remove(c.lru.Back()).(*lazyDatafile)
+		delete(c.elems, victim)
+		victims = append(victims, victim)
+	}
+	return
+}
+
+func (c *Cache) contains(df *lazyDatafile) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.elems[df]
+	return ok
+}
+
+func (c *Cache) remove(df *lazyDatafile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.elems[df]; ok {
+		c.lru.Remove(elem)
+		delete(c.elems, df)
+	}
+}
+
+// lazyDatafile is a readonly datafile that is only opened when read from and
+// may be closed again by its Cache at any time when not in use.
+type lazyDatafile struct {
+	sync.RWMutex
+
+	cache *Cache
+	open  func() (Datafile, error)
+	id    int
+	name  string
+	size  int64
+	df    Datafile
+
+	// roffset is the offset of the next entry read by Read(), to resume
+	// reading there if the Cache closed the datafile in the meantime
+	rmu     sync.Mutex
+	roffset int64
+}
+
+// NewLazyDatafile returns a readonly datafile that is opened on demand and
+// kept open subject to the limit of `cache`. See NewDatafile for the other
+// arguments.
+func NewLazyDatafile(cache *Cache, fsys fs.FS, path string, id int, maxKeySize uint32, maxValueSize uint64, noMmap bool, ext string, magic bool) (Datafile, error) {
+	fn := filepath.Join(path, fmt.Sprintf(datafileFilename, id)+ext)
+	f, err := fsys.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "error calling Stat()")
+	}
+
+	// Like NewDatafile, the size doesn't include the footer
+	size, err := sealedSize(f, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	return &lazyDatafile{
+		cache: cache,
+		open: func() (Datafile, error) {
+			return NewDatafile(fsys, path, id, true, maxKeySize, maxValueSize, noMmap, ext, magic, 0, 0, false)
+		},
+		id:   id,
+		name: fn,
+		size: size,
+	}, nil
+}
+
+// acquire returns the underlying datafile, opening it if needed, with the
+// read lock held. The caller must call done() when finished with it.
+func (df *lazyDatafile) acquire() (Datafile, error) {
+	df.RLock()
+	for df.df == nil {
+		df.RUnlock()
+		df.Lock()
+		if df.df == nil {
+			f, err := df.open()
+			if err != nil {
+				df.Unlock()
+				return nil, err
+			}
+			df.df = f
+		}
+		df.Unlock()
+		df.RLock()
+	}
+	return df.df, nil
+}
+
+// done releases the read lock taken by acquire() and closes the datafiles
+// evicted from the cache by this use
+func (df *lazyDatafile) done() {
+	df.RUnlock()
+	for _, victim := range df.cache.touch(df) {
+		victim.release()
+	}
+}
+
+// release closes the underlying datafile unless it was used again since it
+// was evicted from the cache
+func (df *lazyDatafile) release() {
+	df.Lock()
+	defer df.Unlock()
+
+	if df.df == nil || df.cache.contains(df) {
+		return
+	}
+	df.df.Close()
+	df.df = nil
+}
+
+func (df *lazyDatafile) FileID() int {
+	return df.id
+}
+
+func (df *lazyDatafile) Name() string {
+	return df.name
+}
+
+func (df *lazyDatafile) Close() error {
+	df.cache.remove(df)
+
+	df.Lock()
+	defer df.Unlock()
+
+	if df.df == nil {
+		return nil
+	}
+	err := df.df.Close()
+	df.df = nil
+	return err
+}
+
+func (df *lazyDatafile) Sync() error {
+	return nil
+}
+
+func (df *lazyDatafile) Size() int64 {
+	return df.size
+}
+
+// Read reads the next entry from the datafile. The datafile is kept open as
+// the most recently used while it is being read sequentially, and reading
+// resumes after the last entry read if it was closed in between.
+func (df *lazyDatafile) Read() (e internal.Entry, n int64, err error) {
+	df.rmu.Lock()
+	defer df.rmu.Unlock()
+
+	f, err := df.acquire()
+	if err != nil {
+		return
+	}
+	defer df.done()
+
+	if d, ok := f.(*datafile); ok && df.roffset > 0 {
+		d.seek(df.roffset)
+	}
+	if e, n, err = f.Read(); err == nil {
+		df.roffset = e.Offset + n
+	}
+	return
+}
+
+// ReadAt the entry located at index offset with expected serialized size
+func (df *lazyDatafile) ReadAt(index, size int64) (e internal.Entry, err error) {
+	f, err := df.acquire()
+	if err != nil {
+		return
+	}
+	defer df.done()
+
+	return f.ReadAt(index, size)
+}
+
+// ReadValueSize reads the value size of the entry located at index offset
+func (df *lazyDatafile) ReadValueSize(index int64) (int64, bool, error) {
+	f, err := df.acquire()
+	if err != nil {
+		return 0, false, err
+	}
+	defer df.done()
+
+	return f.ReadValueSize(index)
+}
+
+func (df *lazyDatafile) Write(e internal.Entry) (int64, int64, error) {
+	return -1, 0, errReadonly
+}
+
+func (df *lazyDatafile) WriteRaw(b []byte) (int64, int64, error) {
+	return -1, 0, errReadonly
+}
+
+func (df *lazyDatafile) Seal() error {
+	return errReadonly
+}
@@ -2,6 +2,16 @@ package internal
 
 import (
 	"hash/crc32"
+	"math"
+)
+
+const (
+	// KeySizeWidth is the width in bytes of the key length prefix shared by
+	// the datafile and index encodings.
+	KeySizeWidth = 4
+
+	// MaxKeySize is the largest key size representable in KeySizeWidth bytes.
+	MaxKeySize = math.MaxUint32
 )
 
 // Entry represents a key/value in the database
@@ -10,6 +20,16 @@ type Entry struct {
 	Key      []byte
 	Offset   int64
 	Value    []byte
+	Expiry   int64 // Unix time in nanoseconds, 0 if the entry never expires
+	ModTime  int64 // Unix time in nanoseconds, 0 if not recorded
+	Blob     bool  // Value references the blob file holding the value
+
+	// NoChecksum is set for entries written without computing the checksum
+	// of their value (see WithChecksumOnWrite), which can't be verified
+	NoChecksum bool
+
+	// Tag describes the value to the application, 0 if it has none
+	Tag uint8
 }
 
 // NewEntry creates a new `Entry` with the given `key` and `value`
@@ -22,3 +42,9 @@ func NewEntry(key, value []byte) Entry {
 		Value:    value,
 	}
 }
+
+// Verify returns true if `value` matches the checksum of the entry, or if no
+// checksum was computed when the entry was written
+func (e Entry) Verify(value []byte) bool {
+	return e.NoChecksum || crc32.ChecksumIEEE(value) == e.Checksum
+}
@@ -0,0 +1,21 @@
+package internal
+
+import (
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEntry(t *testing.T) {
+	assert := assert.New(t)
+
+	e := NewEntry([]byte("foo"), []byte("bar"))
+	assert.Equal(crc32.ChecksumIEEE([]byte("bar")), e.Checksum)
+	assert.False(e.NoChecksum)
+	assert.True(e.Verify([]byte("bar")))
+	assert.False(e.Verify([]byte("baz")))
+
+	e = Entry{Key: []byte("foo"), Value: []byte("bar"), NoChecksum: true}
+	assert.True(e.Verify([]byte("baz")))
+}
@@ -0,0 +1,176 @@
+// Package fs abstracts the file system a database is stored on
+package fs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// File is an open file of a FS
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS is a file system a database can be stored on. Its methods behave like
+// their counterparts in the os and ioutil packages.
+type FS interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+}
+
+// OS is the file system of the operating system
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// IsOS returns true if `fsys` is the file system of the operating system,
+// which is required to memory map and lock files
+func IsOS(fsys FS) bool {
+	_, ok := fsys.(osFS)
+	return ok
+}
+
+// Exists returns `true` if the given `path` on `fsys` exists
+func Exists(fsys FS, path string) bool {
+	_, err := fsys.Stat(path)
+	return err == nil
+}
+
+// ReadFile reads the whole file `name` from `fsys`
+func ReadFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// WriteFile writes `data` to the file `name` on `fsys` replacing any previous
+// contents and syncs it to disk
+func WriteFile(fsys FS, name string, data []byte, perm os.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RemoveAll removes `path` and any children it contains from `fsys`. It
+// returns nil if `path` doesn't exist.
+func RemoveAll(fsys FS, path string) error {
+	if IsOS(fsys) {
+		return os.RemoveAll(path)
+	}
+
+	info, err := fsys.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir() {
+		children, err := fsys.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := RemoveAll(fsys, filepath.Join(path, child.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return fsys.Remove(path)
+}
+
+// TempDir creates a new directory in `dir` on `fsys` whose name begins with
+// `prefix` and returns its path
+func TempDir(fsys FS, dir, prefix string) (string, error) {
+	if IsOS(fsys) {
+		return ioutil.TempDir(dir, prefix)
+	}
+
+	for {
+		name := filepath.Join(dir, fmt.Sprintf("%s%d", prefix, rand.Uint32()))
+		if Exists(fsys, name) {
+			continue
+		}
+		if err := fsys.MkdirAll(name, 0700); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+}
+
+// SyncDir fsyncs the directory `path` on `fsys` so that the entries of files
+// created in it are durable
+func SyncDir(fsys FS, path string) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,390 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNotDir = errors.New("not a directory")
+
+// NewMemFS returns a new empty FS keeping all files in memory. Syncing its
+// files does nothing.
+func NewMemFS() FS {
+	return &memFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]time.Time{string(filepath.Separator): time.Now()},
+	}
+}
+
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]time.Time
+}
+
+// memData is the contents of a file of a memFS shared by all its open files
+type memData struct {
+	sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func memPath(name string) string {
+	return filepath.Clean(string(filepath.Separator) + name)
+}
+
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (m *memFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(name)
+	if _, ok := m.dirs[p]; ok {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, pathError("open", name, os.ErrPermission)
+		}
+		return &memFile{name: name, dir: true}, nil
+	}
+
+	d, ok := m.files[p]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, pathError("open", name, os.ErrNotExist)
+	case !ok:
+		if _, ok := m.dirs[filepath.Dir(p)]; !ok {
+			return nil, pathError("open", name, os.ErrNotExist)
+		}
+		d = &memData{modTime: time.Now()}
+		m.files[p] = d
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, pathError("open", name, os.ErrExist)
+	}
+
+	f := &memFile{
+		name:     name,
+		data:     d,
+		readable: flag&os.O_WRONLY == 0,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+		append:   flag&os.O_APPEND != 0,
+	}
+	if flag&os.O_TRUNC != 0 && f.writable {
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(name)
+	if modTime, ok := m.dirs[p]; ok {
+		return &memInfo{name: filepath.Base(p), dir: true, modTime: modTime}, nil
+	}
+	if d, ok := m.files[p]; ok {
+		return d.info(filepath.Base(p)), nil
+	}
+	return nil, pathError("stat", name, os.ErrNotExist)
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(name)
+	if _, ok := m.files[p]; ok {
+		delete(m.files, p)
+		return nil
+	}
+	if _, ok := m.dirs[p]; !ok {
+		return pathError("remove", name, os.ErrNotExist)
+	}
+	if len(m.children(p)) > 0 {
+		return pathError("remove", name, errors.New("directory not empty"))
+	}
+	delete(m.dirs, p)
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, n := memPath(oldpath), memPath(newpath)
+	if _, ok := m.dirs[filepath.Dir(n)]; !ok {
+		return pathError("rename", newpath, os.ErrNotExist)
+	}
+
+	if d, ok := m.files[o]; ok {
+		if _, ok := m.dirs[n]; ok {
+			return pathError("rename", newpath, os.ErrExist)
+		}
+		delete(m.files, o)
+		m.files[n] = d
+		return nil
+	}
+
+	modTime, ok := m.dirs[o]
+	if !ok {
+		return pathError("rename", oldpath, os.ErrNotExist)
+	}
+	if _, ok := m.files[n]; ok {
+		return pathError("rename", newpath, errNotDir)
+	}
+	delete(m.dirs, o)
+	m.dirs[n] = modTime
+
+	// Move everything within the directory along with it
+	prefix := o + string(filepath.Separator)
+	dirs := make(map[string]time.Time)
+	for p, modTime := range m.dirs {
+		if strings.HasPrefix(p, prefix) {
+			delete(m.dirs, p)
+			dirs[filepath.Join(n, p[len(prefix):])] = modTime
+		}
+	}
+	for p, modTime := range dirs {
+		m.dirs[p] = modTime
+	}
+	files := make(map[string]*memData)
+	for p, d := range m.files {
+		if strings.HasPrefix(p, prefix) {
+			delete(m.files, p)
+			files[filepath.Join(n, p[len(prefix):])] = d
+		}
+	}
+	for p, d := range files {
+		m.files[p] = d
+	}
+	return nil
+}
+
+func (m *memFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(dirname)
+	if _, ok := m.dirs[p]; !ok {
+		return nil, pathError("readdir", dirname, os.ErrNotExist)
+	}
+
+	infos := m.children(p)
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+// children returns the files and directories directly within the directory
+// `p`. The caller must hold the lock.
+func (m *memFS) children(p string) []os.FileInfo {
+	var infos []os.FileInfo
+	for name, modTime := range m.dirs {
+		if name != p && filepath.Dir(name) == p {
+			infos = append(infos, &memInfo{name: filepath.Base(name), dir: true, modTime: modTime})
+		}
+	}
+	for name, d := range m.files {
+		if filepath.Dir(name) == p {
+			infos = append(infos, d.info(filepath.Base(name)))
+		}
+	}
+	return infos
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memPath(path)
+	for dir := p; ; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return pathError("mkdir", path, errNotDir)
+		}
+		if _, ok := m.dirs[dir]; ok {
+			break
+		}
+		m.dirs[dir] = time.Now()
+	}
+	return nil
+}
+
+func (d *memData) info(name string) os.FileInfo {
+	d.RLock()
+	defer d.RUnlock()
+	return &memInfo{name: name, size: int64(len(d.data)), modTime: d.modTime}
+}
+
+// memFile is an open file (or directory) of a memFS
+type memFile struct {
+	mu sync.Mutex
+
+	name     string
+	dir      bool
+	data     *memData
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) check(op string, allowed bool) error {
+	if f.closed {
+		return pathError(op, f.name, os.ErrClosed)
+	}
+	if f.dir {
+		return pathError(op, f.name, errors.New("is a directory"))
+	}
+	if !allowed {
+		return pathError(op, f.name, os.ErrPermission)
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("read", f.readable); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("read", f.readable); err != nil {
+		return 0, err
+	}
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	f.data.RLock()
+	defer f.data.RUnlock()
+
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("write", f.writable); err != nil {
+		return 0, err
+	}
+
+	f.data.Lock()
+	defer f.data.Unlock()
+
+	if f.append {
+		f.offset = int64(len(f.data.data))
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data, make([]byte, end-int64(len(f.data.data)))...)
+	}
+	n := copy(f.data.data[f.offset:], p)
+	f.offset += int64(n)
+	f.data.modTime = time.Now()
+	return n, nil
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return pathError("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.dir {
+		return &memInfo{name: filepath.Base(f.name), dir: true}, nil
+	}
+	return f.data.info(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return pathError("sync", f.name, os.ErrClosed)
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("truncate", f.writable); err != nil {
+		return err
+	}
+
+	f.data.Lock()
+	defer f.data.Unlock()
+
+	if size < int64(len(f.data.data)) {
+		f.data.data = f.data.data[:size:size]
+	} else {
+		f.data.data = append(f.data.data, make([]byte, size-int64(len(f.data.data)))...)
+	}
+	f.data.modTime = time.Now()
+	return nil
+}
+
+// memInfo describes a file of a memFS
+type memInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.dir }
+func (i *memInfo) Sys() interface{}   { return nil }
+
+func (i *memInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
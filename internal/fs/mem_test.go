@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFS(t *testing.T) {
+	assert := assert.New(t)
+
+	fsys := NewMemFS()
+	assert.NoError(fsys.MkdirAll("/db/merge", 0755))
+
+	_, err := fsys.Open("/db/missing")
+	assert.True(os.IsNotExist(err))
+
+	_, err = fsys.OpenFile("/missing/foo", os.O_CREATE|os.O_WRONLY, 0644)
+	assert.True(os.IsNotExist(err))
+
+	w, err := fsys.OpenFile("/db/merge/foo", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(err)
+	_, err = w.Write([]byte("hello "))
+	assert.NoError(err)
+	_, err = w.Write([]byte("world"))
+	assert.NoError(err)
+	assert.NoError(w.Sync())
+
+	_, err = w.Read(make([]byte, 1))
+	assert.True(os.IsPermission(err))
+
+	r, err := fsys.Open("/db/merge/foo")
+	assert.NoError(err)
+	buf := make([]byte, 5)
+	_, err = r.ReadAt(buf, 6)
+	assert.NoError(err)
+	assert.Equal([]byte("world"), buf)
+	_, err = r.ReadAt(buf, 8)
+	assert.Equal(io.EOF, err)
+
+	assert.NoError(w.Truncate(5))
+	data, err := ReadFile(fsys, "/db/merge/foo")
+	assert.NoError(err)
+	assert.Equal([]byte("hello"), data)
+	assert.NoError(w.Close())
+	assert.NoError(r.Close())
+
+	assert.NoError(fsys.Rename("/db/merge/foo", "/db/foo"))
+	assert.False(Exists(fsys, "/db/merge/foo"))
+
+	infos, err := fsys.ReadDir("/db")
+	assert.NoError(err)
+	if assert.Equal(2, len(infos)) {
+		assert.Equal("foo", infos[0].Name())
+		assert.Equal(int64(5), infos[0].Size())
+		assert.Equal("merge", infos[1].Name())
+		assert.True(infos[1].IsDir())
+	}
+
+	assert.Error(fsys.Remove("/db"))
+	assert.NoError(RemoveAll(fsys, "/db"))
+	assert.False(Exists(fsys, "/db"))
+	assert.NoError(RemoveAll(fsys, "/db"))
+}
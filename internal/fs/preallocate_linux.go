@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, allocating space without changing
+// the size of the file
+const fallocKeepSize = 0x1
+
+// Preallocate reserves `size` bytes of disk space for `f` without changing
+// its size, so appending to it up to that size doesn't fragment it. It does
+// nothing for files not on the file system of the operating system or where
+// that doesn't support preallocating space.
+func Preallocate(f File, size int64) error {
+	osf, ok := f.(*os.File)
+	if !ok {
+		return nil
+	}
+
+	err := syscall.Fallocate(int(osf.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+// Preallocate reserves `size` bytes of disk space for `f` without changing
+// its size. It is only supported on Linux and does nothing elsewhere.
+func Preallocate(f File, size int64) error {
+	return nil
+}
@@ -1,7 +1,10 @@
 package index
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 
 	"github.com/pkg/errors"
@@ -14,18 +17,78 @@ var (
 	errTruncatedKeyData = errors.New("key data is truncated")
 	errTruncatedData    = errors.New("data is truncated")
 	errKeySizeTooLarge  = errors.New("key size too large")
+	errInvalidKeyPrefix = errors.New("key prefix longer than the previous key")
+	errUnknownFormat    = errors.New("unknown index format")
 )
 
+// CorruptionError is the error returned reading an index that is corrupt
+// from Offset onwards, after reading the keys stored before it
+type CorruptionError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+}
+
+// Cause returns the corruption error for errors.Cause()
+func (e *CorruptionError) Cause() error { return e.Err }
+
+// Unwrap returns the corruption error for errors.Is() and errors.As()
+func (e *CorruptionError) Unwrap() error { return e.Err }
+
+// corruptAt returns `err` as a CorruptionError at `offset` if it reports a
+// corruption
+func corruptAt(offset int64, err error) error {
+	if !IsIndexCorruption(err) {
+		return err
+	}
+	return &CorruptionError{Offset: offset, Err: err}
+}
+
+// countingReader counts the bytes read from an io.Reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// indexMarker starts an index in a format other than the original one and
+// is followed by the format's version. The original format starts with the
+// size of the first key, which can never be this large.
+var indexMarker = []byte{0xff, 0xff, 0xff, 0xff}
+
 const (
-	int32Size  = 4
-	int64Size  = 8
-	fileIDSize = int32Size
-	offsetSize = int64Size
-	sizeSize   = int64Size
+	int32Size   = 4
+	int64Size   = 8
+	fileIDSize  = int32Size
+	offsetSize  = int64Size
+	sizeSize    = int64Size
+	expirySize  = int64Size
+	modTimeSize = int64Size
+
+	// expiryFlag is set in the size of items with an expiry, which is then
+	// stored after the item
+	expiryFlag = uint64(1) << 63
+
+	// modTimeFlag is set in the size of items with a modification time,
+	// which is then stored after the expiry (if any)
+	modTimeFlag = uint64(1) << 62
+
+	// formatFrontCoded is the version of the front coded format, which
+	// stores every key as the length of the prefix it shares with the
+	// previous key and the rest of the key, both lengths as uvarints
+	formatFrontCoded = 1
 )
 
 func readKeyBytes(r io.Reader, maxKeySize uint32) ([]byte, error) {
-	s := make([]byte, int32Size)
+	s := make([]byte, internal.KeySizeWidth)
 	_, err := io.ReadFull(r, s)
 	if err != nil {
 		if err == io.EOF {
@@ -46,18 +109,56 @@ func readKeyBytes(r io.Reader, maxKeySize uint32) ([]byte, error) {
 	return b, nil
 }
 
-func writeBytes(b []byte, w io.Writer) error {
-	s := make([]byte, int32Size)
-	binary.BigEndian.PutUint32(s, uint32(len(b)))
-	_, err := w.Write(s)
+// readFrontCodedKey reads a key of the front coded format sharing its
+// prefix with the `prev` key
+func readFrontCodedKey(r *bufio.Reader, prev []byte, maxKeySize uint32) ([]byte, error) {
+	shared, err := binary.ReadUvarint(r)
 	if err != nil {
-		return err
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errors.Wrap(errTruncatedKeySize, err.Error())
 	}
-	_, err = w.Write(b)
+	suffix, err := binary.ReadUvarint(r)
 	if err != nil {
+		return nil, errors.Wrap(errTruncatedKeySize, err.Error())
+	}
+
+	if shared > uint64(len(prev)) {
+		return nil, errInvalidKeyPrefix
+	}
+	if suffix > uint64(maxKeySize) || shared+suffix > uint64(maxKeySize) {
+		return nil, errKeySizeTooLarge
+	}
+
+	b := make([]byte, shared+suffix)
+	copy(b, prev[:shared])
+	if _, err := io.ReadFull(r, b[shared:]); err != nil {
+		return nil, errors.Wrap(errTruncatedKeyData, err.Error())
+	}
+	return b, nil
+}
+
+// writeFrontCodedKey writes `key` in the front coded format sharing its
+// prefix with the `prev` key
+func writeFrontCodedKey(key, prev []byte, w io.Writer) error {
+	if uint64(len(key)) > internal.MaxKeySize {
+		return errKeySizeTooLarge
+	}
+
+	shared := 0
+	for shared < len(key) && shared < len(prev) && key[shared] == prev[shared] {
+		shared++
+	}
+
+	s := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(s, uint64(shared))
+	n += binary.PutUvarint(s[n:], uint64(len(key)-shared))
+	if _, err := w.Write(s[:n]); err != nil {
 		return err
 	}
-	return nil
+	_, err := w.Write(key[shared:])
+	return err
 }
 
 func readItem(r io.Reader) (internal.Item, error) {
@@ -67,18 +168,55 @@ func readItem(r io.Reader) (internal.Item, error) {
 		return internal.Item{}, errors.Wrap(errTruncatedData, err.Error())
 	}
 
-	return internal.Item{
+	size := binary.BigEndian.Uint64(buf[(fileIDSize + offsetSize):])
+	item := internal.Item{
 		FileID: int(binary.BigEndian.Uint32(buf[:fileIDSize])),
 		Offset: int64(binary.BigEndian.Uint64(buf[fileIDSize:(fileIDSize + offsetSize)])),
-		Size:   int64(binary.BigEndian.Uint64(buf[(fileIDSize + offsetSize):])),
-	}, nil
+		Size:   int64(size &^ (expiryFlag | modTimeFlag)),
+	}
+
+	if size&expiryFlag != 0 {
+		expiry := make([]byte, expirySize)
+		if _, err := io.ReadFull(r, expiry); err != nil {
+			return internal.Item{}, errors.Wrap(errTruncatedData, err.Error())
+		}
+		item.Expiry = int64(binary.BigEndian.Uint64(expiry))
+	}
+
+	if size&modTimeFlag != 0 {
+		modTime := make([]byte, modTimeSize)
+		if _, err := io.ReadFull(r, modTime); err != nil {
+			return internal.Item{}, errors.Wrap(errTruncatedData, err.Error())
+		}
+		item.ModTime = int64(binary.BigEndian.Uint64(modTime))
+	}
+
+	return item, nil
 }
 
 func writeItem(item internal.Item, w io.Writer) error {
+	size := uint64(item.Size)
+	if item.Expiry != 0 {
+		size |= expiryFlag
+	}
+	if item.ModTime != 0 {
+		size |= modTimeFlag
+	}
+
 	buf := make([]byte, (fileIDSize + offsetSize + sizeSize))
 	binary.BigEndian.PutUint32(buf[:fileIDSize], uint32(item.FileID))
 	binary.BigEndian.PutUint64(buf[fileIDSize:(fileIDSize+offsetSize)], uint64(item.Offset))
-	binary.BigEndian.PutUint64(buf[(fileIDSize+offsetSize):], uint64(item.Size))
+	binary.BigEndian.PutUint64(buf[(fileIDSize+offsetSize):], size)
+	if item.Expiry != 0 {
+		expiry := make([]byte, expirySize)
+		binary.BigEndian.PutUint64(expiry, uint64(item.Expiry))
+		buf = append(buf, expiry...)
+	}
+	if item.ModTime != 0 {
+		modTime := make([]byte, modTimeSize)
+		binary.BigEndian.PutUint64(modTime, uint64(item.ModTime))
+		buf = append(buf, modTime...)
+	}
 	_, err := w.Write(buf)
 	if err != nil {
 		return err
@@ -86,20 +224,73 @@ func writeItem(item internal.Item, w io.Writer) error {
 	return nil
 }
 
-// ReadIndex reads a persisted from a io.Reader into a Tree
+// readIndex reads a persisted index from a io.Reader into a Tree. Both the
+// front coded format and the original one are supported.
 func readIndex(r io.Reader, t art.Tree, maxKeySize uint32) error {
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr)
+
+	// offset returns the offset in `r` of the next byte read from `br`
+	offset := func() int64 {
+		return cr.n - int64(br.Buffered())
+	}
+
+	marker, err := br.Peek(len(indexMarker))
+	if err != nil || !bytes.Equal(marker, indexMarker) {
+		return readOriginalIndex(br, t, maxKeySize, offset)
+	}
+	if _, err := br.Discard(len(indexMarker)); err != nil {
+		return err
+	}
+
+	version, err := br.ReadByte()
+	if err != nil {
+		return corruptAt(0, errors.Wrap(errTruncatedData, err.Error()))
+	}
+	if version != formatFrontCoded {
+		return errUnknownFormat
+	}
+
+	var prev []byte
 	for {
+		start := offset()
+		key, err := readFrontCodedKey(br, prev, maxKeySize)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return corruptAt(start, err)
+		}
+
+		item, err := readItem(br)
+		if err != nil {
+			return corruptAt(start, err)
+		}
+
+		t.Insert(key, item)
+		prev = key
+	}
+
+	return nil
+}
+
+// readOriginalIndex reads an index of the original format, which stores
+// every key in full preceded by its size. The function `offset` returns the
+// offset in the index of the next byte read from `r`.
+func readOriginalIndex(r io.Reader, t art.Tree, maxKeySize uint32, offset func() int64) error {
+	for {
+		start := offset()
 		key, err := readKeyBytes(r, maxKeySize)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return corruptAt(start, err)
 		}
 
 		item, err := readItem(r)
 		if err != nil {
-			return err
+			return corruptAt(start, err)
 		}
 
 		t.Insert(key, item)
@@ -108,22 +299,42 @@ func readIndex(r io.Reader, t art.Tree, maxKeySize uint32) error {
 	return nil
 }
 
+// writeIndex writes the Tree to a io.Writer in the front coded format. As
+// the keys are written in order, keys sharing long prefixes take little
+// space.
 func writeIndex(t art.Tree, w io.Writer) (err error) {
+	bw := bufio.NewWriter(w)
+
+	if _, err = bw.Write(indexMarker); err != nil {
+		return
+	}
+	if err = bw.WriteByte(formatFrontCoded); err != nil {
+		return
+	}
+
+	var prev []byte
 	t.ForEach(func(node art.Node) bool {
-		err = writeBytes(node.Key(), w)
+		// The walk carries on with the siblings of the failed node
 		if err != nil {
 			return false
 		}
+		if err = writeFrontCodedKey(node.Key(), prev, bw); err != nil {
+			return false
+		}
 
 		item := node.Value().(internal.Item)
-		err := writeItem(item, w)
-		if err != nil {
+		if err = writeItem(item, bw); err != nil {
 			return false
 		}
 
+		prev = node.Key()
 		return true
 	})
-	return
+	if err != nil {
+		return
+	}
+
+	return bw.Flush()
 }
 
 // IsIndexCorruption returns a boolean indicating whether the error
@@ -131,7 +342,7 @@ func writeIndex(t art.Tree, w io.Writer) (err error) {
 func IsIndexCorruption(err error) bool {
 	cause := errors.Cause(err)
 	switch cause {
-	case errKeySizeTooLarge, errTruncatedData, errTruncatedKeyData, errTruncatedKeySize:
+	case errKeySizeTooLarge, errTruncatedData, errTruncatedKeyData, errTruncatedKeySize, errInvalidKeyPrefix:
 		return true
 	}
 	return false
@@ -12,45 +12,125 @@ import (
 )
 
 const (
+	// base64SampleTree is the sample tree in the original format
 	base64SampleTree = "AAAABGFiY2QAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAARhYmNlAAAAAQAAAAAAAAABAAAAAAAAAAEAAAAEYWJjZgAAAAIAAAAAAAAAAgAAAAAAAAACAAAABGFiZ2QAAAADAAAAAAAAAAMAAAAAAAAAAw=="
+
+	// base64FrontCodedSampleTree is the sample tree in the front coded format
+	base64FrontCodedSampleTree = "/////wEABGFiY2QAAAAAAAAAAAAAAAAAAAAAAAAAAAMBZQAAAAEAAAAAAAAAAQAAAAAAAAABAwFmAAAAAgAAAAAAAAACAAAAAAAAAAICAmdkAAAAAwAAAAAAAAADAAAAAAAAAAM="
 )
 
 func TestWriteIndex(t *testing.T) {
-	at, expectedSerializedSize := getSampleTree()
+	at, originalSerializedSize := getSampleTree()
 
 	var b bytes.Buffer
 	err := writeIndex(at, &b)
 	if err != nil {
 		t.Fatalf("writing index failed: %v", err)
 	}
-	if b.Len() != expectedSerializedSize {
-		t.Fatalf("incorrect size of serialied index: expected %d, got: %d", expectedSerializedSize, b.Len())
+	if b.Len() >= originalSerializedSize {
+		t.Fatalf("front coded index isn't smaller than the original format: %d >= %d", b.Len(), originalSerializedSize)
 	}
-	sampleTreeBytes, _ := base64.StdEncoding.DecodeString(base64SampleTree)
+	sampleTreeBytes, _ := base64.StdEncoding.DecodeString(base64FrontCodedSampleTree)
 	if !bytes.Equal(b.Bytes(), sampleTreeBytes) {
 		t.Fatalf("unexpected serialization of the tree")
 	}
 }
 
 func TestReadIndex(t *testing.T) {
-	sampleTreeBytes, _ := base64.StdEncoding.DecodeString(base64SampleTree)
-	b := bytes.NewBuffer(sampleTreeBytes)
+	for name, sample := range map[string]string{
+		"original":    base64SampleTree,
+		"front-coded": base64FrontCodedSampleTree,
+	} {
+		t.Run(name, func(t *testing.T) {
+			sampleTreeBytes, _ := base64.StdEncoding.DecodeString(sample)
+			b := bytes.NewBuffer(sampleTreeBytes)
+
+			at := art.New()
+			err := readIndex(b, at, 1024)
+			if err != nil {
+				t.Fatalf("error while deserializing correct sample tree: %v", err)
+			}
+
+			atsample, _ := getSampleTree()
+			if atsample.Size() != at.Size() {
+				t.Fatalf("trees aren't the same size, expected %v, got %v", atsample.Size(), at.Size())
+			}
+			atsample.ForEach(func(node art.Node) bool {
+				value, found := at.Search(node.Key())
+				if !found {
+					t.Fatalf("expected node wasn't found: %s", node.Key())
+				}
+				if value.(internal.Item) != node.Value().(internal.Item) {
+					t.Fatalf("expected item %v, got %v", node.Value(), value)
+				}
+				return true
+			})
+		})
+	}
+}
 
+func TestIndexFrontCoding(t *testing.T) {
 	at := art.New()
-	err := readIndex(b, at, 1024)
-	if err != nil {
-		t.Fatalf("error while deserializing correct sample tree: %v", err)
+	prefix := bytes.Repeat([]byte("users/profiles/"), 4)
+	for i := 0; i < 100; i++ {
+		key := append(append([]byte(nil), prefix...), byte('a'+i%26), byte('a'+i/26))
+		at.Insert(key, internal.Item{FileID: i, Offset: int64(i), Size: int64(i)})
+	}
+
+	var b bytes.Buffer
+	if err := writeIndex(at, &b); err != nil {
+		t.Fatalf("writing index failed: %v", err)
+	}
+
+	// Only the first key is stored in full
+	original := 100 * (int32Size + len(prefix) + 2 + fileIDSize + offsetSize + sizeSize)
+	if b.Len() > original/2 {
+		t.Fatalf("expected the index to shrink to less than %d bytes, got %d", original/2, b.Len())
 	}
 
-	atsample, _ := getSampleTree()
-	if atsample.Size() != at.Size() {
-		t.Fatalf("trees aren't the same size, expected %v, got %v", atsample.Size(), at.Size())
+	rt := art.New()
+	if err := readIndex(&b, rt, 1024); err != nil {
+		t.Fatalf("reading index failed: %v", err)
 	}
-	atsample.ForEach(func(node art.Node) bool {
-		_, found := at.Search(node.Key())
+	if rt.Size() != at.Size() {
+		t.Fatalf("trees aren't the same size, expected %v, got %v", at.Size(), rt.Size())
+	}
+	at.ForEach(func(node art.Node) bool {
+		value, found := rt.Search(node.Key())
 		if !found {
 			t.Fatalf("expected node wasn't found: %s", node.Key())
 		}
+		if value.(internal.Item) != node.Value().(internal.Item) {
+			t.Fatalf("expected item %v, got %v", node.Value(), value)
+		}
+		return true
+	})
+}
+
+func TestIndexExpiry(t *testing.T) {
+	at := art.New()
+	at.Insert([]byte("abcd"), internal.Item{FileID: 1, Offset: 2, Size: 3, Expiry: 4})
+	at.Insert([]byte("abce"), internal.Item{FileID: 5, Offset: 6, Size: 7})
+	at.Insert([]byte("abcf"), internal.Item{FileID: 8, Offset: 9, Size: 10, ModTime: 11})
+	at.Insert([]byte("abcg"), internal.Item{FileID: 12, Offset: 13, Size: 14, Expiry: 15, ModTime: 16})
+
+	var b bytes.Buffer
+	if err := writeIndex(at, &b); err != nil {
+		t.Fatalf("writing index failed: %v", err)
+	}
+
+	rt := art.New()
+	if err := readIndex(&b, rt, 1024); err != nil {
+		t.Fatalf("reading index failed: %v", err)
+	}
+	at.ForEach(func(node art.Node) bool {
+		value, found := rt.Search(node.Key())
+		if !found {
+			t.Fatalf("expected node wasn't found: %s", node.Key())
+		}
+		if value.(internal.Item) != node.Value().(internal.Item) {
+			t.Fatalf("expected item %v, got %v", node.Value(), value)
+		}
 		return true
 	})
 }
@@ -59,25 +139,69 @@ func TestReadCorruptedData(t *testing.T) {
 	sampleBytes, _ := base64.StdEncoding.DecodeString(base64SampleTree)
 
 	t.Run("truncated", func(t *testing.T) {
+		second := int64(int32Size + 4 + fileIDSize + offsetSize + sizeSize)
+
+		table := []struct {
+			name   string
+			err    error
+			offset int64
+			data   []byte
+		}{
+			{name: "key-size-first-item", err: errTruncatedKeySize, offset: 0, data: sampleBytes[:2]},
+			{name: "key-data-second-item", err: errTruncatedKeyData, offset: 0, data: sampleBytes[:6]},
+			{name: "key-size-second-item", err: errTruncatedKeySize, offset: second, data: sampleBytes[:(int32Size+4+fileIDSize+offsetSize+sizeSize)+2]},
+			{name: "key-data-second-item", err: errTruncatedKeyData, offset: second, data: sampleBytes[:(int32Size+4+fileIDSize+offsetSize+sizeSize)+6]},
+			{name: "data", err: errTruncatedData, offset: 0, data: sampleBytes[:int32Size+4+(fileIDSize+offsetSize+sizeSize-3)]},
+		}
+
+		for i := range table {
+			t.Run(table[i].name, func(t *testing.T) {
+				bf := bytes.NewBuffer(table[i].data)
+
+				err := readIndex(bf, art.New(), 1024)
+				if !IsIndexCorruption(err) || errors.Cause(err) != table[i].err {
+					t.Fatalf("expected %v, got %v", table[i].err, err)
+				}
+				if cerr, ok := err.(*CorruptionError); !ok || cerr.Offset != table[i].offset {
+					t.Fatalf("expected corruption at offset %d, got %v", table[i].offset, err)
+				}
+			})
+		}
+	})
+
+	t.Run("front-coded", func(t *testing.T) {
+		frontCodedBytes, _ := base64.StdEncoding.DecodeString(base64FrontCodedSampleTree)
+		header := len(indexMarker) + 1
+		first := header + 2 + 4 + fileIDSize + offsetSize + sizeSize
+
+		invalidPrefix := make([]byte, len(frontCodedBytes))
+		copy(invalidPrefix, frontCodedBytes)
+		invalidPrefix[first] = 5
+
 		table := []struct {
-			name string
-			err  error
-			data []byte
+			name   string
+			err    error
+			offset int64
+			data   []byte
 		}{
-			{name: "key-size-first-item", err: errTruncatedKeySize, data: sampleBytes[:2]},
-			{name: "key-data-second-item", err: errTruncatedKeyData, data: sampleBytes[:6]},
-			{name: "key-size-second-item", err: errTruncatedKeySize, data: sampleBytes[:(int32Size+4+fileIDSize+offsetSize+sizeSize)+2]},
-			{name: "key-data-second-item", err: errTruncatedKeyData, data: sampleBytes[:(int32Size+4+fileIDSize+offsetSize+sizeSize)+6]},
-			{name: "data", err: errTruncatedData, data: sampleBytes[:int32Size+4+(fileIDSize+offsetSize+sizeSize-3)]},
+			{name: "version", err: errTruncatedData, offset: 0, data: frontCodedBytes[:header-1]},
+			{name: "key-size-second-item", err: errTruncatedKeySize, offset: int64(first), data: frontCodedBytes[:first+1]},
+			{name: "key-data-second-item", err: errTruncatedKeyData, offset: int64(first), data: frontCodedBytes[:first+2]},
+			{name: "data", err: errTruncatedData, offset: int64(first), data: frontCodedBytes[:first+3+4]},
+			{name: "key-prefix", err: errInvalidKeyPrefix, offset: int64(first), data: invalidPrefix},
 		}
 
 		for i := range table {
 			t.Run(table[i].name, func(t *testing.T) {
 				bf := bytes.NewBuffer(table[i].data)
 
-				if err := readIndex(bf, art.New(), 1024); !IsIndexCorruption(err) || errors.Cause(err) != table[i].err {
+				err := readIndex(bf, art.New(), 1024)
+				if !IsIndexCorruption(err) || errors.Cause(err) != table[i].err {
 					t.Fatalf("expected %v, got %v", table[i].err, err)
 				}
+				if cerr, ok := err.(*CorruptionError); !ok || cerr.Offset != table[i].offset {
+					t.Fatalf("expected corruption at offset %d, got %v", table[i].offset, err)
+				}
 			})
 		}
 	})
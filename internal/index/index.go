@@ -4,7 +4,7 @@ import (
 	"os"
 
 	art "github.com/plar/go-adaptive-radix-tree"
-	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
 )
 
 // Indexer is an interface for loading and saving the index (an Adaptive Radix Tree)
@@ -15,20 +15,23 @@ type Indexer interface {
 
 // NewIndexer returns an instance of the default `Indexer` implemtnation
 // which perists the index (an Adaptive Radix Tree) as a binary blob on file
-func NewIndexer() Indexer {
-	return &indexer{}
+// on `fsys`
+func NewIndexer(fsys fs.FS) Indexer {
+	return &indexer{fs: fsys}
 }
 
-type indexer struct{}
+type indexer struct {
+	fs fs.FS
+}
 
 func (i *indexer) Load(path string, maxKeySize uint32) (art.Tree, bool, error) {
 	t := art.New()
 
-	if !internal.Exists(path) {
+	if !fs.Exists(i.fs, path) {
 		return t, false, nil
 	}
 
-	f, err := os.Open(path)
+	f, err := i.fs.Open(path)
 	if err != nil {
 		return t, true, err
 	}
@@ -41,7 +44,7 @@ func (i *indexer) Load(path string, maxKeySize uint32) (art.Tree, bool, error) {
 }
 
 func (i *indexer) Save(t art.Tree, path string) error {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	f, err := i.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
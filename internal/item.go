@@ -4,7 +4,9 @@ package internal
 // internal Adaptive Radix Tree to hold an in-memory structure mapping keys to
 // locations on disk of where the value(s) can be read from.
 type Item struct {
-	FileID int   `json:"fileid"`
-	Offset int64 `json:"offset"`
-	Size   int64 `json:"size"`
+	FileID  int   `json:"fileid"`
+	Offset  int64 `json:"offset"`
+	Size    int64 `json:"size"`
+	Expiry  int64 `json:"expiry,omitempty"`
+	ModTime int64 `json:"modtime,omitempty"`
 }
@@ -101,6 +101,48 @@ func (_m *Datafile) ReadAt(index int64, size int64) (internal.Entry, error) {
 	return r0, r1
 }
 
+// ReadValueSize provides a mock function with given fields: index
+func (_m *Datafile) ReadValueSize(index int64) (int64, bool, error) {
+	ret := _m.Called(index)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(int64) int64); ok {
+		r0 = rf(index)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(int64) bool); ok {
+		r1 = rf(index)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(int64) error); ok {
+		r2 = rf(index)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// Seal provides a mock function with given fields:
+func (_m *Datafile) Seal() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Size provides a mock function with given fields:
 func (_m *Datafile) Size() int64 {
 	ret := _m.Called()
@@ -156,3 +198,31 @@ func (_m *Datafile) Write(_a0 internal.Entry) (int64, int64, error) {
 
 	return r0, r1, r2
 }
+
+// WriteRaw provides a mock function with given fields: _a0
+func (_m *Datafile) WriteRaw(_a0 []byte) (int64, int64, error) {
+	ret := _m.Called(_a0)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func([]byte) int64); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func([]byte) int64); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func([]byte) error); ok {
+		r2 = rf(_a0)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
@@ -0,0 +1,38 @@
+package internal
+
+// Observer is notified of lifecycle events of an open database. It is
+// exposed publicly as `bitcask.Observer`. Its methods are called
+// synchronously with the database locked, so they must be cheap and must not
+// call back into the database.
+type Observer interface {
+	// DatafileRolled is called when the current datafile `oldID` reached its
+	// maximum size and writes moved on to the new datafile `newID`
+	DatafileRolled(oldID, newID int)
+
+	// MergeStarted is called when a merge of `datafiles` datafiles starts
+	MergeStarted(datafiles int)
+
+	// MergeFinished is called when a merge completed successfully, reducing
+	// the datafiles from `before` to `after` and their size by `reclaimed`
+	// bytes
+	MergeFinished(before, after int, reclaimed int64)
+
+	// IndexWritten is called when the index of `keys` keys was saved to disk
+	IndexWritten(keys int)
+}
+
+// NopObserver is an Observer that ignores all events. It can be embedded to
+// implement only some of the methods of Observer.
+type NopObserver struct{}
+
+// DatafileRolled implements Observer
+func (NopObserver) DatafileRolled(oldID, newID int) {}
+
+// MergeStarted implements Observer
+func (NopObserver) MergeStarted(datafiles int) {}
+
+// MergeFinished implements Observer
+func (NopObserver) MergeFinished(before, after int, reclaimed int64) {}
+
+// IndexWritten implements Observer
+func (NopObserver) IndexWritten(keys int) {}
@@ -0,0 +1,18 @@
+package internal
+
+// Stats holds statistics about an open database. It is exposed publicly as
+// `bitcask.Stats`.
+type Stats struct {
+	Datafiles int
+	Keys      int
+	Size      int64
+
+	// DeadBytes is the size of the entries in the datafiles that were
+	// overwritten or deleted (including the deletion markers), which is the
+	// space a Merge() reclaims
+	DeadBytes int64
+
+	// RecoveredFromIndex is true if the database was last (re)opened from
+	// its index file and false if the index was rebuilt from the datafiles
+	RecoveredFromIndex bool
+}
@@ -1,56 +1,119 @@
 package internal
 
 import (
-	"fmt"
-	"os"
+	"io"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/prologic/bitcask/internal/fs"
 )
 
-// Exists returns `true` if the given `path` on the current file system exists
-func Exists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
-}
+// DirSize returns the space occupied by the given `path` on `fsys`. This is
+// the total footprint of a database including its index, config, lock and any
+// temporary merge files (see DataSize).
+func DirSize(fsys fs.FS, path string) (int64, error) {
+	infos, err := fsys.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
 
-// DirSize returns the space occupied by the given `path` on disk on the current
-// file system.
-func DirSize(path string) (int64, error) {
 	var size int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	for _, info := range infos {
 		if !info.IsDir() {
 			size += info.Size()
+			continue
+		}
+		n, err := DirSize(fsys, filepath.Join(path, info.Name()))
+		if err != nil {
+			return 0, err
 		}
-		return err
-	})
-	return size, err
+		size += n
+	}
+	return size, nil
+}
+
+// DatafileMagic is the header written at the start of every datafile of a
+// database created with WithDatafileMagic()
+const DatafileMagic = "bitcask\x00"
+
+// DataSize returns the space occupied on disk by the datafiles with the
+// extension `ext` (see GetDatafiles) in the given `path` only.
+func DataSize(fsys fs.FS, path, ext string, magic bool) (int64, error) {
+	fns, err := GetDatafiles(fsys, path, ext, magic)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, fn := range fns {
+		info, err := fsys.Stat(fn)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
 }
 
 // GetDatafiles returns a list of all data files stored in the database path
-// given by `path`. All datafiles are identified by the the glob `*.data` and
-// the basename is represented by an monotomic increasing integer.
-func GetDatafiles(path string) ([]string, error) {
-	fns, err := filepath.Glob(fmt.Sprintf("%s/*.data", path))
+// given by `path` on `fsys`. All datafiles are identified by the the suffix
+// `<ext>` and the basename is represented by an monotomic increasing integer.
+// If `magic` is true only files starting with DatafileMagic are returned.
+func GetDatafiles(fsys fs.FS, path, ext string, magic bool) ([]string, error) {
+	infos, err := fsys.ReadDir(path)
 	if err != nil {
 		return nil, err
 	}
+
+	var fns []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ext) {
+			fns = append(fns, filepath.Join(path, info.Name()))
+		}
+	}
+	if magic {
+		var matched []string
+		for _, fn := range fns {
+			ok, err := hasDatafileMagic(fsys, fn)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matched = append(matched, fn)
+			}
+		}
+		fns = matched
+	}
 	sort.Strings(fns)
 	return fns, nil
 }
 
+func hasDatafileMagic(fsys fs.FS, fn string) (bool, error) {
+	f, err := fsys.Open(fn)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(DatafileMagic))
+	if _, err := io.ReadFull(f, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(header) == DatafileMagic, nil
+}
+
 // ParseIds will parse a list of datafiles as returned by `GetDatafiles` and
 // extract the id part and return a slice of ints.
-func ParseIds(fns []string) ([]int, error) {
+func ParseIds(fns []string, ext string) ([]int, error) {
 	var ids []int
 	for _, fn := range fns {
 		fn = filepath.Base(fn)
-		ext := filepath.Ext(fn)
-		if ext != ".data" {
+		if !strings.HasSuffix(fn, ext) {
 			continue
 		}
 		id, err := strconv.ParseInt(strings.TrimSuffix(fn, ext), 10, 32)
@@ -0,0 +1,133 @@
+package bitcask
+
+import (
+	"os"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+)
+
+// Iterator iterates over a point-in-time snapshot of the keys (and their
+// values) matching a prefix. The keys and the datafiles holding their values
+// are captured when the Iterator is created, so the Iterator keeps returning
+// the values as of creation even if keys are later overwritten or a Merge()
+// removes the datafiles they were read from. Close() must be called to
+// release the datafiles held open by the Iterator. Values stored in blob files
+// (see WithLargeValueThreshold) are the exception: those overwritten before a
+// Merge() or GCBlobs() are removed by it and can no longer be read.
+type Iterator struct {
+	keys      [][]byte
+	items     []internal.Item
+	datafiles map[int]data.Datafile
+	blobs     *blobStore
+	verify    bool
+
+	pos   int
+	key   []byte
+	value []byte
+	err   error
+}
+
+// Iterator returns a new Iterator over all keys matching the given prefix.
+// An empty prefix iterates over all keys in the database.
+func (b *Bitcask) Iterator(prefix []byte) (*Iterator, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	it := &Iterator{
+		datafiles: make(map[int]data.Datafile),
+		blobs:     b.blobs,
+		verify:    !b.config.NoVerifyChecksums,
+	}
+
+	b.forEachPrefix(b.storedKey(prefix), func(node art.Node) bool {
+		it.keys = append(it.keys, b.stripKey(node.Key()))
+		it.items = append(it.items, node.Value().(internal.Item))
+		return true
+	})
+
+	// Pin every datafile referenced by the snapshot with our own handles
+	// so a concurrent Merge() can't close them out from under us.
+	for _, item := range it.items {
+		if _, ok := it.datafiles[item.FileID]; ok {
+			continue
+		}
+		df, err := b.openDatafile(item.FileID, true)
+		if err != nil {
+			it.Close()
+			if os.IsNotExist(err) {
+				return nil, ErrDatafileNotFound
+			}
+			return nil, err
+		}
+		it.datafiles[item.FileID] = df
+	}
+
+	return it, nil
+}
+
+// Next advances the Iterator to the next key and reads its value. It returns
+// false when there are no more keys or an error occurred (see Err()).
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.pos >= len(it.keys) {
+		return false
+	}
+
+	key, item := it.keys[it.pos], it.items[it.pos]
+	it.pos++
+
+	df, ok := it.datafiles[item.FileID]
+	if !ok {
+		it.err = ErrIteratorClosed
+		return false
+	}
+
+	e, err := readAt(df, item)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	value, err := it.blobs.value(e)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	if it.verify && !e.Verify(value) {
+		it.err = ErrChecksumFailed
+		return false
+	}
+
+	it.key, it.value = key, value
+	return true
+}
+
+// Key returns the current key of the Iterator
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the current key of the Iterator
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the first error encountered by the Iterator, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the datafiles held open by the Iterator. Any further
+// calls to Next() return false.
+func (it *Iterator) Close() (err error) {
+	for id, df := range it.datafiles {
+		if e := df.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(it.datafiles, id)
+	}
+	it.pos = len(it.keys)
+	return
+}
@@ -0,0 +1,71 @@
+package bitcask
+
+import (
+	"errors"
+)
+
+// errLoaderPanicked is returned by GetOrLoad() to the calls waiting on a
+// loader that panicked
+var errLoaderPanicked = errors.New("error: loader panicked")
+
+// loadCall is a call of the loader of GetOrLoad() in progress
+type loadCall struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// GetOrLoad retrieves the value of the given key like Get(). If the key is not
+// found, `loader` is called to load its value, which is stored with Put() and
+// returned. If `loader` fails its error is returned and nothing is stored.
+//
+// Concurrent calls missing the same key share a single call of `loader`: the
+// first one loads the value while the others wait for it and return the same
+// result.
+func (b *Bitcask) GetOrLoad(key []byte, loader func(key []byte) ([]byte, error)) ([]byte, error) {
+	value, err := b.Get(key)
+	if err != ErrKeyNotFound {
+		return value, err
+	}
+
+	// Coalesce on the stored form of the key so keys normalized to the same
+	// form share a load
+	k := string(b.storedKey(key))
+
+	b.loadMu.Lock()
+	if call, ok := b.loads[k]; ok {
+		b.loadMu.Unlock()
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		return append([]byte(nil), call.value...), nil
+	}
+	call := &loadCall{done: make(chan struct{})}
+	if b.loads == nil {
+		b.loads = make(map[string]*loadCall)
+	}
+	b.loads[k] = call
+	b.loadMu.Unlock()
+
+	defer func() {
+		b.loadMu.Lock()
+		delete(b.loads, k)
+		b.loadMu.Unlock()
+		close(call.done)
+	}()
+
+	// The key may have been stored by a load that finished since the miss
+	if call.value, call.err = b.Get(key); call.err != ErrKeyNotFound {
+		return call.value, call.err
+	}
+
+	call.err = errLoaderPanicked
+	if call.value, call.err = loader(key); call.err == nil {
+		call.err = b.Put(key, call.value)
+	}
+	if call.err != nil {
+		call.value = nil
+	}
+	return call.value, call.err
+}
@@ -0,0 +1,54 @@
+package bitcask
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// metricsLogger logs the statistics of the database every `interval` until
+// stopMetricsLogger() is called
+func (b *Bitcask) metricsLogger(interval time.Duration, logf func(format string, args ...interface{})) {
+	defer close(b.metricsDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.hook(func() { b.logMetrics(logf) })
+		case <-b.metricsStop:
+			return
+		}
+	}
+}
+
+func (b *Bitcask) stopMetricsLogger() {
+	if b.metricsStop == nil {
+		return
+	}
+	close(b.metricsStop)
+	<-b.metricsDone
+	b.metricsStop = nil
+}
+
+// logMetrics logs Stats() along with the live bytes and the current datafile
+func (b *Bitcask) logMetrics(logf func(format string, args ...interface{})) {
+	stats, err := b.Stats()
+	if err != nil {
+		logf("bitcask: error getting stats of %s: %s", b.path, err)
+		return
+	}
+
+	b.mu.RLock()
+	liveBytes := b.liveBytes
+	currID, currSize := b.curr.FileID(), b.curr.Size()
+	readOnly := b.writeErr != nil
+	b.mu.RUnlock()
+
+	logf(
+		"bitcask: %s: datafiles=%d keys=%d size=%d dead_bytes=%d live_bytes=%d current_datafile=%d current_size=%d merging=%t read_only=%t",
+		b.path, stats.Datafiles, stats.Keys, stats.Size, stats.DeadBytes, liveBytes,
+		currID, currSize, atomic.LoadInt32(&b.merging) == 1, readOnly,
+	)
+}
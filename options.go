@@ -1,6 +1,15 @@
 package bitcask
 
-import "github.com/prologic/bitcask/internal/config"
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/prologic/bitcask/internal/config"
+	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/internal/fs"
+)
 
 const (
 	// DefaultMaxDatafileSize is the default maximum datafile size in bytes
@@ -14,6 +23,14 @@ const (
 
 	// DefaultSync is the default file synchronization action
 	DefaultSync = false
+
+	// DefaultDatafileExtension is the default file extension of datafiles
+	DefaultDatafileExtension = ".data"
+)
+
+var (
+	errInvalidDatafileExtension = errors.New("error: invalid datafile extension")
+	errInvalidEntryAlignment    = errors.New("error: invalid entry alignment")
 )
 
 // Option is a function that takes a config struct and modifies it
@@ -52,11 +69,516 @@ func WithSync(sync bool) Option {
 	}
 }
 
+// WithNoIndexFile disables (or enables again) persisting the index file on
+// Close(). The index is then always rebuilt by replaying the datafiles on
+// open, which trades slower startup for less work on shutdown (suitable for
+// write-once archives). The setting is saved in config.json.
+func WithNoIndexFile(enabled bool) Option {
+	return func(cfg *config.Config) error {
+		cfg.NoIndexFile = enabled
+		return nil
+	}
+}
+
+// WithMergeKeepVersions causes Merge() to retain the `n` most recent versions
+// of each live key rather than only the current one. Versions written before
+// a key's most recent deletion are not retained.
+func WithMergeKeepVersions(n int) Option {
+	return func(cfg *config.Config) error {
+		cfg.MergeKeepVersions = n
+		return nil
+	}
+}
+
+// WithKeyPrefix transparently prepends `prefix` to every key written and
+// strips it from every key returned (Scan, Keys, Fold and Iterator). Only keys
+// with the prefix are visible, making it possible to namespace several logical
+// datasets in one database. Note that the prefix counts towards the maximum key
+// size and that Len() and Stats() still cover the whole database.
+func WithKeyPrefix(prefix []byte) Option {
+	return func(cfg *config.Config) error {
+		cfg.KeyPrefix = prefix
+		return nil
+	}
+}
+
+// WithKeyNormalizer applies `normalizer` to every key passed to Get, Has,
+// Put, Delete, Scan and Iterator so that keys which normalize to the same form
+// are treated as the same key. Keys are stored in their normalized form which
+// is what Scan, Keys and Fold return. Scan prefixes are normalized too, so the
+// normalizer should preserve prefixes. The normalizer must not modify its
+// argument in place.
+func WithKeyNormalizer(normalizer func([]byte) []byte) Option {
+	return func(cfg *config.Config) error {
+		cfg.KeyNormalizer = normalizer
+		return nil
+	}
+}
+
+// WithCaseInsensitiveKeys makes keys case insensitive by lowercasing them
+// (see WithKeyNormalizer).
+func WithCaseInsensitiveKeys() Option {
+	return WithKeyNormalizer(bytes.ToLower)
+}
+
+// WithMergeTrigger sets a predicate that is evaluated after every write. When
+// it returns true a Merge() is scheduled in the background (only one merge
+// runs at a time). The Stats passed are computed from in-memory state and
+// their Size only accounts for the datafiles. The predicate is called on the
+// writer's goroutine and should be cheap.
+func WithMergeTrigger(trigger func(Stats) bool) Option {
+	return func(cfg *config.Config) error {
+		cfg.MergeTrigger = trigger
+		return nil
+	}
+}
+
+// WithAutoMergeRatio schedules a Merge() in the background after a write
+// once the dead bytes (see Stats) make up more than the ratio `r` (between 0
+// and 1) of the size of the datafiles. Unlike a fixed size, the ratio suits
+// databases of any size. It can be combined with WithMergeTrigger(), in which
+// case a merge is scheduled when either fires.
+func WithAutoMergeRatio(r float64) Option {
+	return func(cfg *config.Config) error {
+		cfg.AutoMergeRatio = r
+		return nil
+	}
+}
+
+// WithBackgroundMergeOnClose causes Close() to Merge() the database before
+// closing it, so that processes accumulating writes compact the database at
+// shutdown instead of while serving. Close() blocks until the merge is done;
+// it is skipped if another merge is already in progress. If the merge fails
+// the database is still closed as usual and the merge error is returned.
+func WithBackgroundMergeOnClose() Option {
+	return func(cfg *config.Config) error {
+		cfg.MergeOnClose = true
+		return nil
+	}
+}
+
+// WithDatafileFooters causes datafiles to be sealed with a footer holding the
+// checksum of their contents when the database rolls over to the next one, so
+// their integrity can be verified without decoding every entry (see
+// WithVerifyDatafileFooters and the recover command). Datafiles without a
+// footer are still read as usual.
+func WithDatafileFooters() Option {
+	return func(cfg *config.Config) error {
+		cfg.DatafileFooters = true
+		return nil
+	}
+}
+
+// WithVerifyDatafileFooters causes Open() to verify every datafile sealed with
+// a footer (see WithDatafileFooters) against its checksum, failing with
+// ErrFooterMismatch if one was modified since.
+func WithVerifyDatafileFooters() Option {
+	return func(cfg *config.Config) error {
+		cfg.VerifyFooters = true
+		return nil
+	}
+}
+
+// WithObserver sets an Observer notified of datafile rollovers, merges and
+// index writes, for example to export metrics without polling Stats().
+func WithObserver(observer Observer) Option {
+	return func(cfg *config.Config) error {
+		cfg.Observer = observer
+		return nil
+	}
+}
+
+// WithFileSystem stores the database on the file system `fsys` instead of
+// the one of the operating system, for example to run on an in-memory or
+// networked file system. Datafiles on another file system are never memory
+// mapped and the database is not locked against being opened by other
+// processes, which the file system must prevent itself if needed.
+func WithFileSystem(fsys FS) Option {
+	return func(cfg *config.Config) error {
+		cfg.FS = fsys
+		return nil
+	}
+}
+
+// WithInitialCapacity hints the expected number of keys so that internal
+// per-key structures (such as those built by Merge()) can be pre-sized. The
+// in-memory index (an Adaptive Radix Tree) grows on demand and does not
+// support reserving capacity.
+func WithInitialCapacity(keys int) Option {
+	return func(cfg *config.Config) error {
+		cfg.InitialCapacity = keys
+		return nil
+	}
+}
+
+// WithStrictDeletes causes Delete() to return ErrKeyNotFound for keys that
+// don't exist instead of silently succeeding
+func WithStrictDeletes() Option {
+	return func(cfg *config.Config) error {
+		cfg.StrictDeletes = true
+		return nil
+	}
+}
+
+// WithReadRepair enables read repair: when Get() finds a value that fails its
+// checksum, the datafiles are scanned for the most recent valid prior version
+// of the key which is returned and rewritten as the current value. This can
+// be slow as it reads every datafile up to the corrupted one.
+func WithReadRepair() Option {
+	return func(cfg *config.Config) error {
+		cfg.ReadRepair = true
+		return nil
+	}
+}
+
+// WithClock sets the clock used whenever the database needs the current time
+// (for example to stamp entries or evaluate expiry). It defaults to time.Now
+// and is mostly useful for deterministic tests.
+func WithClock(clock func() time.Time) Option {
+	return func(cfg *config.Config) error {
+		cfg.Clock = clock
+		return nil
+	}
+}
+
+// WithVerifyChecksums controls whether the checksum of every value read is
+// verified, returning ErrChecksumFailed for corrupt values. It is enabled by
+// default. Disabling it lowers the latency of reading large values but
+// corrupt values are then returned as is, so only do so on trusted storage.
+func WithVerifyChecksums(verify bool) Option {
+	return func(cfg *config.Config) error {
+		cfg.NoVerifyChecksums = !verify
+		return nil
+	}
+}
+
+// WithChecksumOnWrite controls whether the checksum of every value written is
+// computed. It is enabled by default. Disabling it saves hashing the values of
+// append-heavy workloads that verify their data elsewhere, but the values
+// written without a checksum aren't verified when read until a Merge() with
+// it enabled rewrites them.
+func WithChecksumOnWrite(enabled bool) Option {
+	return func(cfg *config.Config) error {
+		cfg.NoWriteChecksums = !enabled
+		return nil
+	}
+}
+
+// WithPreallocateDatafile reserves disk space for `size` bytes, typically the
+// maximum datafile size, whenever a datafile is opened for writing so it
+// doesn't fragment as it grows. Unused space is released when the datafile
+// is closed. It is only supported on Linux and ignored elsewhere.
+func WithPreallocateDatafile(size int) Option {
+	return func(cfg *config.Config) error {
+		cfg.PreallocateDatafile = size
+		return nil
+	}
+}
+
+// WithLargeValueThreshold stores values larger than `size` bytes in blob
+// files of their own, referenced from the datafiles, instead of inline. A
+// merge then only rewrites the references, which keeps merges cheap for
+// databases holding large values. Values are still limited by
+// WithMaxValueSize().
+func WithLargeValueThreshold(size int) Option {
+	return func(cfg *config.Config) error {
+		cfg.LargeValueThreshold = size
+		return nil
+	}
+}
+
+// WithEntryAlignment pads every entry written so it ends on a multiple of
+// `n` bytes (at most 256), which aligns the entries of datafiles to `n` bytes
+// for faster memory mapped reads at the cost of some disk space. The padding
+// is recorded in each entry so datafiles can be read regardless of this
+// option.
+func WithEntryAlignment(n int) Option {
+	return func(cfg *config.Config) error {
+		if n < 1 || n > codec.MaxAlignment {
+			return errInvalidEntryAlignment
+		}
+		cfg.EntryAlignment = n
+		return nil
+	}
+}
+
+// WithReadOnlyAfterError makes the database read-only once a write to its
+// datafiles fails, for example because the disk is full, so that further
+// writes can't make matters worse. Writes then return ErrReadOnly until
+// ResetReadOnly() is called, while reads carry on. Health() reports the
+// error that made the database read-only.
+func WithReadOnlyAfterError() Option {
+	return func(cfg *config.Config) error {
+		cfg.ReadOnlyAfterError = true
+		return nil
+	}
+}
+
+// WithMergeConcurrency causes Merge() to read the values of up to `n` keys
+// concurrently while they are written to the merged database, which is
+// faster on storage that serves parallel reads well. The values are still
+// written in key order so the merged datafiles are the same as without it.
+// It has no effect together with WithMergeKeepVersions().
+func WithMergeConcurrency(n int) Option {
+	return func(cfg *config.Config) error {
+		cfg.MergeConcurrency = n
+		return nil
+	}
+}
+
+// WithMergeVerify causes Merge() to check the merged database (see Check())
+// before it replaces the original datafiles. If any of its keys can't be read
+// back or fails its checksum the merge is aborted with ErrMergeVerifyFailed,
+// leaving the original datafiles untouched.
+func WithMergeVerify() Option {
+	return func(cfg *config.Config) error {
+		cfg.MergeVerify = true
+		return nil
+	}
+}
+
+// WithMergeVerifyKeyCount causes Merge() to replay the merged datafiles as
+// Open() would and compare the number of keys found with the number of keys
+// of the database, not counting expired keys. If they differ, for example
+// because a key with an empty value is replayed as deleted, the merge is
+// aborted with ErrMergeVerifyFailed, leaving the original datafiles untouched.
+func WithMergeVerifyKeyCount() Option {
+	return func(cfg *config.Config) error {
+		cfg.MergeVerifyKeyCount = true
+		return nil
+	}
+}
+
+// WithMergeTargetFileSize sets the maximum datafile size used for the
+// datafiles written by Merge(). Setting this larger than the maximum datafile
+// size coalesces many small datafiles into fewer large ones.
+func WithMergeTargetFileSize(size int) Option {
+	return func(cfg *config.Config) error {
+		cfg.MergeTargetFileSize = size
+		return nil
+	}
+}
+
+// WithNoMmap disables memory mapping of readonly datafiles so all reads use
+// ReadAt() syscalls instead. This trades some read performance for a much
+// smaller virtual memory footprint on databases with many datafiles.
+func WithNoMmap() Option {
+	return func(cfg *config.Config) error {
+		cfg.NoMmap = true
+		return nil
+	}
+}
+
+// WithLockTimeout makes Open() wait up to `timeout` for the database lock to
+// be released by another process before failing with ErrDatabaseLocked.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.LockTimeout = timeout
+		return nil
+	}
+}
+
+// WithOpenTimeout makes Open() give up rebuilding the index from the
+// datafiles after `timeout`, returning context.DeadlineExceeded, rather than
+// taking arbitrarily long on a large database without an index file. See
+// also OpenContext().
+func WithOpenTimeout(timeout time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.OpenTimeout = timeout
+		return nil
+	}
+}
+
+// WithDatafileSync controls whether a new datafile and the directory entry
+// for it are synced to disk as soon as it is created, when the current
+// datafile is rolled over or a new database is opened, so a crash can't lose
+// it. This is independent of WithSync() and is enabled by default.
+func WithDatafileSync(enabled bool) Option {
+	return func(cfg *config.Config) error {
+		cfg.NoDatafileSync = !enabled
+		return nil
+	}
+}
+
+// WithSyncInterval syncs the current datafile to disk in the background every
+// `interval`, bounding how many recent writes can be lost on a crash without
+// the cost of syncing on every write (see WithSync).
+func WithSyncInterval(interval time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.SyncInterval = interval
+		return nil
+	}
+}
+
+// WithMetricsInterval logs the statistics of the database (see Stats()) along
+// with the size of the live entries and the state of the current datafile
+// every `interval` until it is closed. The lines are logged with `logf`, for
+// example logrus.Infof, or with log.Printf if it is nil.
+func WithMetricsInterval(interval time.Duration, logf func(format string, args ...interface{})) Option {
+	return func(cfg *config.Config) error {
+		cfg.MetricsInterval = interval
+		cfg.MetricsLogf = logf
+		return nil
+	}
+}
+
+// WithDatafileExtension sets the file extension of datafiles (by default
+// ".data"). It can only be set when the database is created.
+func WithDatafileExtension(ext string) Option {
+	return func(cfg *config.Config) error {
+		if ext == "" || strings.ContainsAny(ext, "/\\*?[") {
+			return errInvalidDatafileExtension
+		}
+		cfg.DatafileExt = ext
+		return nil
+	}
+}
+
+// WithDatafileMagic writes a magic header at the start of every datafile so
+// only files that belong to the database are picked up when opening it, even
+// if the directory is shared with other files using the same extension. It
+// can only be set when the database is created.
+func WithDatafileMagic() Option {
+	return func(cfg *config.Config) error {
+		cfg.DatafileMagic = true
+		return nil
+	}
+}
+
+// WithModTimes records the time every key is written in its entry so it can
+// be queried with ModTime() and GetWithMeta(). Modification times survive
+// reopening and merging the database. Once enabled it stays enabled for the
+// database.
+func WithModTimes() Option {
+	return func(cfg *config.Config) error {
+		cfg.ModTimes = true
+		return nil
+	}
+}
+
+// WithMaxOpenDatafiles limits the number of readonly datafiles kept open at
+// once to `n`. Datafiles are opened on demand when read from and the least
+// recently used ones closed, bounding the number of file descriptors (and
+// memory maps) used by databases with many datafiles.
+func WithMaxOpenDatafiles(n int) Option {
+	return func(cfg *config.Config) error {
+		cfg.MaxOpenDatafiles = n
+		return nil
+	}
+}
+
+// WithMaxDatafiles caps the number of datafiles (including the current one)
+// at `n` by merging the database before a write would roll over to the
+// (n+1)th datafile, bounding the size of the database directory and the file
+// descriptors used by write-heavy databases whose merges aren't scheduled.
+// The merge runs on the goroutine of the write that filled the current
+// datafile, which stalls until it is done, and other writes are blocked while
+// the merged datafiles replace the original ones. The cap isn't strict: the
+// datafiles roll over regardless if a merge wouldn't reclaim any space (so
+// `n` must leave room for the live data), if another merge is in progress or
+// if it fails. It combines with WithAutoMergeRatio() and WithMergeTrigger().
+func WithMaxDatafiles(n int) Option {
+	return func(cfg *config.Config) error {
+		cfg.MaxDatafiles = n
+		return nil
+	}
+}
+
+// WithWriteTimeout bounds how long writes (Put, Delete and friends) wait to
+// acquire the database's lock, for example behind a long running Merge(),
+// before giving up with ErrWriteTimeout.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.WriteTimeout = timeout
+		return nil
+	}
+}
+
+// WithDedupWrites skips writing a key whose current value is equal to the
+// value being written. This avoids growing the datafiles for workloads that
+// rewrite identical values at the cost of reading the current value on every
+// write. Writes with a TTL are never skipped.
+func WithDedupWrites() Option {
+	return func(cfg *config.Config) error {
+		cfg.DedupWrites = true
+		return nil
+	}
+}
+
+// WithSecondaryIndex adds a secondary index `name` mapping the terms returned
+// by `extract` for each key and value written to the keys they were extracted
+// from, so keys can be looked up by term with Lookup(). Secondary indexes are
+// kept in memory only and are rebuilt by reading every value when the
+// database is opened (or merged).
+func WithSecondaryIndex(name string, extract func(key, value []byte) [][]byte) Option {
+	return func(cfg *config.Config) error {
+		if cfg.SecondaryIndexes == nil {
+			cfg.SecondaryIndexes = make(map[string]func(key, value []byte) [][]byte)
+		}
+		cfg.SecondaryIndexes[name] = extract
+		return nil
+	}
+}
+
+// WithPanicHandler recovers panics in the callbacks passed to Scan(),
+// ReverseScan(), Fold(), FoldWithValue() and ForEachByFile(), which then
+// return ErrCallbackPanicked, calling `handler` with the value recovered.
+// Without a panic handler such panics carry on to the caller, leaving the
+// database unlocked. Panics in hooks (Observer methods, secondary index
+// extract functions, merge triggers and metrics loggers) are always
+// recovered, and are passed to `handler` rather than logged. A panicking
+// extract function indexes no terms and a panicking merge trigger triggers
+// no merge.
+func WithPanicHandler(handler func(interface{})) Option {
+	return func(cfg *config.Config) error {
+		cfg.PanicHandler = handler
+		return nil
+	}
+}
+
+// WithoutConfigFile causes the database to neither read nor write its
+// config.json file, for example if the directory is read-only except for the
+// datafiles. The configuration, including the limits and the datafile format
+// otherwise persisted in config.json, then comes solely from the options
+// given, which must match those the database was created with.
+func WithoutConfigFile() Option {
+	return func(cfg *config.Config) error {
+		cfg.NoConfigFile = true
+		return nil
+	}
+}
+
+// withConfig replaces the whole configuration with a copy of `c`
+func withConfig(c *config.Config) Option {
+	return func(cfg *config.Config) error {
+		*cfg = *c
+		return nil
+	}
+}
+
+// optionsConfig returns the default configuration with `options` applied,
+// which has the options needed before the configuration can be loaded (see
+// WithFileSystem and WithoutConfigFile)
+func optionsConfig(options []Option) (*config.Config, error) {
+	cfg := newDefaultConfig()
+	for _, opt := range options {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.FS == nil {
+		cfg.FS = fs.OS
+	}
+	return cfg, nil
+}
+
 func newDefaultConfig() *config.Config {
 	return &config.Config{
 		MaxDatafileSize: DefaultMaxDatafileSize,
 		MaxKeySize:      DefaultMaxKeySize,
 		MaxValueSize:    DefaultMaxValueSize,
 		Sync:            DefaultSync,
+		DatafileExt:     DefaultDatafileExtension,
+		FS:              fs.OS,
 	}
 }
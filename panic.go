@@ -0,0 +1,40 @@
+package bitcask
+
+import (
+	"log"
+)
+
+// callback calls the user callback `f` passed to a method such as Fold(). If
+// it panics and a panic handler is set (see WithPanicHandler) the panic is
+// passed to it and ErrCallbackPanicked returned, otherwise the panic carries
+// on to the caller of the method, which must not leave the database locked.
+func (b *Bitcask) callback(f func() error) (err error) {
+	if b.config.PanicHandler == nil {
+		return f()
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			b.config.PanicHandler(p)
+			err = ErrCallbackPanicked
+		}
+	}()
+	return f()
+}
+
+// hook calls the user hook `f`, such as an Observer method or the extract
+// function of a secondary index. Hooks run on behalf of other calls, often
+// with the database locked, so a panic is always recovered and passed to the
+// panic handler (see WithPanicHandler) or logged if there is none.
+func (b *Bitcask) hook(f func()) {
+	defer func() {
+		if p := recover(); p != nil {
+			if b.config.PanicHandler != nil {
+				b.config.PanicHandler(p)
+			} else {
+				log.Printf("bitcask: recovered panic in hook: %v", p)
+			}
+		}
+	}()
+	f()
+}
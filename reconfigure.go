@@ -0,0 +1,220 @@
+package bitcask
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/config"
+)
+
+// reconfigurable are the settings Reconfigure() can change
+var reconfigurable = map[string]bool{
+	"MaxDatafileSize": true,
+	"MaxKeySize":      true,
+	"MaxValueSize":    true,
+	"Sync":            true,
+	"NoDatafileSync":  true,
+	"SyncInterval":    true,
+	"NoIndexFile":     true,
+}
+
+// Reconfigure applies the given options to the open database and saves the
+// resulting configuration. Only the maximum datafile, key and value sizes
+// (WithMaxDatafileSize, WithMaxKeySize and WithMaxValueSize), syncing
+// (WithSync, WithDatafileSync and WithSyncInterval) and persisting the index
+// (WithNoIndexFile) can be changed. The key
+// and value sizes can't be lowered below those of any entry already stored,
+// and options changing other settings are rejected, in which case
+// ErrIncompatibleConfig (or ErrDatafileFormatChanged) is returned and nothing
+// is changed. If a merge is in progress ErrMergeInProgress is returned, and
+// ErrDatabaseClosed once the database is closed.
+func (b *Bitcask) Reconfigure(options ...Option) (err error) {
+	// The syncer syncs the current datafile with the read lock held so it
+	// is restarted with the new interval once the write lock is released
+	var restart bool
+	defer func() {
+		if restart && err == nil {
+			b.restartSyncer()
+		}
+	}()
+
+	if err := b.lockWrite(); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrDatabaseClosed
+	}
+
+	cfg := *b.config
+	// Options add secondary indexes to the map in place
+	if b.config.SecondaryIndexes != nil {
+		cfg.SecondaryIndexes = make(map[string]func(key, value []byte) [][]byte, len(b.config.SecondaryIndexes))
+		for name, extract := range b.config.SecondaryIndexes {
+			cfg.SecondaryIndexes[name] = extract
+		}
+	}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return err
+		}
+	}
+
+	if atomic.LoadInt32(&b.merging) == 1 {
+		return ErrMergeInProgress
+	}
+
+	if err := b.checkReconfigure(&cfg); err != nil {
+		return err
+	}
+
+	restart = cfg.SyncInterval != b.config.SyncInterval
+	resize := cfg.MaxKeySize != b.config.MaxKeySize || cfg.MaxValueSize != b.config.MaxValueSize
+
+	b.config.MaxDatafileSize = cfg.MaxDatafileSize
+	b.config.MaxKeySize = cfg.MaxKeySize
+	b.config.MaxValueSize = cfg.MaxValueSize
+	b.config.Sync = cfg.Sync
+	b.config.NoDatafileSync = cfg.NoDatafileSync
+	b.config.SyncInterval = cfg.SyncInterval
+	b.config.NoIndexFile = cfg.NoIndexFile
+
+	// The datafiles decode entries within the sizes they were opened with
+	if resize {
+		if err := b.reopenDatafiles(); err != nil {
+			return err
+		}
+	}
+
+	return b.saveConfig()
+}
+
+// checkReconfigure returns an error if the configuration `cfg` can't be
+// applied to the open database. The caller must hold the write lock.
+func (b *Bitcask) checkReconfigure(cfg *config.Config) error {
+	if cfg.DatafileExt != b.config.DatafileExt || cfg.DatafileMagic != b.config.DatafileMagic {
+		return ErrDatafileFormatChanged
+	}
+	if changed := changedSettings(b.config, cfg); len(changed) > 0 {
+		return fmt.Errorf("%w: %s can't be changed", ErrIncompatibleConfig, strings.Join(changed, ", "))
+	}
+	if cfg.MaxDatafileSize <= 0 {
+		return fmt.Errorf("%w: invalid max datafile size %d", ErrIncompatibleConfig, cfg.MaxDatafileSize)
+	}
+
+	if cfg.MaxKeySize >= b.config.MaxKeySize && cfg.MaxValueSize >= b.config.MaxValueSize {
+		return nil
+	}
+
+	// Every entry must remain readable with the lowered sizes
+	var (
+		maxKeySize   uint32
+		maxValueSize uint64
+	)
+	for _, id := range b.datafileIDs() {
+		err := b.scanDatafile(id, func(e internal.Entry, item internal.Item) error {
+			if n := uint32(len(e.Key)); n > maxKeySize {
+				maxKeySize = n
+			}
+			if n := uint64(len(e.Value)); n > maxValueSize {
+				maxValueSize = n
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if maxKeySize > cfg.MaxKeySize {
+		return fmt.Errorf("%w: max key size below stored key of %d bytes", ErrIncompatibleConfig, maxKeySize)
+	}
+	if maxValueSize > cfg.MaxValueSize {
+		return fmt.Errorf("%w: max value size below stored value of %d bytes", ErrIncompatibleConfig, maxValueSize)
+	}
+	return nil
+}
+
+// reopenDatafiles closes and opens the datafiles again with the current
+// configuration, keeping the index. The caller must hold the write lock.
+func (b *Bitcask) reopenDatafiles() error {
+	if err := b.closeDatafiles(); err != nil {
+		return err
+	}
+
+	return b.openDatafiles()
+}
+
+// openDatafiles opens the closed datafiles again, keeping the index, after
+// truncating any partially written entry at the end of the current datafile.
+// The caller must hold the write lock.
+func (b *Bitcask) openDatafiles() error {
+	if err := repairLastDatafile(b.path, b.config); err != nil {
+		return err
+	}
+
+	datafiles, lastID, err := loadDatafiles(b.path, b.config, b.cache)
+	if err != nil {
+		return err
+	}
+
+	curr, err := b.openDatafile(lastID, false)
+	if err != nil {
+		return err
+	}
+
+	b.curr = curr
+	b.datafiles = datafiles
+	return nil
+}
+
+// changedSettings returns the names of the settings of `cfg` that differ from
+// `orig`, other than those Reconfigure() can change. Functions are compared
+// by identity.
+func changedSettings(orig, cfg *config.Config) []string {
+	var changed []string
+	a, b := reflect.ValueOf(orig).Elem(), reflect.ValueOf(cfg).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Name
+		if !reconfigurable[name] && !sameSetting(a.Field(i), b.Field(i)) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// sameSetting reports whether the settings `a` and `b` are the same
+func sameSetting(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Func:
+		return a.Pointer() == b.Pointer()
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for _, key := range a.MapKeys() {
+			v := b.MapIndex(key)
+			if !v.IsValid() || !sameSetting(a.MapIndex(key), v) {
+				return false
+			}
+		}
+		return true
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		if a.Elem().Type() != b.Elem().Type() {
+			return false
+		}
+		if a.Elem().Type().Comparable() {
+			return a.Interface() == b.Interface()
+		}
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	default:
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	}
+}
@@ -0,0 +1,144 @@
+package bitcask
+
+import (
+	"errors"
+	"sort"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/internal"
+)
+
+var (
+	// ErrIndexNotFound is the error returned by Lookup() for a secondary
+	// index that was not configured with WithSecondaryIndex
+	ErrIndexNotFound = errors.New("error: secondary index not found")
+)
+
+// secondaryIndex maps the terms extracted from the keys and values of the
+// database to the keys they were extracted from
+type secondaryIndex struct {
+	extract func(key, value []byte) [][]byte
+
+	// terms maps each term to the set of keys holding it
+	terms art.Tree
+	// keys maps each key to the terms extracted from it, so that they can be
+	// removed when the key is overwritten or deleted without reading its
+	// value again
+	keys map[string][][]byte
+}
+
+func newSecondaryIndex(extract func(key, value []byte) [][]byte) *secondaryIndex {
+	return &secondaryIndex{
+		extract: extract,
+		terms:   art.New(),
+		keys:    make(map[string][][]byte),
+	}
+}
+
+func (idx *secondaryIndex) add(key []byte, terms [][]byte) {
+	idx.remove(key)
+
+	if len(terms) == 0 {
+		return
+	}
+
+	// The terms may share the value's memory, which the caller may reuse
+	for i, term := range terms {
+		terms[i] = append([]byte(nil), term...)
+	}
+	idx.keys[string(key)] = terms
+
+	for _, term := range terms {
+		keys, found := idx.terms.Search(term)
+		if !found {
+			keys = make(map[string]struct{})
+			idx.terms.Insert(term, keys)
+		}
+		keys.(map[string]struct{})[string(key)] = struct{}{}
+	}
+}
+
+func (idx *secondaryIndex) remove(key []byte) {
+	for _, term := range idx.keys[string(key)] {
+		keys, found := idx.terms.Search(term)
+		if !found {
+			continue
+		}
+		delete(keys.(map[string]struct{}), string(key))
+		if len(keys.(map[string]struct{})) == 0 {
+			idx.terms.Delete(term)
+		}
+	}
+	delete(idx.keys, string(key))
+}
+
+// Lookup returns the keys, in order, from which the secondary index `name`
+// (see WithSecondaryIndex) extracted `term`. If no such index is configured
+// ErrIndexNotFound is returned.
+func (b *Bitcask) Lookup(name string, term []byte) ([][]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	idx, ok := b.indexes[name]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+
+	keys, found := idx.terms.Search(term)
+	if !found {
+		return nil, nil
+	}
+
+	var result [][]byte
+	for key := range keys.(map[string]struct{}) {
+		if value, found := b.trie.Search([]byte(key)); found && !b.expired(value.(internal.Item)) {
+			result = append(result, b.stripKey([]byte(key)))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return string(result[i]) < string(result[j])
+	})
+	return result, nil
+}
+
+// indexKey adds `key` with `value` to the secondary indexes. The caller must
+// hold the write lock.
+func (b *Bitcask) indexKey(key, value []byte) {
+	for _, idx := range b.indexes {
+		var terms [][]byte
+		b.hook(func() { terms = idx.extract(b.stripKey(key), value) })
+		idx.add(key, terms)
+	}
+}
+
+// unindexKey removes `key` from the secondary indexes along with the terms
+// extracted from its current value. The caller must hold the write lock
+// taken to delete it so that Lookup() never sees it deleted but indexed.
+func (b *Bitcask) unindexKey(key []byte) {
+	for _, idx := range b.indexes {
+		idx.remove(key)
+	}
+}
+
+// buildIndexes builds the configured secondary indexes from scratch by
+// reading the value of every key. The caller must hold the write lock.
+func (b *Bitcask) buildIndexes() (err error) {
+	if len(b.config.SecondaryIndexes) == 0 {
+		return nil
+	}
+
+	b.indexes = make(map[string]*secondaryIndex, len(b.config.SecondaryIndexes))
+	for name, extract := range b.config.SecondaryIndexes {
+		b.indexes[name] = newSecondaryIndex(extract)
+	}
+
+	b.forEachPrefix(b.config.KeyPrefix, func(node art.Node) bool {
+		var value []byte
+		if value, err = b.readItem(node.Value().(internal.Item)); err != nil {
+			return false
+		}
+		b.indexKey(node.Key(), value)
+		return true
+	})
+	return
+}
@@ -0,0 +1,90 @@
+package bitcask
+
+import (
+	"bytes"
+)
+
+// watchBufferSize is the number of events buffered for each watcher
+const watchBufferSize = 128
+
+// EventType is the type of change to a key reported by an Event
+type EventType int
+
+const (
+	// EventPut is a key written by Put() (or any of its variants)
+	EventPut EventType = iota
+	// EventDelete is a key removed by Delete(), DeleteAll() or Clear()
+	EventDelete
+)
+
+// Event is a change to a key streamed by Watch()
+type Event struct {
+	Type  EventType
+	Key   []byte
+	Value []byte // nil for EventDelete
+}
+
+type watcher struct {
+	prefix []byte
+	events chan Event
+}
+
+// Watch streams the changes to keys matching the given prefix (an empty
+// prefix matches all keys) in the order they are made. The returned function
+// stops watching and closes the channel, which is also closed when the
+// database is closed.
+//
+// Each watcher buffers a limited number of events. Writes never block on
+// watchers, so if a watcher falls behind and its buffer is full further
+// events are dropped for it until it catches up.
+func (b *Bitcask) Watch(prefix []byte) (<-chan Event, func()) {
+	w := &watcher{
+		prefix: b.storedKey(prefix),
+		events: make(chan Event, watchBufferSize),
+	}
+
+	b.mu.Lock()
+	if b.watchers == nil {
+		b.watchers = make(map[*watcher]struct{})
+	}
+	b.watchers[w] = struct{}{}
+	b.mu.Unlock()
+
+	return w.events, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.watchers[w]; ok {
+			delete(b.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+// notify sends the change of `key` to the watchers of matching prefixes. The
+// caller must hold the write lock.
+func (b *Bitcask) notify(typ EventType, key, value []byte) {
+	var e *Event
+	for w := range b.watchers {
+		if !bytes.HasPrefix(key, w.prefix) {
+			continue
+		}
+		if e == nil {
+			e = &Event{Type: typ, Key: append([]byte(nil), b.stripKey(key)...)}
+			if typ == EventPut {
+				e.Value = append([]byte{}, value...)
+			}
+		}
+		select {
+		case w.events <- *e:
+		default:
+		}
+	}
+}
+
+// closeWatchers stops all watchers. The caller must hold the write lock.
+func (b *Bitcask) closeWatchers() {
+	for w := range b.watchers {
+		delete(b.watchers, w)
+		close(w.events)
+	}
+}